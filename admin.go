@@ -0,0 +1,45 @@
+package gossipcache
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminHandler returns an http.Handler exposing the state of the node
+// as JSON, to be mounted using http.StripPrefix:
+//
+//   - GET /groups, the groups registered on this node
+//   - GET /mismatches, the groups other nodes registered differently
+//   - GET /status, the health of the gossip transport
+//   - GET /peers, the health of the other nodes
+//   - GET /hot, the hot keys of each group
+func (gc *GossipCache) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /groups", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, req, http.StatusOK, gc.GroupSpecs())
+	})
+	mux.HandleFunc("GET /mismatches", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, req, http.StatusOK, gc.GroupMismatches())
+	})
+	mux.HandleFunc("GET /status", func(rw http.ResponseWriter, req *http.Request) {
+		status := gc.Status()
+		writeJSON(rw, req, http.StatusOK, &status)
+	})
+	mux.HandleFunc("GET /peers", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, req, http.StatusOK, gc.PeerStatus())
+	})
+	mux.HandleFunc("GET /hot", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, req, http.StatusOK, gc.HotKeyStats())
+	})
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, req *http.Request, code int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+
+	if req.Method != http.MethodHead {
+		_ = json.NewEncoder(rw).Encode(v)
+	}
+}
@@ -0,0 +1,37 @@
+package gossipcache
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// AdvertiseAddr returns the address memberlist advertises for this node,
+// normalised to be used in URLs
+func AdvertiseAddr(cfg *memberlist.Config) (netip.Addr, error) {
+	if cfg == nil || cfg.Transport == nil {
+		return netip.Addr{}, errors.New("memberlist transport not ready")
+	}
+
+	ip, _, err := cfg.Transport.FinalAdvertiseAddr(cfg.AdvertiseAddr, cfg.AdvertisePort)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, errors.New("invalid advertise address")
+	}
+
+	return NormalizeAdvertiseAddr(addr), nil
+}
+
+// NormalizeAdvertiseAddr unmaps IPv4-mapped IPv6 addresses and removes
+// zones, as those are only meaningful locally
+func NormalizeAdvertiseAddr(addr netip.Addr) netip.Addr {
+	if addr.IsValid() {
+		addr = addr.Unmap().WithZone("")
+	}
+	return addr
+}
@@ -0,0 +1,80 @@
+package gossipcache
+
+import (
+	"net/netip"
+	"testing"
+
+	"darvaza.org/core"
+
+	"darvaza.org/gossipcache/transport"
+)
+
+func TestNormalizeAdvertiseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"fe80::1%eth0", "fe80::1"},
+	} {
+		addr := NormalizeAdvertiseAddr(netip.MustParseAddr(tc.in))
+		if s := addr.String(); s != tc.out {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.out, s)
+		}
+	}
+
+	if addr := NormalizeAdvertiseAddr(netip.Addr{}); addr.IsValid() {
+		t.Errorf("invalid address normalised to %q", addr)
+	}
+}
+
+func TestPrepareCacheBaseURLAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		url  string
+		port int
+		out  string
+	}{
+		{"192.0.2.1", "", 0, "https://192.0.2.1"},
+		{"192.0.2.1", "http://", 8080, "http://192.0.2.1:8080"},
+		{"2001:db8::1", "", 0, "https://[2001:db8::1]"},
+		{"2001:db8::1", "https://", 8443, "https://[2001:db8::1]:8443"},
+		{"::ffff:192.0.2.1", "http://", 80, "http://192.0.2.1"},
+		{"fe80::1%eth0", "https://", 0, "https://[fe80::1]"},
+		{"fe80::1%eth0", "http://:8080/path?q", 9090, "http://[fe80::1]:8080"},
+	} {
+		addr := NormalizeAdvertiseAddr(netip.MustParseAddr(tc.addr))
+		s, err := prepareCacheBaseURL(tc.url, tc.port, func() (netip.Addr, error) {
+			return addr, nil
+		})
+
+		switch {
+		case err != nil:
+			t.Errorf("%q %q: %v", tc.addr, tc.url, err)
+		case s != tc.out:
+			t.Errorf("%q %q: expected %q, got %q", tc.addr, tc.url, tc.out, s)
+		}
+	}
+}
+
+func TestConfigAdvertiseAddrHint(t *testing.T) {
+	conf := &Config{}
+	if s := conf.advertiseAddrHint(); s != "0" {
+		t.Errorf("expected unspecified hint, got %q", s)
+	}
+
+	conf.Transport = &transport.Config{
+		BindInterface: []string{"lo"},
+	}
+	if addrs, _ := core.GetStringIPAddresses("lo"); len(addrs) > 0 {
+		if s := conf.advertiseAddrHint(); s != addrs[0] {
+			t.Errorf("expected %q from BindInterface, got %q", addrs[0], s)
+		}
+	}
+
+	conf.Transport.BindAddress = []string{"192.0.2.1"}
+	if s := conf.advertiseAddrHint(); s != "192.0.2.1" {
+		t.Errorf("expected BindAddress, got %q", s)
+	}
+}
@@ -0,0 +1,176 @@
+package gossipcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// gossipMsgMagic starts the messages we broadcast, telling
+	// them apart from those of the user
+	gossipMsgMagic byte = 0xe8
+
+	// gossipMsgHotKeys announces the hot keys of a group,
+	// [magic][type][group len uvarint][group]([key len uvarint][key])*
+	gossipMsgHotKeys byte = 1
+
+	// maxGossipMsg is the largest message we broadcast, so
+	// they fit in a packet along with memberlist's own
+	maxGossipMsg = 512
+)
+
+// gossipBroadcast is a message for memberlist to broadcast,
+// about a group, as part of an announcement
+type gossipBroadcast struct {
+	group string
+	seq   uint64
+	msg   []byte
+}
+
+// Invalidates tells if this message replaces another, as it
+// belongs to a later announcement about the same group
+func (b *gossipBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*gossipBroadcast)
+	return ok && o.group == b.group && o.seq < b.seq
+}
+
+// Message returns the content of the broadcast
+func (b *gossipBroadcast) Message() []byte { return b.msg }
+
+// Finished is called when the message won't be sent anymore
+func (*gossipBroadcast) Finished() {}
+
+// WithHotKeyBroadcasts creates a configuration option to announce the
+// hot keys of the Groups using WithHotKeys to the rest of the cluster,
+// and keep copies of the ones the other nodes announce. Its messages
+// are sent and handled before those of the NotifyMsg and GetBroadcasts
+// delegates, which get the rest
+func WithHotKeyBroadcasts(gc *GossipCache) ClusterConfigOption {
+	opt := func(cluster *Cluster, conf *memberlist.Config) error {
+		if gc == nil {
+			return errors.New("invalid GossipCache")
+		}
+
+		q := &memberlist.TransmitLimitedQueue{
+			NumNodes: func() int {
+				if ml := cluster.members; ml != nil {
+					return ml.NumMembers()
+				}
+				return 1
+			},
+			RetransmitMult: conf.RetransmitMult,
+		}
+
+		gc.mu.Lock()
+		gc.broadcasts = q
+		gc.mu.Unlock()
+
+		delegate := &cluster.delegate
+		delegate.addBroadcastHook(func(_ *Cluster, overhead, limit int) [][]byte {
+			return q.GetBroadcasts(overhead, limit)
+		})
+		delegate.addMsgHook(func(_ *Cluster, msg []byte) bool {
+			return gc.handleGossipMsg(msg)
+		})
+
+		conf.Delegate = delegate
+		return nil
+	}
+	return opt
+}
+
+// announceHotKeys queues the broadcast of the hot keys of a group,
+// reporting false if broadcasts aren't enabled
+func (gc *GossipCache) announceHotKeys(group string, keys []string) bool {
+	gc.mu.Lock()
+	q := gc.broadcasts
+	gc.broadcastSeq++
+	seq := gc.broadcastSeq
+	gc.mu.Unlock()
+
+	if q == nil {
+		return false
+	}
+
+	for _, msg := range encodeHotKeys(group, keys) {
+		q.QueueBroadcast(&gossipBroadcast{
+			group: group,
+			seq:   seq,
+			msg:   msg,
+		})
+	}
+	return true
+}
+
+// handleGossipMsg handles the messages we broadcast,
+// reporting false for those of the user
+func (gc *GossipCache) handleGossipMsg(msg []byte) bool {
+	if len(msg) < 2 || msg[0] != gossipMsgMagic {
+		return false
+	}
+
+	switch msg[1] {
+	case gossipMsgHotKeys:
+		group, keys, ok := decodeHotKeys(msg[2:])
+		if !ok {
+			gc.warn().Print("Invalid hot keys message received")
+			break
+		}
+
+		if g := gc.LoaderGroup(group); g != nil && g.hot != nil {
+			g.markHot(keys)
+		}
+	}
+	return true
+}
+
+// encodeHotKeys encodes the hot keys of a group in as
+// many messages as needed
+func encodeHotKeys(group string, keys []string) [][]byte {
+	var out [][]byte
+
+	head := []byte{gossipMsgMagic, gossipMsgHotKeys}
+	head = binary.AppendUvarint(head, uint64(len(group)))
+	head = append(head, group...)
+
+	msg := slices.Clone(head)
+	for _, key := range keys {
+		size := binary.MaxVarintLen64 + len(key)
+		switch {
+		case len(head)+size > maxGossipMsg:
+			// too long to announce
+			continue
+		case len(msg)+size > maxGossipMsg:
+			out = append(out, msg)
+			msg = slices.Clone(head)
+		}
+
+		msg = binary.AppendUvarint(msg, uint64(len(key)))
+		msg = append(msg, key...)
+	}
+
+	if len(msg) > len(head) {
+		out = append(out, msg)
+	}
+	return out
+}
+
+func decodeHotKeys(buf []byte) (group string, keys []string, ok bool) {
+	b, buf, ok := nextField(buf)
+	if !ok || len(b) == 0 {
+		return "", nil, false
+	}
+	group = string(b)
+
+	for len(buf) > 0 {
+		b, buf, ok = nextField(buf)
+		if !ok {
+			return "", nil, false
+		}
+		keys = append(keys, string(b))
+	}
+	return group, keys, true
+}
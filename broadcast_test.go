@@ -0,0 +1,79 @@
+package gossipcache
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func newTestDelegate(t *testing.T, options ...ClusterConfigOption) *ClusterDelegate {
+	t.Helper()
+
+	cluster := &Cluster{}
+	conf := memberlist.DefaultLocalConfig()
+	for _, opt := range options {
+		if err := opt(cluster, conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &cluster.delegate
+}
+
+// TestHotKeyBroadcastsChained checks the user's delegates keep
+// working alongside the hot key announcements
+func TestHotKeyBroadcastsChained(t *testing.T) {
+	gc := &GossipCache{}
+
+	var received [][]byte
+	delegate := newTestDelegate(t,
+		WithNotifyMsgDelegate(func(_ *Cluster, msg []byte) {
+			received = append(received, msg)
+		}),
+		WithGetBroadcastDelegate(func(*Cluster, int, int) [][]byte {
+			return [][]byte{[]byte("user broadcast")}
+		}),
+		WithHotKeyBroadcasts(gc),
+	)
+
+	if !gc.announceHotKeys("group", []string{"key"}) {
+		t.Fatal("broadcasts not enabled")
+	}
+
+	out := delegate.GetBroadcasts(2, 1024)
+	if len(out) != 2 || string(out[1]) != "user broadcast" {
+		t.Fatalf("unexpected broadcasts %q", out)
+	}
+
+	delegate.NotifyMsg(out[0])
+	delegate.NotifyMsg([]byte("user message"))
+	if len(received) != 1 || string(received[0]) != "user message" {
+		t.Fatalf("unexpected messages %q", received)
+	}
+}
+
+// TestHotKeyBroadcastsInvalidate checks announcements replace the
+// earlier ones of the same group still queued
+func TestHotKeyBroadcastsInvalidate(t *testing.T) {
+	gc := &GossipCache{}
+	delegate := newTestDelegate(t, WithHotKeyBroadcasts(gc))
+
+	gc.announceHotKeys("a", []string{"old"})
+	gc.announceHotKeys("b", []string{"other"})
+	gc.announceHotKeys("a", []string{"new"})
+
+	if n := gc.broadcasts.NumQueued(); n != 2 {
+		t.Fatalf("expected 2 queued broadcasts, got %v", n)
+	}
+
+	out := delegate.GetBroadcasts(2, 1024)
+	expected := [][]byte{
+		encodeHotKeys("a", []string{"new"})[0],
+		encodeHotKeys("b", []string{"other"})[0],
+	}
+	for _, msg := range expected {
+		if !slices.ContainsFunc(out, func(b []byte) bool { return slices.Equal(b, msg) }) {
+			t.Fatalf("%q not broadcast", msg)
+		}
+	}
+}
@@ -2,15 +2,23 @@ package gossipcache
 
 import (
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"net/netip"
 	"os"
 	"time"
 
 	"darvaza.org/core"
 	"darvaza.org/slog"
 	"github.com/hashicorp/memberlist"
+
+	"darvaza.org/gossipcache/transport"
 )
 
+// AdvertiseUpdateTimeout is how long we wait for the cluster to
+// acknowledge a change of our advertised address
+const AdvertiseUpdateTimeout = 10 * time.Second
+
 var (
 	_ ClusterConfigOption = WithAddress("")
 	_ ClusterConfigOption = WithGossipPort(0)
@@ -23,6 +31,12 @@ var (
 	_ ClusterConfigOption = WithDefaultWANConfig()
 	_ ClusterConfigOption = WithDefaultLocalConfig()
 	_ ClusterConfigOption = WithTransport(nil)
+	_ ClusterConfigOption = WithNodeRoutes(nil, nil)
+	_ ClusterConfigOption = WithAdvertiseUpdates(nil)
+	_ ClusterConfigOption = WithLeaveOnTransportFailure(nil, 0)
+	_ ClusterConfigOption = WithGroupRegistry(nil, false)
+	_ ClusterConfigOption = WithPeerHealth(nil, nil)
+	_ ClusterConfigOption = WithHotKeyBroadcasts(nil)
 
 	_ ClusterConfigOption = WithDelegateProtocolVersion(0, 0, 0)
 	_ ClusterConfigOption = WithNodeMetaDelegate(nil)
@@ -107,6 +121,76 @@ func WithTransport(transport memberlist.Transport) ClusterConfigOption {
 	return opt
 }
 
+// WithNodeRoutes creates a configuration option to keep the routing table
+// of a transport.Transport in sync with the cluster members, using the given
+// callback to extract the Route from the Node, typically from its metadata
+func WithNodeRoutes(t *transport.Transport,
+	decode func(*memberlist.Node) (transport.Route, bool)) ClusterConfigOption {
+	opt := func(cluster *Cluster, conf *memberlist.Config) error {
+		if t == nil || decode == nil {
+			return errors.New("invalid node routes")
+		}
+
+		delegate := &cluster.delegate
+		delegate.addEventHook(func(_ *Cluster, node *memberlist.Node,
+			ev memberlist.NodeEventType) {
+			if r, ok := decode(node); ok && ev != memberlist.NodeLeave {
+				t.SetRoute(node.Name, r)
+			} else {
+				t.RemoveRoute(node.Name)
+			}
+		})
+
+		conf.Events = delegate
+		return nil
+	}
+	return opt
+}
+
+// WithAdvertiseUpdates creates a configuration option to announce to
+// the cluster when a transport.Transport chooses a new address to
+// advertise, like when the previous one disappears from the host.
+// Memberlist keeps announcing the address the node joined with, so
+// the node metadata is updated instead. For the other nodes to use
+// the new address it has to be part of the metadata, from
+// Transport.AdvertiseAddr(), and be their Route to this node through
+// WithNodeRoutes
+func WithAdvertiseUpdates(t *transport.Transport) ClusterConfigOption {
+	opt := func(cluster *Cluster, _ *memberlist.Config) error {
+		if t == nil {
+			return errors.New("invalid transport")
+		}
+
+		t.OnAdvertiseChange(func(netip.AddrPort) {
+			if ml := cluster.members; ml != nil {
+				_ = ml.UpdateNode(AdvertiseUpdateTimeout)
+			}
+		})
+		return nil
+	}
+	return opt
+}
+
+// WithLeaveOnTransportFailure creates a configuration option to
+// gracefully leave the cluster, waiting up to the given timeout,
+// and shut down the memberlist when a transport.Transport fails
+func WithLeaveOnTransportFailure(t *transport.Transport, timeout time.Duration) ClusterConfigOption {
+	opt := func(cluster *Cluster, _ *memberlist.Config) error {
+		if t == nil {
+			return errors.New("invalid transport")
+		}
+
+		t.NotifyFailure(func(error) {
+			if ml := cluster.members; ml != nil {
+				_ = ml.Leave(timeout)
+				go func() { _ = ml.Shutdown() }()
+			}
+		})
+		return nil
+	}
+	return opt
+}
+
 // WithGossipKeyBase64 creates a configuration option for the cluster's encryption
 func WithGossipKeyBase64(salt, key string) ClusterConfigOption {
 	bkey, err := base64.RawStdEncoding.DecodeString(key)
@@ -391,12 +475,16 @@ type ClusterDelegate struct {
 	// Delegate
 	nodeMeta         func(*Cluster, int) []byte
 	notifyMsg        func(*Cluster, []byte)
+	msgHooks         []func(*Cluster, []byte) bool
 	getBroadcasts    func(c *Cluster, overhead, limit int) [][]byte
+	broadcastHooks   []func(c *Cluster, overhead, limit int) [][]byte
 	localState       func(*Cluster, bool) []byte
 	mergeRemoteState func(*Cluster, []byte, bool)
+	stateHooks       []stateHook
 
 	// EventDelegate
-	event func(*Cluster, *memberlist.Node, memberlist.NodeEventType)
+	event      func(*Cluster, *memberlist.Node, memberlist.NodeEventType)
+	eventHooks []func(*Cluster, *memberlist.Node, memberlist.NodeEventType)
 	// ConflictDelegate
 	conflict func(c *Cluster, existing, other *memberlist.Node)
 	// MergeDelegate
@@ -404,8 +492,22 @@ type ClusterDelegate struct {
 	// PingDeletegate
 	ackPayload   []byte
 	pingComplete func(*Cluster, *memberlist.Node, time.Duration, []byte)
+	pingHooks    []func(*Cluster, *memberlist.Node, time.Duration)
 	// AliveDelegate
-	alive func(*Cluster, *memberlist.Node) error
+	alive      func(*Cluster, *memberlist.Node) error
+	aliveHooks []func(*Cluster, *memberlist.Node) error
+}
+
+// gossipStateMagic starts the push/pull state when there are
+// stateHooks, telling it apart from the user's alone
+const gossipStateMagic byte = 0xe9
+
+// stateHook contributes to the push/pull state alongside the user's,
+// identified by its id
+type stateHook struct {
+	id    byte
+	local func(*Cluster, bool) []byte
+	merge func(*Cluster, []byte, bool)
 }
 
 // NodeMeta is used to retrieve meta-data about the current node
@@ -417,55 +519,148 @@ func (cd *ClusterDelegate) NodeMeta(limit int) []byte {
 	return nil
 }
 
+// addMsgHook adds a handler called on user-data messages before
+// the user's, which is skipped if the hook reports it handled them
+func (cd *ClusterDelegate) addMsgHook(fn func(*Cluster, []byte) bool) {
+	cd.msgHooks = append(cd.msgHooks, fn)
+}
+
 // NotifyMsg is called when a user-data message is received.
 func (cd *ClusterDelegate) NotifyMsg(userData []byte) {
+	for _, fn := range cd.msgHooks {
+		if fn(cd.cluster, userData) {
+			return
+		}
+	}
+
 	if fn := cd.notifyMsg; fn != nil {
 		fn(cd.cluster, userData)
 	}
 }
 
+// addBroadcastHook adds a handler providing messages to broadcast
+// before the user's, which gets the space left
+func (cd *ClusterDelegate) addBroadcastHook(fn func(c *Cluster, overhead, limit int) [][]byte) {
+	cd.broadcastHooks = append(cd.broadcastHooks, fn)
+}
+
 // GetBroadcasts is called when user data messages can be broadcast.
 func (cd *ClusterDelegate) GetBroadcasts(overhead, limit int) [][]byte {
-	if fn := cd.getBroadcasts; fn != nil {
-		return fn(cd.cluster, overhead, limit)
+	var out [][]byte
+
+	for _, fn := range cd.broadcastHooks {
+		for _, msg := range fn(cd.cluster, overhead, limit) {
+			limit -= overhead + len(msg)
+			out = append(out, msg)
+		}
 	}
-	return nil
+
+	if fn := cd.getBroadcasts; fn != nil && limit > overhead {
+		out = append(out, fn(cd.cluster, overhead, limit)...)
+	}
+	return out
 }
 
-// LocalState is used for a TCP Push/Pull
+// addStateHook adds a contributor to the push/pull state,
+// placed before the user's
+func (cd *ClusterDelegate) addStateHook(id byte, local func(*Cluster, bool) []byte,
+	merge func(*Cluster, []byte, bool)) {
+	cd.stateHooks = append(cd.stateHooks, stateHook{id: id, local: local, merge: merge})
+}
+
+// LocalState is used for a TCP Push/Pull. With hooks the state is
+// [magic]([id][len uvarint][state])*[0] followed by the user's
 func (cd *ClusterDelegate) LocalState(join bool) []byte {
+	var out []byte
+
+	if len(cd.stateHooks) > 0 {
+		out = append(out, gossipStateMagic)
+		for _, h := range cd.stateHooks {
+			b := h.local(cd.cluster, join)
+			out = append(out, h.id)
+			out = binary.AppendUvarint(out, uint64(len(b)))
+			out = append(out, b...)
+		}
+		out = append(out, 0)
+	}
+
 	if fn := cd.localState; fn != nil {
-		return fn(cd.cluster, join)
+		out = append(out, fn(cd.cluster, join)...)
 	}
-	return nil
+	return out
 }
 
 // MergeRemoteState is invoked after a TCP Push/Pull
 func (cd *ClusterDelegate) MergeRemoteState(buf []byte, join bool) {
+	buf = cd.mergeStateHooks(buf, join)
+
 	if fn := cd.mergeRemoteState; fn != nil {
 		fn(cd.cluster, buf, join)
 	}
 }
 
-// NotifyJoin is invoked when a node is detected to have joined.
-func (cd *ClusterDelegate) NotifyJoin(node *memberlist.Node) {
+// mergeStateHooks hands the states of the hooks to them, returning
+// what remains for the user's
+func (cd *ClusterDelegate) mergeStateHooks(buf []byte, join bool) []byte {
+	if len(buf) == 0 || buf[0] != gossipStateMagic {
+		return buf
+	}
+
+	for b := buf[1:]; len(b) > 0; {
+		id := b[0]
+		if id == 0 {
+			return b[1:]
+		}
+
+		size, n := binary.Uvarint(b[1:])
+		if n <= 0 || uint64(len(b)-1-n) < size {
+			break
+		}
+
+		state := b[1+n : 1+n+int(size)]
+		b = b[1+n+int(size):]
+
+		for _, h := range cd.stateHooks {
+			if h.id == id {
+				h.merge(cd.cluster, state, join)
+			}
+		}
+	}
+
+	// truncated, not ours
+	return buf
+}
+
+// addEventHook adds a handler called on node events before
+// the user's
+func (cd *ClusterDelegate) addEventHook(fn func(*Cluster,
+	*memberlist.Node, memberlist.NodeEventType)) {
+	cd.eventHooks = append(cd.eventHooks, fn)
+}
+
+func (cd *ClusterDelegate) notifyEvent(node *memberlist.Node, ev memberlist.NodeEventType) {
+	for _, fn := range cd.eventHooks {
+		fn(cd.cluster, node, ev)
+	}
+
 	if fn := cd.event; fn != nil {
-		fn(cd.cluster, node, memberlist.NodeJoin)
+		fn(cd.cluster, node, ev)
 	}
 }
 
+// NotifyJoin is invoked when a node is detected to have joined.
+func (cd *ClusterDelegate) NotifyJoin(node *memberlist.Node) {
+	cd.notifyEvent(node, memberlist.NodeJoin)
+}
+
 // NotifyLeave is invoked when a node is detected to have left.
 func (cd *ClusterDelegate) NotifyLeave(node *memberlist.Node) {
-	if fn := cd.event; fn != nil {
-		fn(cd.cluster, node, memberlist.NodeLeave)
-	}
+	cd.notifyEvent(node, memberlist.NodeLeave)
 }
 
 // NotifyUpdate is invoked when a node is detected to have
 func (cd *ClusterDelegate) NotifyUpdate(node *memberlist.Node) {
-	if fn := cd.event; fn != nil {
-		fn(cd.cluster, node, memberlist.NodeUpdate)
-	}
+	cd.notifyEvent(node, memberlist.NodeUpdate)
 }
 
 // NotifyConflict is invoked when a name conflict is detected
@@ -488,16 +683,38 @@ func (cd *ClusterDelegate) AckPayload() []byte {
 	return cd.ackPayload
 }
 
+// addPingHook adds a handler called when a ping completes
+// before the user's
+func (cd *ClusterDelegate) addPingHook(fn func(*Cluster, *memberlist.Node, time.Duration)) {
+	cd.pingHooks = append(cd.pingHooks, fn)
+}
+
 // NotifyPingComplete is invoked when an ack for a ping is received
 func (cd *ClusterDelegate) NotifyPingComplete(peer *memberlist.Node,
 	rtt time.Duration, payload []byte) {
+	for _, fn := range cd.pingHooks {
+		fn(cd.cluster, peer, rtt)
+	}
+
 	if fn := cd.pingComplete; fn != nil {
 		fn(cd.cluster, peer, rtt, payload)
 	}
 }
 
+// addAliveHook adds a check of alive messages run before
+// the user's
+func (cd *ClusterDelegate) addAliveHook(fn func(*Cluster, *memberlist.Node) error) {
+	cd.aliveHooks = append(cd.aliveHooks, fn)
+}
+
 // NotifyAlive is invoked when a message about a live node is received from the network
 func (cd *ClusterDelegate) NotifyAlive(peer *memberlist.Node) error {
+	for _, fn := range cd.aliveHooks {
+		if err := fn(cd.cluster, peer); err != nil {
+			return err
+		}
+	}
+
 	if fn := cd.alive; fn != nil {
 		return fn(cd.cluster, peer)
 	}
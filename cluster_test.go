@@ -0,0 +1,169 @@
+package gossipcache
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"darvaza.org/gossipcache/transport"
+)
+
+// newTestTransport creates a transport.Transport on loopback
+func newTestTransport(t *testing.T) *transport.Transport {
+	t.Helper()
+
+	tr, err := transport.New(&transport.Config{
+		BindAddress: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = tr.Shutdown() })
+	return tr
+}
+
+// newTestCluster creates a memberlist node using the given transport
+func newTestCluster(t *testing.T, name string, tr *transport.Transport,
+	options ...ClusterConfigOption) *Cluster {
+	t.Helper()
+
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = name
+	conf.LogOutput = io.Discard
+
+	options = append([]ClusterConfigOption{WithTransport(tr)}, options...)
+	cluster, err := NewCluster(conf, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = cluster.members.Shutdown() })
+	return cluster
+}
+
+// joinTestCluster joins a node to the cluster of another
+func joinTestCluster(t *testing.T, cluster, other *Cluster) {
+	t.Helper()
+
+	node := other.members.LocalNode()
+	if _, err := cluster.members.Join([]string{node.FullAddress().Addr}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAdvertiseUpdates checks the other nodes follow a node
+// advertising a new address through its metadata
+func TestAdvertiseUpdates(t *testing.T) {
+	tb := newTestTransport(t)
+	received := make(chan string, 1)
+	b := newTestCluster(t, "b", tb,
+		WithAdvertiseUpdates(tb),
+		WithNodeMetaDelegate(func(*Cluster, int) []byte {
+			ap, _ := tb.AdvertiseAddr()
+			return []byte(ap.String())
+		}),
+		WithNotifyMsgDelegate(func(_ *Cluster, msg []byte) {
+			received <- string(msg)
+		}),
+	)
+
+	ta := newTestTransport(t)
+	a := newTestCluster(t, "a", ta,
+		WithNodeRoutes(ta, func(node *memberlist.Node) (transport.Route, bool) {
+			return transport.Route{Addr: string(node.Meta)}, len(node.Meta) > 0
+		}),
+	)
+
+	joinTestCluster(t, a, b)
+
+	// b moves to another address, and stops listening
+	// on the one memberlist knows
+	if err := tb.AddListener("127.0.0.2"); err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	if err := tb.RemoveListener("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, _ := tb.AdvertiseAddr()
+	if moved.Addr() != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("advertising %v after the move", moved)
+	}
+
+	nodeB := b.members.LocalNode()
+	dest := memberlist.Address{Addr: nodeB.Address(), Name: nodeB.Name}
+	waitFor(t, 5*time.Second, "the new address", func() bool {
+		return ta.Route(dest).Target(dest.Addr) == moved.String()
+	})
+
+	// a reaches b through the new address
+	for _, node := range a.members.Members() {
+		if node.Name == "b" {
+			if err := a.members.SendReliable(node, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message never arrived")
+	}
+}
+
+// TestNodeRoutes checks the routing table of the transport follows
+// the metadata of the members, falling back to the memberlist address
+// when a node stops announcing a route or leaves
+func TestNodeRoutes(t *testing.T) {
+	tr := newTestTransport(t)
+	delegate := newTestDelegate(t,
+		WithNodeRoutes(tr, func(node *memberlist.Node) (transport.Route, bool) {
+			return transport.Route{Addr: string(node.Meta)}, len(node.Meta) > 0
+		}),
+	)
+
+	node := &memberlist.Node{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946}
+	dest := memberlist.Address{Addr: node.Address(), Name: node.Name}
+	target := func() string {
+		return tr.Route(dest).Target(dest.Addr)
+	}
+
+	for _, step := range []struct {
+		notify   func(*memberlist.Node)
+		meta     string
+		expected string
+	}{
+		{delegate.NotifyJoin, "192.0.2.1:7946", "192.0.2.1:7946"},
+		{delegate.NotifyUpdate, "192.0.2.2:7946", "192.0.2.2:7946"},
+		{delegate.NotifyUpdate, "", "127.0.0.1:7946"},
+		{delegate.NotifyUpdate, "192.0.2.3:7946", "192.0.2.3:7946"},
+		{delegate.NotifyLeave, "192.0.2.3:7946", "127.0.0.1:7946"},
+	} {
+		node.Meta = []byte(step.meta)
+		step.notify(node)
+
+		if s := target(); s != step.expected {
+			t.Fatalf("expected %q, got %q", step.expected, s)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// gossip-replay inspects recordings of gossip traffic, and replays
+// them into a fresh memberlist instance to reproduce incidents offline
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	"darvaza.org/gossipcache/transport/record"
+)
+
+type options struct {
+	dump  bool
+	keys  string
+	label string
+	name  string
+	speed float64
+}
+
+func main() {
+	var opts options
+
+	flag.BoolVar(&opts.dump, "dump", false, "print the recording instead of replaying it")
+	flag.StringVar(&opts.keys, "keys", "", "comma separated base64 gossip keys, primary first")
+	flag.StringVar(&opts.label, "label", "", "gossip label of the cluster, the salt given to WithGossipKey")
+	flag.StringVar(&opts.name, "name", "", "node name of the recorded node, hostname if empty")
+	flag.Float64Var(&opts.speed, "speed", 1, "replay speed multiplier, 0 for no waiting")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <recording>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), &opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(filename string, opts *options) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := record.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := newKeyring(opts.keys)
+	if err != nil {
+		return err
+	}
+
+	if opts.dump {
+		return dump(os.Stdout, r, keyring)
+	}
+	return replay(r, keyring, opts)
+}
+
+func newKeyring(s string) (*memberlist.Keyring, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, k := range strings.Split(s, ",") {
+		// as WithGossipKeyBase64, tolerating padding
+		k = strings.TrimRight(strings.TrimSpace(k), "=")
+		key, err := base64.RawStdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+func replay(r *record.Reader, keyring *memberlist.Keyring, opts *options) error {
+	rp, err := record.NewReplayer(r)
+	if err != nil {
+		return err
+	}
+	rp.Speed = opts.speed
+
+	conf := memberlist.DefaultLANConfig()
+	if opts.name != "" {
+		conf.Name = opts.name
+	}
+	conf.Transport = rp
+	conf.Keyring = keyring
+	conf.Label = opts.label
+
+	m, err := memberlist.Create(conf)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := rp.Run(ctx); err != nil {
+		return err
+	}
+
+	// let memberlist digest the last messages
+	time.Sleep(time.Second)
+
+	for _, node := range m.Members() {
+		fmt.Printf("%s\t%s\tstate:%d\n", node.Name, node.Address(), node.State)
+	}
+	return nil
+}
+
+// dump prints the records, decrypting their content if a keyring
+// is given. Stream data is decrypted when the stream is closed
+func dump(w io.Writer, r *record.Reader, keyring *memberlist.Keyring) error {
+	var dec *record.Decrypter
+	if keyring != nil {
+		dec = record.NewDecrypter(keyring)
+	}
+
+	streams := make(map[uint64]*streamData)
+	for {
+		rec, err := r.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		fmt.Fprintf(w, "%12s %-15s", rec.Time.Sub(r.Start), rec.Kind)
+		if rec.Kind >= record.KindStreamAccepted {
+			fmt.Fprintf(w, " #%d", rec.Stream)
+		}
+		if rec.Peer != "" {
+			fmt.Fprintf(w, " %s", rec.Peer)
+		}
+		if len(rec.Data) > 0 {
+			fmt.Fprintf(w, " %d bytes", len(rec.Data))
+		}
+		fmt.Fprintln(w)
+
+		dumpContent(w, dec, streams, rec)
+	}
+}
+
+type streamData struct {
+	received []byte
+	sent     []byte
+}
+
+func dumpContent(w io.Writer, dec *record.Decrypter, streams map[uint64]*streamData,
+	rec *record.Record) {
+	switch rec.Kind {
+	case record.KindPacketReceived, record.KindPacketSent:
+		dumpPacket(w, dec, rec.Data)
+	case record.KindStreamAccepted, record.KindStreamDialed:
+		streams[rec.Stream] = &streamData{}
+	case record.KindStreamReceived:
+		if s, ok := streams[rec.Stream]; ok {
+			s.received = append(s.received, rec.Data...)
+		}
+	case record.KindStreamSent:
+		if s, ok := streams[rec.Stream]; ok {
+			s.sent = append(s.sent, rec.Data...)
+		}
+	case record.KindStreamClosed:
+		if s, ok := streams[rec.Stream]; ok {
+			delete(streams, rec.Stream)
+			dumpStream(w, dec, "received", s.received)
+			dumpStream(w, dec, "sent", s.sent)
+		}
+	}
+}
+
+func dumpPacket(w io.Writer, dec *record.Decrypter, b []byte) {
+	if dec == nil {
+		dumpMessage(w, "", b)
+		return
+	}
+
+	label, plain, err := dec.Packet(b)
+	if err != nil {
+		fmt.Fprintf(w, "%14s %s\n", "", err)
+		return
+	}
+	dumpMessage(w, label, plain)
+}
+
+func dumpStream(w io.Writer, dec *record.Decrypter, dir string, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	if dec == nil {
+		dumpMessage(w, dir, b)
+		return
+	}
+
+	label, msgs, err := dec.Stream(b)
+	for _, msg := range msgs {
+		dumpMessage(w, dir+" "+label, msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%14s %s: %s\n", "", dir, err)
+	}
+}
+
+func dumpMessage(w io.Writer, prefix string, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+
+	n := min(len(b), 32)
+	fmt.Fprintf(w, "%14s %s type:%d %d bytes %x\n", "",
+		strings.TrimSpace(prefix), b[0], len(b), b[:n])
+}
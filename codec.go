@@ -0,0 +1,93 @@
+package gossipcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"strconv"
+)
+
+// Codec converts the values of a TypedGroup to and from bytes
+type Codec[V any] interface {
+	// Tag identifies the encoding and version of the values.
+	// It must change whenever their encoded form does, so nodes
+	// running different code don't decode each other's values
+	Tag() string
+	// Encode converts a value into bytes
+	Encode(V) ([]byte, error)
+	// Decode converts bytes into a value
+	Decode([]byte) (V, error)
+}
+
+func codecTag(name string, version uint) string {
+	return name + "/" + strconv.FormatUint(uint64(version), 10)
+}
+
+// JSONCodec returns a Codec using encoding/json. The version
+// needs to be increased whenever V changes incompatibly
+func JSONCodec[V any](version uint) Codec[V] {
+	return jsonCodec[V]{tag: codecTag("json", version)}
+}
+
+type jsonCodec[V any] struct {
+	tag string
+}
+
+func (c jsonCodec[V]) Tag() string { return c.tag }
+
+func (jsonCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[V]) Decode(b []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// GobCodec returns a Codec using encoding/gob. The version
+// needs to be increased whenever V changes incompatibly
+func GobCodec[V any](version uint) Codec[V] {
+	return gobCodec[V]{tag: codecTag("gob", version)}
+}
+
+type gobCodec[V any] struct {
+	tag string
+}
+
+func (c gobCodec[V]) Tag() string { return c.tag }
+
+func (gobCodec[V]) Encode(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[V]) Decode(b []byte) (V, error) {
+	var v V
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// RawCodec returns a Codec storing byte slices and strings as-is.
+// The version needs to be increased whenever the meaning of the
+// bytes changes
+func RawCodec[V ~[]byte | ~string](version uint) Codec[V] {
+	return rawCodec[V]{tag: codecTag("raw", version)}
+}
+
+type rawCodec[V ~[]byte | ~string] struct {
+	tag string
+}
+
+func (c rawCodec[V]) Tag() string { return c.tag }
+
+func (rawCodec[V]) Encode(v V) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (rawCodec[V]) Decode(b []byte) (V, error) {
+	return V(b), nil
+}
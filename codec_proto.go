@@ -0,0 +1,36 @@
+package gossipcache
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoMessage is a pointer to T implementing proto.Message
+type ProtoMessage[T any] interface {
+	*T
+	proto.Message
+}
+
+// ProtoCodec returns a Codec using protobuf for *T messages.
+// The version needs to be increased whenever the message
+// changes incompatibly
+func ProtoCodec[T any, PT ProtoMessage[T]](version uint) Codec[PT] {
+	return protoCodec[T, PT]{tag: codecTag("proto", version)}
+}
+
+type protoCodec[T any, PT ProtoMessage[T]] struct {
+	tag string
+}
+
+func (c protoCodec[T, PT]) Tag() string { return c.tag }
+
+func (protoCodec[T, PT]) Encode(v PT) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (protoCodec[T, PT]) Decode(b []byte) (PT, error) {
+	v := PT(new(T))
+	if err := proto.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
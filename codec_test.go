@@ -0,0 +1,79 @@
+package gossipcache
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func testCodecRoundTrip[V any](t *testing.T, codec Codec[V], v V, tag string) {
+	t.Helper()
+
+	if s := codec.Tag(); s != tag {
+		t.Fatalf("expected tag %q, got %q", tag, s)
+	}
+
+	b, err := codec.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := codec.Decode(b)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case !reflect.DeepEqual(got, v):
+		t.Fatalf("expected %+v, got %+v", v, got)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	v := testValue{Name: "gossip", Count: 3, Tags: []string{"a", "b"}}
+
+	testCodecRoundTrip(t, JSONCodec[testValue](1), v, "json/1")
+	testCodecRoundTrip(t, GobCodec[testValue](2), v, "gob/2")
+	testCodecRoundTrip(t, RawCodec[string](3), "value", "raw/3")
+	testCodecRoundTrip(t, RawCodec[[]byte](4), []byte("value"), "raw/4")
+}
+
+func TestProtoCodec(t *testing.T) {
+	codec := ProtoCodec[wrapperspb.StringValue](5)
+	if s := codec.Tag(); s != "proto/5" {
+		t.Fatalf("expected tag %q, got %q", "proto/5", s)
+	}
+
+	v := wrapperspb.String("value")
+	b, err := codec.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := codec.Decode(b)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case !proto.Equal(got, v):
+		t.Fatalf("expected %v, got %v", v, got)
+	}
+
+	if _, err := codec.Decode([]byte{0xff}); err == nil {
+		t.Fatal("invalid message decoded")
+	}
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	if _, err := JSONCodec[testValue](1).Decode([]byte("{")); err == nil {
+		t.Fatal("invalid JSON decoded")
+	}
+	if _, err := GobCodec[testValue](1).Decode([]byte("gob")); err == nil {
+		t.Fatal("invalid gob decoded")
+	}
+}
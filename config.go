@@ -3,10 +3,13 @@ package gossipcache
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"darvaza.org/core"
 	"darvaza.org/slog"
@@ -42,8 +45,12 @@ type Config struct {
 	CacheReplicas int
 
 	// CacheBaseURL is the base of the advertised URL for the groupcache.
-	// Path and Query string components will be ignored
+	// Path and Query string components will be ignored, and if the host
+	// is missing the node's AdvertiseAddr will be used
 	CacheBaseURL string
+	// CachePort is the TCP port to use on the CacheBaseURL when it doesn't
+	// specify one. If zero the default port for the scheme is used
+	CachePort int
 	// CacheBasePath is the path under the CacheBaseURL where the groupcache
 	// handler is mounted
 	CacheBasePath string
@@ -79,7 +86,7 @@ func (conf *Config) SetDefaults() error {
 
 	// CacheBaseURL
 	if conf.CacheBaseURL != "" {
-		s, err := PrepareCacheBaseURL(conf.CacheBaseURL)
+		s, err := prepareCacheBaseURL(conf.CacheBaseURL, conf.CachePort, conf.AdvertiseAddr)
 		if err != nil {
 			// failed to sanitise
 			return core.Wrapf(err, "%s: %s: %s", "Config", "CacheBaseURL", "invalid")
@@ -98,11 +105,83 @@ func (conf *Config) SetDefaults() error {
 	return nil
 }
 
-// revive:disable:cyclomatic
-// revive:disable:cognitive-complexity
+func (conf *Config) advertisePolicy() *transport.AdvertisePolicy {
+	if conf.Transport != nil {
+		return conf.Transport.AdvertisePolicy
+	}
+	return nil
+}
+
+// AdvertiseAddr returns the address this node uses to identify itself
+// on the cluster, the same one used by memberlist once the transport
+// is ready, so gossip and the CacheBaseURL agree
+func (conf *Config) AdvertiseAddr() (netip.Addr, error) {
+	if ml := conf.Memberlist; ml != nil && ml.Transport != nil {
+		return AdvertiseAddr(ml)
+	}
+
+	// before the transport exists, follow the same steps
+	// it will.
+	addr, err := core.ParseAddr(conf.advertiseAddrHint())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr, err = transport.ResolveAdvertiseAddr(addr, conf.advertisePolicy())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return NormalizeAdvertiseAddr(addr), nil
+}
+
+func (conf *Config) advertiseAddrHint() string {
+	if ml := conf.Memberlist; ml != nil && ml.AdvertiseAddr != "" {
+		return ml.AdvertiseAddr
+	}
+
+	if tc := conf.Transport; tc != nil {
+		if len(tc.BindAddress) > 0 {
+			return tc.BindAddress[0]
+		}
+
+		if len(tc.BindInterface) > 0 {
+			// the transport will listen on the addresses
+			// of these interfaces, and advertise the first
+			addrs, _ := core.GetStringIPAddresses(tc.BindInterface...)
+			if len(addrs) > 0 {
+				return addrs[0]
+			}
+		}
+	}
+
+	if ml := conf.Memberlist; ml != nil && ml.BindAddr != "" {
+		return ml.BindAddr
+	}
+
+	return "0"
+}
 
 // PrepareCacheBaseURL sanitises a CacheBaseURL value
 func PrepareCacheBaseURL(s string) (string, error) {
+	return PrepareCacheBaseURLWithPolicy(s, nil)
+}
+
+// PrepareCacheBaseURLWithPolicy sanitises a CacheBaseURL value, using
+// the given AdvertisePolicy to choose an address if the host is missing
+func PrepareCacheBaseURLWithPolicy(s string, policy *transport.AdvertisePolicy) (string, error) {
+	return prepareCacheBaseURL(s, 0, func() (netip.Addr, error) {
+		addr, err := transport.ResolveAdvertiseAddr(netip.Addr{}, policy)
+		return NormalizeAdvertiseAddr(addr), err
+	})
+}
+
+// revive:disable:cyclomatic
+// revive:disable:cognitive-complexity
+
+// prepareCacheBaseURL sanitises a CacheBaseURL value, using the given
+// port when none is specified, and the given callback to choose an
+// address when the host is missing
+func prepareCacheBaseURL(s string, port int, getAddr func() (netip.Addr, error)) (string, error) {
 	// revive:enable:cyclomatic
 	// revive:enable:cognitive-complexity
 
@@ -123,31 +202,29 @@ func PrepareCacheBaseURL(s string) (string, error) {
 		return "", fmt.Errorf("invalid scheme (%q)", u.Scheme)
 	}
 
-	if u.Host == "" {
-		// pick the first non-localhost address
-		ifaces, err := core.GetInterfacesNames("lo")
-		if err != nil {
-			return "", err
-		}
-
-		addrs, err := core.GetStringIPAddresses(ifaces...)
-		if err != nil {
+	host, sPort := u.Hostname(), u.Port()
+	if host == "" {
+		// pick the address we advertise
+		addr, err := getAddr()
+		switch {
+		case err == nil:
+			host = addr.String()
+		case errors.Is(err, transport.ErrNoAdvertiseAddr):
+			host = "0"
+		default:
 			return "", err
 		}
+	}
 
-		if len(addrs) > 0 {
-			u.Host = addrs[0]
-		} else {
-			u.Host = "0"
+	if sPort == "" && port > 0 {
+		sPort = strconv.Itoa(port)
+	} else if sPort != "" {
+		if _, err := strconv.ParseUint(sPort, 10, 16); err != nil {
+			return "", core.Wrapf(err, "invalid Host (%q)", u.Host)
 		}
-	} else if host, port, err := net.SplitHostPort(u.Host); err != nil {
-		return "", core.Wrapf(err, "invalid Host (%q)", u.Host)
-	} else if port == "80" && u.Scheme == "http" {
-		u.Host = host
-	} else if port == "443" && u.Scheme == "https" {
-		u.Host = host
 	}
 
+	u.Host = joinCacheHost(u.Scheme, host, sPort)
 	u.Path = ""
 	u.RawQuery = ""
 	u.Fragment = ""
@@ -155,24 +232,43 @@ func PrepareCacheBaseURL(s string) (string, error) {
 	return u.String(), nil
 }
 
+// joinCacheHost assembles the Host of a CacheBaseURL, omitting the
+// port when it's the default for the scheme
+func joinCacheHost(scheme, host, port string) string {
+	switch {
+	case port == "80" && scheme == "http",
+		port == "443" && scheme == "https":
+		port = ""
+	}
+
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
 // InferCacheBaseURL produces a CacheBaseURL pointing to https on 443/tcp of
 // Transport's AdveriseAddr
 func InferCacheBaseURL(cfg *memberlist.Config) (string, error) {
-	var s string
+	return InferCacheBaseURLWithPort(cfg, "https", 0)
+}
 
-	ip, _, err := cfg.Transport.FinalAdvertiseAddr(cfg.AdvertiseAddr, 0)
+// InferCacheBaseURLWithPort produces a CacheBaseURL using the given scheme
+// and port on the Transport's AdvertiseAddr. A zero port means the default
+// for the scheme
+func InferCacheBaseURLWithPort(cfg *memberlist.Config, scheme string, port int) (string, error) {
+	addr, err := AdvertiseAddr(cfg)
 	if err != nil {
 		return "", err
 	}
-	addr, _ := netip.AddrFromSlice(ip)
-	addr.Unmap()
-	addr.WithZone("")
 
-	if addr.Is6() {
-		s = fmt.Sprintf("[%s]", addr.String())
-	} else {
-		s = addr.String()
+	if scheme == "" {
+		scheme = "https"
 	}
 
-	return "https://" + s, nil
+	return prepareCacheBaseURL(scheme+"://", port, func() (netip.Addr, error) {
+		return addr, nil
+	})
 }
@@ -0,0 +1,128 @@
+package gossipcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// envelopeMagic identifies values stored by a Group
+const envelopeMagic = 0xe7
+
+// envelope flags, telling what fields are present and
+// what kind of value it holds
+const (
+	envFresh byte = 1 << iota
+	envExpire
+	envNotFound
+	envTag
+)
+
+var (
+	errBadEnvelope = errors.New("invalid cached value")
+)
+
+// envelope wraps the values stored in the groupcache, carrying
+// their lifetime as decided by the owner, so every node serving
+// them agrees on it
+type envelope struct {
+	// fresh is when the value needs to be refreshed.
+	// zero means never
+	fresh time.Time
+	// expire is when the value must no longer be served.
+	// zero means never
+	expire time.Time
+	// notFound indicates the key doesn't exist
+	notFound bool
+	// tag identifies the Codec used to encode the value
+	tag string
+
+	value []byte
+}
+
+// IsFresh tells if the value doesn't need to be refreshed yet
+func (e *envelope) IsFresh(now time.Time) bool {
+	return e.fresh.IsZero() || now.Before(e.fresh)
+}
+
+// IsExpired tells if the value must no longer be served
+func (e *envelope) IsExpired(now time.Time) bool {
+	return !e.expire.IsZero() && !now.Before(e.expire)
+}
+
+// Bytes encodes the envelope as
+// [magic][flags][fresh uvarint][expire uvarint][tag len uvarint][tag][value],
+// omitting zero times and empty tags
+func (e *envelope) Bytes() []byte {
+	var flags byte
+
+	if e.notFound {
+		flags |= envNotFound
+	}
+
+	b := make([]byte, 2, 2+3*binary.MaxVarintLen64+len(e.tag)+len(e.value))
+	if !e.fresh.IsZero() {
+		flags |= envFresh
+		b = binary.AppendUvarint(b, uint64(e.fresh.UnixNano()))
+	}
+	if !e.expire.IsZero() {
+		flags |= envExpire
+		b = binary.AppendUvarint(b, uint64(e.expire.UnixNano()))
+	}
+	if e.tag != "" {
+		flags |= envTag
+		b = binary.AppendUvarint(b, uint64(len(e.tag)))
+		b = append(b, e.tag...)
+	}
+
+	b[0], b[1] = envelopeMagic, flags
+	return append(b, e.value...)
+}
+
+// decodeEnvelope parses the output of envelope.Bytes. The value
+// shares the given buffer
+func decodeEnvelope(b []byte) (*envelope, error) {
+	if len(b) < 2 || b[0] != envelopeMagic {
+		return nil, errBadEnvelope
+	}
+
+	var err error
+	flags, b := b[1], b[2:]
+	e := &envelope{
+		notFound: flags&envNotFound != 0,
+	}
+
+	if flags&envFresh != 0 {
+		e.fresh, b, err = decodeEnvelopeTime(b)
+	}
+	if err == nil && flags&envExpire != 0 {
+		e.expire, b, err = decodeEnvelopeTime(b)
+	}
+	if err == nil && flags&envTag != 0 {
+		e.tag, b, err = decodeEnvelopeString(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e.value = b
+	return e, nil
+}
+
+func decodeEnvelopeString(b []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return "", nil, errBadEnvelope
+	}
+
+	b = b[n:]
+	return string(b[:size]), b[size:], nil
+}
+
+func decodeEnvelopeTime(b []byte) (time.Time, []byte, error) {
+	ns, n := binary.Uvarint(b)
+	if n <= 0 {
+		return time.Time{}, nil, errBadEnvelope
+	}
+	return time.Unix(0, int64(ns)), b[n:], nil
+}
@@ -0,0 +1,95 @@
+package gossipcache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestEnvelopeLifetime checks the TTL, jitter and stale window
+// of loaded values, and how they are served over time
+func TestEnvelopeLifetime(t *testing.T) {
+	const ttl, stale = time.Minute, 30 * time.Second
+	const jitter = 0.2
+
+	g := &Group{ttl: ttl, stale: stale, jitter: jitter}
+	now := time.Now()
+	minFresh := now.Add(ttl - time.Duration(float64(ttl)*jitter))
+
+	var jittered bool
+	for i := 0; i < 1000; i++ {
+		e := g.newEnvelope(Entry{Value: []byte("v")}, now)
+
+		switch {
+		case e.fresh.Before(minFresh), e.fresh.After(now.Add(ttl)):
+			t.Fatalf("fresh for %v, expected %v minus up to %v%%",
+				e.fresh.Sub(now), ttl, jitter*100)
+		case !e.expire.Equal(e.fresh.Add(stale)):
+			t.Fatalf("stale for %v, expected %v", e.expire.Sub(e.fresh), stale)
+		}
+		jittered = jittered || !e.fresh.Equal(now.Add(ttl))
+
+		for _, tc := range []struct {
+			at      time.Time
+			fresh   bool
+			expired bool
+		}{
+			{now, true, false},
+			{e.fresh.Add(-1), true, false},
+			{e.fresh, false, false},
+			{e.expire.Add(-1), false, false},
+			{e.expire, false, true},
+		} {
+			if e.IsFresh(tc.at) != tc.fresh || e.IsExpired(tc.at) != tc.expired {
+				t.Fatalf("at %v: expected fresh:%v expired:%v",
+					tc.at.Sub(now), tc.fresh, tc.expired)
+			}
+		}
+	}
+
+	if !jittered {
+		t.Fatal("TTL never jittered")
+	}
+}
+
+func TestEnvelopeEntryLifetime(t *testing.T) {
+	g := &Group{ttl: time.Minute, stale: 30 * time.Second}
+	now := time.Now()
+
+	// the Loader decides
+	e := g.newEnvelope(Entry{TTL: time.Second, Stale: time.Hour}, now)
+	if !e.fresh.Equal(now.Add(time.Second)) || !e.expire.Equal(e.fresh.Add(time.Hour)) {
+		t.Fatalf("Entry lifetime ignored: %v, %v", e.fresh.Sub(now), e.expire.Sub(now))
+	}
+
+	// never expires
+	e = g.newEnvelope(Entry{TTL: -1}, now)
+	far := now.Add(100 * 365 * 24 * time.Hour)
+	if !e.IsFresh(far) || e.IsExpired(far) {
+		t.Fatal("negative TTL expired")
+	}
+}
+
+func TestEnvelopeBytes(t *testing.T) {
+	now := time.Now()
+
+	for _, e := range []*envelope{
+		{value: []byte("value")},
+		{fresh: now, expire: now.Add(time.Minute), tag: "json/1", value: []byte("{}")},
+		{expire: now, notFound: true},
+	} {
+		got, err := decodeEnvelope(e.Bytes())
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !got.fresh.Equal(e.fresh), !got.expire.Equal(e.expire):
+			t.Fatalf("expected %v-%v, got %v-%v", e.fresh, e.expire, got.fresh, got.expire)
+		case got.notFound != e.notFound, got.tag != e.tag, !bytes.Equal(got.value, e.value):
+			t.Fatalf("expected %+v, got %+v", e, got)
+		}
+	}
+
+	if _, err := decodeEnvelope([]byte("value")); err == nil {
+		t.Fatal("raw value decoded")
+	}
+}
@@ -2,8 +2,16 @@
 package gossipcache
 
 import (
+	"net/http"
+	"sync"
+	"time"
+
 	"darvaza.org/cache"
 	"darvaza.org/cache/x/groupcache"
+	"darvaza.org/slog"
+	"github.com/hashicorp/memberlist"
+
+	"darvaza.org/gossipcache/transport"
 )
 
 var (
@@ -13,4 +21,42 @@ var (
 // GossipCache is a groupcache cluster managed using memberlist
 type GossipCache struct {
 	*groupcache.HTTPPool
+
+	// Transport is the gossip transport of the node, used
+	// to report its health
+	Transport *transport.Transport
+
+	// Logger is used to report problems with the cluster
+	Logger slog.Logger
+
+	// BaseURL is the CacheBaseURL of this node, as
+	// given to Set
+	BaseURL string
+	// PeerBasePath is where the PeerHandler of every node is
+	// mounted under their CacheBaseURL. If empty it will be
+	// DefaultPeerBasePath
+	PeerBasePath string
+	// Replicas is the number of replicas of the groupcache.
+	// If zero or negative it will be DefaultCacheReplicas
+	Replicas int
+	// Client is used to talk to other nodes. If nil
+	// http.DefaultClient is used
+	Client *http.Client
+	// PeerSecret, when set, signs the requests nodes send to
+	// each other's PeerHandler, which refuses those not signed
+	// with it. Every node needs the same
+	PeerSecret []byte
+
+	health peerHealth
+
+	mu           sync.Mutex
+	peers        []string
+	ring         *ring
+	prevRing     *ring
+	ringChanged  time.Time
+	broadcasts   *memberlist.TransmitLimitedQueue
+	broadcastSeq uint64
+	groups       map[string]*Group
+	specs        map[string]GroupSpec
+	mismatches   map[string][]GroupMismatch
 }
@@ -0,0 +1,378 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"darvaza.org/cache"
+	"darvaza.org/core"
+	"golang.org/x/sync/singleflight"
+)
+
+// Entry is what a Loader produces for a key
+type Entry struct {
+	// Value is the content to cache
+	Value []byte
+	// TTL is how long the Value remains fresh. Zero uses the
+	// Group's default, negative never expires
+	TTL time.Duration
+	// Stale is how long after the TTL the Value can still be
+	// served while a new one is loaded. Zero uses the Group's
+	// default
+	Stale time.Duration
+}
+
+// Loader produces the Entry of a key when it's not cached
+type Loader func(ctx context.Context, key string) (Entry, error)
+
+// GroupOption adjusts a Group before it's registered
+type GroupOption func(*Group) error
+
+// Group is a cache namespace whose values expire at the time
+// decided by the node loading them, on every node of the cluster
+type Group struct {
+	gc     *GossipCache
+	g      cache.Group[string]
+	loader Loader
+	flight singleflight.Group
+	local  singleflight.Group
+	tag    string
+
+	ttl    time.Duration
+	stale  time.Duration
+	jitter float64
+
+	negativeTTL time.Duration
+	revalidate  time.Duration
+	maxStale    time.Duration
+	lastKnown   *lruCache
+	mismatched  lruCache
+	handoff     *handoff
+	replication *replication
+	hot         *hotKeys
+	leases      *leases
+}
+
+// WithTTL creates a GroupOption setting how long values remain
+// fresh when the Loader doesn't say. Zero or negative never expire
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) error {
+		g.ttl = ttl
+		return nil
+	}
+}
+
+// WithStale creates a GroupOption setting how long after their TTL
+// values can still be served when the Loader doesn't say
+func WithStale(stale time.Duration) GroupOption {
+	return func(g *Group) error {
+		if stale < 0 {
+			return core.Wrap(core.ErrInvalid, "stale")
+		}
+
+		g.stale = stale
+		return nil
+	}
+}
+
+// WithTTLJitter creates a GroupOption shortening each TTL by a random
+// fraction, up to the given one, so values loaded together don't
+// expire together
+func WithTTLJitter(fraction float64) GroupOption {
+	return func(g *Group) error {
+		if fraction < 0 || fraction >= 1 {
+			return core.Wrap(core.ErrInvalid, "jitter")
+		}
+
+		g.jitter = fraction
+		return nil
+	}
+}
+
+// NewLoaderGroup creates a Group whose values are produced by
+// the given Loader
+func (gc *GossipCache) NewLoaderGroup(name string, cacheBytes int64,
+	loader Loader, options ...GroupOption) (*Group, error) {
+	switch {
+	case name == "":
+		return nil, core.Wrap(core.ErrInvalid, "name")
+	case loader == nil:
+		return nil, core.Wrap(core.ErrInvalid, "loader")
+	case gc.HTTPPool == nil:
+		return nil, core.ErrNilReceiver
+	}
+
+	g := &Group{
+		gc:     gc,
+		loader: loader,
+	}
+
+	for _, opt := range options {
+		if opt != nil {
+			if err := opt(g); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if err := gc.unsafeCheckNewGroup(name); err != nil {
+		return nil, err
+	} else if gc.groups == nil {
+		gc.groups = make(map[string]*Group)
+	}
+
+	cg, err := gc.newPoolGroup(name, cacheBytes, cache.GetterFunc[string](g.load))
+	if err != nil {
+		return nil, err
+	}
+
+	g.mismatched.init(cacheBytes)
+	g.g = cg
+	gc.groups[name] = g
+	gc.unsafeSetSpec(GroupSpec{
+		Name:       name,
+		CacheBytes: cacheBytes,
+		Codec:      g.tag,
+	})
+	return g, nil
+}
+
+// unsafeCheckNewGroup fails if the name is taken by a group
+// created via NewLoaderGroup or NewGroup
+func (gc *GossipCache) unsafeCheckNewGroup(name string) error {
+	_, ok1 := gc.groups[name]
+	_, ok2 := gc.specs[name]
+	if ok1 || ok2 {
+		return core.Wrap(core.ErrExists, name)
+	}
+	return nil
+}
+
+// newPoolGroup creates a group on the HTTPPool, which panics
+// instead of failing if the name was taken directly on it
+func (gc *GossipCache) newPoolGroup(name string, cacheBytes int64,
+	getter cache.Getter[string]) (cache.Group[string], error) {
+	var cg cache.Group[string]
+	var c core.Catcher
+
+	err := c.Try(func() error {
+		cg = gc.HTTPPool.NewGroup(name, cacheBytes, getter)
+		return nil
+	})
+	if err != nil {
+		return nil, core.Wrap(core.ErrExists, name)
+	}
+	return cg, nil
+}
+
+// LoaderGroup returns a Group created with NewLoaderGroup,
+// or nil if there is none with that name
+func (gc *GossipCache) LoaderGroup(name string) *Group {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	return gc.groups[name]
+}
+
+// Name returns the name of the Group
+func (g *Group) Name() string {
+	return g.g.Name()
+}
+
+// Get returns the value of a key, loading it if needed.
+// Values past their TTL are reloaded unless the Group
+// is allowed to serve them stale. ErrNotFound is returned
+// if the Loader said the key doesn't exist
+func (g *Group) Get(ctx context.Context, key string) ([]byte, error) {
+	v, _, err := g.GetWithInfo(ctx, key)
+	return v, err
+}
+
+// Remove removes a key from the cache of every node
+func (g *Group) Remove(ctx context.Context, key string) error {
+	if g.lastKnown != nil {
+		g.lastKnown.Remove(key)
+	}
+	if g.replication != nil {
+		g.replication.store.Remove(key)
+	}
+	g.mismatched.Remove(key)
+	return g.g.Remove(ctx, key)
+}
+
+func (g *Group) get(ctx context.Context, key string) (*envelope, error) {
+	if e, ok, err := g.getFromOwners(ctx, key); ok {
+		return e, err
+	}
+
+	var sink bytesSink
+
+	if err := g.g.Get(ctx, key, &sink); err != nil {
+		return nil, err
+	}
+
+	e, err := decodeEnvelope(sink.Bytes())
+	switch {
+	case err != nil:
+		return nil, err
+	case e.tag != g.tag:
+		// encoded by a different version of the code,
+		// we can't trust it
+		return g.loadMismatched(ctx, key)
+	default:
+		return e, nil
+	}
+}
+
+// loadMismatched returns the value of a key the cluster has with
+// a different tag, calling the Loader once per key and keeping the
+// value on this node until it needs a refresh, so nodes running
+// different code don't call it on every request
+func (g *Group) loadMismatched(ctx context.Context, key string) (*envelope, error) {
+	if e, ok := g.mismatched.Get(key); ok && e.IsFresh(time.Now()) {
+		return e, nil
+	}
+
+	e, err := g.loadAround(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mismatched.Add(key, e)
+	return e, nil
+}
+
+// loadLocal calls the Loader bypassing the cache, unless the
+// value was handed over by another node
+func (g *Group) loadLocal(ctx context.Context, key string) (*envelope, error) {
+	e, ok := g.takeWarm(key, time.Now())
+	if !ok {
+		var err error
+
+		e, err = g.loadLeased(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.trackOwned(key, e)
+	return e, nil
+}
+
+// refresh loads a value again and replaces it on the cluster,
+// once per key no matter how many are asking
+func (g *Group) refresh(ctx context.Context, key string) (*envelope, error) {
+	v, err, _ := g.flight.Do(key, func() (any, error) {
+		return g.doRefresh(ctx, key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return v.(*envelope), nil
+}
+
+// doRefresh has the owner of the key refresh its value, so the
+// cluster calls the Loader once, and loads it on this node only
+// if the owner can't be asked
+func (g *Group) doRefresh(ctx context.Context, key string) (*envelope, error) {
+	if e, ok := g.refreshAtOwner(ctx, key); ok {
+		g.replace(ctx, key, e)
+		return e, nil
+	}
+
+	return g.reload(ctx, key)
+}
+
+// reload loads a value on this node and then replaces the one
+// cached by its owner, so others keep getting the old value
+// instead of waiting for the new one
+func (g *Group) reload(ctx context.Context, key string) (*envelope, error) {
+	e, err := g.loadLocal(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	g.replace(ctx, key, e)
+	return e, nil
+}
+
+// replace stores a new value on the owner of the key,
+// and the hot cache of this node
+func (g *Group) replace(ctx context.Context, key string, e *envelope) {
+	if err := g.g.Set(ctx, key, e.Bytes(), e.expire, cache.HotCache); err != nil {
+		// we still have the new value
+		g.gc.error(err).WithField("group", g.Name()).Print("Failed to replace value")
+	}
+}
+
+// load is the cache.Getter of the Group, wrapping the Loader's
+// Entry with its lifetime. Keys not found are cached as such, and
+// values handed over by other nodes are used instead of the Loader.
+// Keys owned by another node, which groupcache couldn't reach,
+// are first asked to the next owners
+func (g *Group) load(ctx context.Context, key string, dest cache.Sink) error {
+	e, ok := g.getFromNextOwners(ctx, key)
+	if !ok {
+		var err error
+
+		e, err = g.loadLocal(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return dest.SetBytes(e.Bytes(), e.expire)
+}
+
+// callLoader calls the Loader and wraps its Entry
+func (g *Group) callLoader(ctx context.Context, key string) (*envelope, error) {
+	entry, err := g.loader(ctx, key)
+	switch {
+	case err == nil:
+		return g.newEnvelope(entry, time.Now()), nil
+	case errors.Is(err, ErrNotFound):
+		return g.newNotFoundEnvelope(err, time.Now()), nil
+	default:
+		return nil, err
+	}
+}
+
+func (g *Group) newEnvelope(entry Entry, now time.Time) *envelope {
+	e := &envelope{
+		tag:   g.tag,
+		value: entry.Value,
+	}
+
+	ttl := core.IIf(entry.TTL == 0, g.ttl, entry.TTL)
+	if ttl > 0 {
+		stale := core.IIf(entry.Stale == 0, g.stale, entry.Stale)
+
+		e.fresh = now.Add(g.withJitter(ttl))
+		e.expire = e.fresh.Add(max(stale, 0))
+	}
+	return e
+}
+
+// withJitter shortens a TTL by a random fraction up to
+// the configured jitter
+func (g *Group) withJitter(ttl time.Duration) time.Duration {
+	if n := time.Duration(float64(ttl) * g.jitter); n > 0 {
+		ttl -= rand.N(n)
+	}
+	return ttl
+}
+
+// withCodecTag creates a GroupOption labelling the values the
+// Group loads, so values labelled differently aren't used
+func withCodecTag(tag string) GroupOption {
+	return func(g *Group) error {
+		g.tag = tag
+		return nil
+	}
+}
@@ -0,0 +1,312 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"darvaza.org/cache"
+	"darvaza.org/cache/x/groupcache"
+	"darvaza.org/core"
+)
+
+// testCacheGroup stands in for the groupcache group of a Group,
+// keeping values in a map and loading them with its Getter
+type testCacheGroup struct {
+	cache.Group[string]
+
+	name   string
+	getter cache.Getter[string]
+
+	// owner, if set, returns the testCacheGroup of the node
+	// owning a key when it's another, to ask it instead as
+	// groupcache does
+	owner func(key string) *testCacheGroup
+
+	mu     sync.Mutex
+	values map[string]bytesSink
+}
+
+func (tg *testCacheGroup) ownerOf(key string) *testCacheGroup {
+	if tg.owner == nil {
+		return nil
+	}
+	return tg.owner(key)
+}
+
+func (tg *testCacheGroup) Name() string { return tg.name }
+
+func (tg *testCacheGroup) Get(ctx context.Context, key string, dest cache.Sink) error {
+	tg.mu.Lock()
+	v, ok := tg.values[key]
+	tg.mu.Unlock()
+
+	if ok && (v.e.IsZero() || time.Now().Before(v.e)) {
+		return dest.SetBytes(v.b, v.e)
+	}
+
+	if o := tg.ownerOf(key); o != nil {
+		return o.Get(ctx, key, dest)
+	}
+
+	if err := tg.getter.Get(ctx, key, &v); err != nil {
+		return err
+	}
+
+	_ = tg.Set(ctx, key, v.b, v.e, cache.MainCache)
+	return dest.SetBytes(v.b, v.e)
+}
+
+func (tg *testCacheGroup) Set(ctx context.Context, key string, value []byte,
+	expire time.Time, kind cache.Type) error {
+	if o := tg.ownerOf(key); o != nil {
+		_ = o.Set(ctx, key, value, expire, cache.MainCache)
+		if kind != cache.HotCache {
+			return nil
+		}
+	}
+
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	tg.values[key] = bytesSink{b: append([]byte(nil), value...), e: expire}
+	return nil
+}
+
+func (tg *testCacheGroup) Remove(_ context.Context, key string) error {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	delete(tg.values, key)
+	return nil
+}
+
+// newTestGroup creates a Group of the given GossipCache backed
+// by a testCacheGroup instead of groupcache
+func newTestGroup(t *testing.T, gc *GossipCache, name string, loader Loader,
+	options ...GroupOption) *Group {
+	t.Helper()
+
+	g := &Group{
+		gc:     gc,
+		loader: loader,
+	}
+
+	for _, opt := range options {
+		if err := opt(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g.mismatched.init(1 << 20)
+	g.g = &testCacheGroup{
+		name:   name,
+		getter: cache.GetterFunc[string](g.load),
+		values: make(map[string]bytesSink),
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.groups == nil {
+		gc.groups = make(map[string]*Group)
+	}
+	gc.groups[name] = g
+	return g
+}
+
+// TestStaleWhileRevalidate checks stale values keep being served
+// while they are loaded again, and replaced once loaded
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	g := newTestGroup(t, &GossipCache{}, "swr",
+		func(_ context.Context, _ string) (Entry, error) {
+			if calls.Add(1) > 1 {
+				<-release
+				return Entry{Value: []byte("new")}, nil
+			}
+			return Entry{Value: []byte("old")}, nil
+		},
+		WithTTL(50*time.Millisecond),
+		WithStale(time.Minute),
+		WithStaleWhileRevalidate(5*time.Second),
+	)
+
+	ctx := context.Background()
+	if _, err := g.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the first caller starts the refresh, everyone
+	// gets the stale value meanwhile
+	expectStale := func() {
+		t.Helper()
+
+		type result struct {
+			v    []byte
+			info Info
+			err  error
+		}
+
+		done := make(chan result, 1)
+		go func() {
+			v, info, err := g.GetWithInfo(ctx, "key")
+			done <- result{v, info, err}
+		}()
+
+		select {
+		case r := <-done:
+			switch {
+			case r.err != nil:
+				t.Fatal(r.err)
+			case string(r.v) != "old", !r.info.Stale:
+				t.Fatalf("expected the stale value, got %q %+v", r.v, r.info)
+			}
+		case <-time.After(time.Second):
+			close(release)
+			t.Fatal("waiting for the refresh")
+		}
+	}
+
+	expectStale()
+	waitFor(t, 5*time.Second, "the refresh", func() bool {
+		return calls.Load() == 2
+	})
+	expectStale()
+	expectStale()
+
+	close(release)
+	waitFor(t, 5*time.Second, "the new value", func() bool {
+		v, err := g.Get(ctx, "key")
+		return err == nil && string(v) == "new"
+	})
+
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected 2 loads, got %v", n)
+	}
+}
+
+// TestTagMismatch checks values cached by nodes running a different
+// version are loaded once, and then kept locally
+func TestTagMismatch(t *testing.T) {
+	var calls atomic.Int32
+
+	g := newTestGroup(t, &GossipCache{}, "mismatch",
+		func(_ context.Context, _ string) (Entry, error) {
+			calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			return Entry{Value: []byte("new")}, nil
+		},
+		withCodecTag(RawCodec[string](2).Tag()),
+		WithTTL(time.Minute),
+	)
+
+	// another version of the code cached it
+	ctx := context.Background()
+	old := &envelope{tag: RawCodec[string](1).Tag(), value: []byte("old")}
+	if err := g.g.Set(ctx, "key", old.Bytes(), time.Time{}, cache.MainCache); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if v, err := g.Get(ctx, "key"); err != nil || string(v) != "new" {
+				t.Errorf("unexpected value %q: %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := g.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected 1 load, got %v", n)
+	}
+}
+
+// TestNewLoaderGroupExists checks names taken by other groups
+// are rejected instead of reaching groupcache
+func TestNewLoaderGroupExists(t *testing.T) {
+	gc := &GossipCache{HTTPPool: new(groupcache.HTTPPool)}
+	loader := func(context.Context, string) (Entry, error) { return Entry{}, nil }
+
+	// by NewLoaderGroup
+	newTestGroup(t, gc, "loader", loader)
+	// by NewGroup
+	gc.mu.Lock()
+	gc.unsafeSetSpec(GroupSpec{Name: "getter"})
+	gc.mu.Unlock()
+
+	for _, name := range []string{"loader", "getter"} {
+		_, err := gc.NewLoaderGroup(name, 1<<20, loader)
+		if !errors.Is(err, core.ErrExists) {
+			t.Fatalf("%s: expected %v, got %v", name, core.ErrExists, err)
+		}
+	}
+}
+
+// TestRefreshAtOwner checks values past their TTL are loaded again
+// by their owner alone, no matter how many nodes ask for them
+func TestRefreshAtOwner(t *testing.T) {
+	nodes := newTestNodes(t, 3, "refresh",
+		WithTTL(100*time.Millisecond),
+		WithStale(time.Minute),
+	)
+	linkTestNodes(nodes)
+
+	const key = "key"
+	owner := findNode(nodes, nodes[0].gc.currentRing().Owner(key))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	getAll := func() {
+		var wg sync.WaitGroup
+		for _, node := range nodes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				v, err := node.g.Get(ctx, key)
+				if err != nil {
+					t.Error(err)
+				} else if string(v) != key {
+					t.Errorf("expected %q, got %q", key, v)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	expectCalls := func(expected int32) {
+		t.Helper()
+
+		var calls int32
+		for _, node := range nodes {
+			calls += node.calls.Load()
+		}
+		if calls != expected || owner.calls.Load() != expected {
+			t.Fatalf("expected the owner to call the origin %v times, got %v (%v total)",
+				expected, owner.calls.Load(), calls)
+		}
+	}
+
+	getAll()
+	expectCalls(1)
+
+	time.Sleep(150 * time.Millisecond)
+	getAll()
+	expectCalls(2)
+}
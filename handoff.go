@@ -0,0 +1,304 @@
+package gossipcache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// DefaultHandoffTimeout is how long a handoff or warm-up can
+// take when WithHandoff isn't given a timeout
+const DefaultHandoffTimeout = 10 * time.Second
+
+// handoff tracks the values of a Group to pass over when
+// the owner of their keys changes
+type handoff struct {
+	maxBytes int64
+	timeout  time.Duration
+
+	// owned are the values this node owns, most recently
+	// used first
+	owned lruCache
+	// warm are the values passed over to this node,
+	// used once instead of calling the Loader
+	warm lruCache
+}
+
+// WithHandoff creates a GroupOption to pass values over when the
+// owner of their keys changes. Leaving nodes push the most recently
+// used values they own to their new owners on Handoff, and joining
+// nodes pull the values they now own from the other nodes on WarmUp.
+// Each direction is bounded by maxBytes and timeout
+func WithHandoff(maxBytes int64, timeout time.Duration) GroupOption {
+	return func(g *Group) error {
+		if maxBytes <= 0 {
+			return core.Wrap(core.ErrInvalid, "handoff")
+		} else if timeout <= 0 {
+			timeout = DefaultHandoffTimeout
+		}
+
+		h := &handoff{
+			maxBytes: maxBytes,
+			timeout:  timeout,
+		}
+		h.owned.init(maxBytes)
+		h.warm.init(maxBytes)
+
+		g.handoff = h
+		return nil
+	}
+}
+
+// trackOwned remembers a value to hand over if this node owns
+// its key
+func (g *Group) trackOwned(key string, e *envelope) {
+	if g.handoff != nil && g.gc.isOwner(key) {
+		g.handoff.owned.Add(key, e)
+	}
+}
+
+// takeWarm returns a value passed over to this node,
+// once
+func (g *Group) takeWarm(key string, now time.Time) (*envelope, bool) {
+	if g.handoff == nil {
+		return nil, false
+	}
+
+	e, ok := g.handoff.warm.Get(key)
+	if ok {
+		g.handoff.warm.Remove(key)
+		if e.tag != g.tag || e.IsExpired(now) {
+			return nil, false
+		}
+	}
+	return e, ok
+}
+
+// addWarm stores the values passed over to this node
+func (g *Group) addWarm(buf []byte) error {
+	now := time.Now()
+	return decodeHandoff(buf, func(key string, e *envelope) {
+		if e.tag == g.tag && !e.IsExpired(now) {
+			g.handoff.warm.Add(key, e)
+		}
+	})
+}
+
+// collectHandoff encodes the owned values, most recently used
+// first and up to maxBytes, grouped by the node the given function
+// assigns them to. Values assigned to no node are skipped
+func (g *Group) collectHandoff(assign func(key string) string) map[string][]byte {
+	var total int64
+	out := make(map[string][]byte)
+
+	now := time.Now()
+	g.handoff.owned.Range(func(key string, e *envelope) bool {
+		node := assign(key)
+		if node == "" || e.IsExpired(now) {
+			return true
+		}
+
+		total += entrySize(key, e)
+		if total > g.handoff.maxBytes {
+			return false
+		}
+
+		out[node] = appendHandoff(out[node], key, e)
+		return true
+	})
+	return out
+}
+
+// Handoff pushes the values this node owns on the Groups using
+// WithHandoff to the nodes owning them once this one is gone.
+// It's meant to be called before leaving the cluster
+func (gc *GossipCache) Handoff(ctx context.Context) error {
+	peers := gc.otherPeers()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	r := newRing(gc.replicas(), peers...)
+
+	var errs []error
+	for _, g := range gc.handoffGroups() {
+		if err := g.pushHandoff(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (g *Group) pushHandoff(ctx context.Context, r *ring) error {
+	ctx, cancel := context.WithTimeout(ctx, g.handoff.timeout)
+	defer cancel()
+
+	batches := g.collectHandoff(r.Owner)
+
+	var errs []error
+	for owner, body := range batches {
+		_, err := g.gc.postPeer(ctx, owner, body, "handoff", g.Name())
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WarmUp pulls from the other nodes the values this node now owns
+// on the Groups using WithHandoff, to serve them instead of loading
+// them again. It's meant to be called after joining the cluster,
+// once Set has been given the new peers
+func (gc *GossipCache) WarmUp(ctx context.Context) error {
+	peers := gc.otherPeers()
+	if len(peers) == 0 || gc.BaseURL == "" {
+		return nil
+	}
+
+	var errs []error
+	for _, g := range gc.handoffGroups() {
+		if err := g.pullHandoff(ctx, peers); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (g *Group) pullHandoff(ctx context.Context, peers []string) error {
+	ctx, cancel := context.WithTimeout(ctx, g.handoff.timeout)
+	defer cancel()
+
+	var errs []error
+	for _, peer := range peers {
+		b, err := g.gc.postPeer(ctx, peer, []byte(g.gc.BaseURL), "handoff", g.Name(), "pull")
+		if err == nil {
+			err = g.addWarm(b)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (gc *GossipCache) handoffGroups() []*Group {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	var out []*Group
+	for _, g := range gc.groups {
+		if g.handoff != nil {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// handoffGroup returns the Group a handoff request is for,
+// or nil if it doesn't use WithHandoff
+func (gc *GossipCache) handoffGroup(req *http.Request) *Group {
+	g := gc.LoaderGroup(req.PathValue("group"))
+	if g == nil || g.handoff == nil {
+		return nil
+	}
+	return g
+}
+
+// serveHandoffPush receives the values a leaving node
+// passes over
+func (gc *GossipCache) serveHandoffPush(rw http.ResponseWriter, req *http.Request) {
+	g := gc.handoffGroup(req)
+	if g == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxPeerResponse))
+	if err == nil {
+		err = g.addWarm(buf)
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// serveHandoffPull returns the values a joining node,
+// identified by its CacheBaseURL, will own
+func (gc *GossipCache) serveHandoffPull(rw http.ResponseWriter, req *http.Request) {
+	g := gc.handoffGroup(req)
+	if g == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, 4096))
+	if err != nil || len(buf) == 0 {
+		http.Error(rw, "invalid node", http.StatusBadRequest)
+		return
+	}
+
+	joiner := string(buf)
+	peers := append(gc.Peers(), joiner)
+	r := newRing(gc.replicas(), core.SliceUnique(peers)...)
+
+	out := g.collectHandoff(func(key string) string {
+		return core.IIf(r.Owner(key) == joiner, joiner, "")
+	})
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = rw.Write(out[joiner])
+}
+
+// appendHandoff encodes a value as
+// [key len uvarint][key][envelope len uvarint][envelope]
+func appendHandoff(buf []byte, key string, e *envelope) []byte {
+	b := e.Bytes()
+
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// decodeHandoff calls fn for each value encoded by appendHandoff
+func decodeHandoff(buf []byte, fn func(key string, e *envelope)) error {
+	for len(buf) > 0 {
+		key, rest, ok := nextField(buf)
+		if !ok {
+			return errBadEnvelope
+		}
+
+		b, rest, ok := nextField(rest)
+		if !ok {
+			return errBadEnvelope
+		}
+
+		e, err := decodeEnvelope(b)
+		if err != nil {
+			return err
+		}
+
+		fn(string(key), e)
+		buf = rest
+	}
+	return nil
+}
+
+// nextField splits a [len uvarint][field] encoded field
+// from the rest of the buffer
+func nextField(buf []byte) (field, rest []byte, ok bool) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || n > uint64(len(buf)-l) {
+		return nil, nil, false
+	}
+
+	buf = buf[l:]
+	return buf[:n], buf[n:], true
+}
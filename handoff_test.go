@@ -0,0 +1,217 @@
+package gossipcache
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// findOwnedKeys returns n keys the given node owns on a ring
+func findOwnedKeys(t *testing.T, r *ring, node string, n int) []string {
+	t.Helper()
+
+	var out []string
+	for i := 0; i < 1000 && len(out) < n; i++ {
+		key := fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i))))
+		if r.Owner(key) == node {
+			out = append(out, key)
+		}
+	}
+
+	if len(out) < n {
+		t.Fatal("not enough keys found")
+	}
+	return out
+}
+
+// TestHandoff checks the values owned by a leaving node reach
+// their new owners, which serve them once without calling the
+// Loader
+func TestHandoff(t *testing.T) {
+	nodes := newTestNodes(t, 3, "handoff", WithHandoff(1<<20, time.Second))
+	leaving, others := nodes[0], nodes[1:]
+	keys := findOwnedKeys(t, leaving.gc.currentRing(), leaving.gc.BaseURL, 5)
+
+	ctx := context.Background()
+	for _, key := range keys {
+		if _, err := leaving.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := leaving.gc.Handoff(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it's gone
+	var peers []string
+	for _, node := range others {
+		peers = append(peers, node.gc.BaseURL)
+	}
+	for _, node := range others {
+		node.gc.setPeers(peers)
+	}
+
+	for _, key := range keys {
+		owner := findNode(others, others[0].gc.currentRing().Owner(key))
+		if v, err := owner.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if string(v) != key {
+			t.Fatalf("unexpected value %q", v)
+		}
+	}
+
+	for _, node := range others {
+		if n := node.calls.Load(); n != 0 {
+			t.Fatalf("handed over values loaded %v times", n)
+		}
+	}
+
+	// only once
+	owner := findNode(others, others[0].gc.currentRing().Owner(keys[0]))
+	if err := owner.g.g.Remove(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.g.Get(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := owner.calls.Load(); n != 1 {
+		t.Fatalf("expected the Loader called once, got %v", n)
+	}
+}
+
+// TestWarmUp checks a joining node pulls the values it now owns
+// from the other nodes
+func TestWarmUp(t *testing.T) {
+	nodes := newTestNodes(t, 3, "warmup", WithHandoff(1<<20, time.Second))
+	joining := nodes[0]
+
+	// before it joined
+	var peers []string
+	for _, node := range nodes[1:] {
+		peers = append(peers, node.gc.BaseURL)
+	}
+	for _, node := range nodes[1:] {
+		node.gc.setPeers(peers)
+	}
+
+	keys := findOwnedKeys(t, joining.gc.currentRing(), joining.gc.BaseURL, 5)
+	ctx := context.Background()
+	for _, key := range keys {
+		owner := findNode(nodes, nodes[1].gc.currentRing().Owner(key))
+		if _, err := owner.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// joined
+	peers = append(peers, joining.gc.BaseURL)
+	for _, node := range nodes[1:] {
+		node.gc.setPeers(peers)
+	}
+
+	if err := joining.gc.WarmUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if _, err := joining.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := joining.calls.Load(); n != 0 {
+		t.Fatalf("pulled values loaded %v times", n)
+	}
+}
+
+// TestHandoffWarm checks only values of the same tag and not
+// expired are kept, and used once
+func TestHandoffWarm(t *testing.T) {
+	g := newTestGroup(t, &GossipCache{}, "warm", nil,
+		withCodecTag("json/2"), WithHandoff(1<<20, time.Second))
+
+	now := time.Now()
+	var buf []byte
+	buf = appendHandoff(buf, "good", &envelope{tag: "json/2", value: []byte("v")})
+	buf = appendHandoff(buf, "old", &envelope{tag: "json/1", value: []byte("v")})
+	buf = appendHandoff(buf, "expired", &envelope{tag: "json/2", expire: now.Add(-time.Second)})
+
+	if err := g.addWarm(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{"good", true},
+		{"good", false},
+		{"old", false},
+		{"expired", false},
+	} {
+		if _, ok := g.takeWarm(tc.key, now); ok != tc.ok {
+			t.Fatalf("%s: expected %v", tc.key, tc.ok)
+		}
+	}
+
+	if err := g.addWarm(buf[:len(buf)-1]); err == nil {
+		t.Fatal("truncated handoff accepted")
+	}
+}
+
+// TestHandoffMaxBytes checks only the most recently used values
+// fitting maxBytes are handed over
+func TestHandoffMaxBytes(t *testing.T) {
+	e := &envelope{value: make([]byte, 100)}
+	size := entrySize("key-0", e)
+
+	g := newTestGroup(t, &GossipCache{}, "maxbytes", nil, WithHandoff(3*size, time.Second))
+	for i := 0; i < 5; i++ {
+		g.handoff.owned.Add("key-"+strconv.Itoa(i), e)
+	}
+
+	var keys []string
+	batches := g.collectHandoff(func(string) string { return "node" })
+	if err := decodeHandoff(batches["node"], func(key string, _ *envelope) {
+		keys = append(keys, key)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"key-4", "key-3", "key-2"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+}
+
+// TestHandoffTimeout checks Handoff gives up on slow nodes
+func TestHandoffTimeout(t *testing.T) {
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	gc := &GossipCache{}
+	newTestPeerServer(t, gc)
+	g := newTestGroup(t, gc, "timeout", nil, WithHandoff(1<<20, 100*time.Millisecond))
+	gc.setPeers([]string{gc.BaseURL, slow.URL})
+
+	g.handoff.owned.Add("key", &envelope{value: []byte("v")})
+
+	start := time.Now()
+	err := gc.Handoff(context.Background())
+	switch {
+	case !errors.Is(err, context.DeadlineExceeded):
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	case time.Since(start) > 2*time.Second:
+		t.Fatalf("Handoff took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,59 @@
+package gossipcache
+
+import (
+	"net/http"
+
+	"darvaza.org/gossipcache/transport"
+)
+
+// Status reports the health of the gossip transport. Without
+// a Transport there is nothing to report
+func (gc *GossipCache) Status() transport.Status {
+	if gc == nil || gc.Transport == nil {
+		return transport.Status{}
+	}
+	return gc.Transport.Status()
+}
+
+// ReadinessHandler returns an http.Handler for readiness probes.
+// It responds 200 when the node can take part in the cluster,
+// or 503 otherwise, with the transport.Status as JSON. Without
+// a Transport to check it always responds 200
+func (gc *GossipCache) ReadinessHandler() http.Handler {
+	return healthHandler(gc, (*transport.Status).Ready)
+}
+
+// LivenessHandler returns an http.Handler for liveness probes.
+// It responds 200 unless the gossip transport has failed or been
+// shut down, in which case it responds 503, with the
+// transport.Status as JSON. Without a Transport to check it
+// always responds 200
+func (gc *GossipCache) LivenessHandler() http.Handler {
+	return healthHandler(gc, (*transport.Status).Alive)
+}
+
+func healthHandler(gc *GossipCache, check func(*transport.Status) bool) http.Handler {
+	fn := func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := gc.Status()
+		code := http.StatusOK
+		if gc.hasTransport() && !check(&status) {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(rw, req, code, &status)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (gc *GossipCache) hasTransport() bool {
+	return gc != nil && gc.Transport != nil
+}
@@ -0,0 +1,50 @@
+package gossipcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"darvaza.org/gossipcache/transport"
+)
+
+func probe(t *testing.T, h http.Handler) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code
+}
+
+func TestHealthHandlers(t *testing.T) {
+	gc := &GossipCache{}
+
+	// nothing to check
+	if code := probe(t, gc.LivenessHandler()); code != http.StatusOK {
+		t.Errorf("liveness without transport: %v", code)
+	}
+	if code := probe(t, gc.ReadinessHandler()); code != http.StatusOK {
+		t.Errorf("readiness without transport: %v", code)
+	}
+
+	tr, err := transport.New(&transport.Config{
+		BindAddress: []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.Transport = tr
+
+	if _, _, err := tr.FinalAdvertiseAddr("", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "readiness", func() bool {
+		return probe(t, gc.ReadinessHandler()) == http.StatusOK
+	})
+
+	_ = tr.Shutdown()
+	if code := probe(t, gc.LivenessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("liveness of a shut down transport: %v", code)
+	}
+}
@@ -0,0 +1,331 @@
+package gossipcache
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// HotKeyWindow is how often owners measure the request rate
+	// of their keys and announce the hot ones
+	HotKeyWindow = time.Second
+
+	// hotKeyTTL is how long a key remains hot on the other
+	// nodes once announced
+	hotKeyTTL = 3 * HotKeyWindow
+
+	hotSketchWidth = 2048
+	hotSketchDepth = 4
+)
+
+// HotKey is a key requested more often than the threshold
+type HotKey struct {
+	Key string `json:"key"`
+	// Rate is the number of requests per second the owner got
+	// during the last window
+	Rate float64 `json:"rate"`
+}
+
+// HotKeyStats describes the hot keys of a Group on this node
+type HotKeyStats struct {
+	Group string `json:"group"`
+	// Owned are the hot keys this node owns as of the last
+	// window, hottest first
+	Owned []HotKey `json:"owned"`
+	// Replicated is the number of hot keys of other nodes
+	// this node keeps a copy of
+	Replicated int `json:"replicated"`
+	// Hits is the number of requests served from those copies
+	Hits uint64 `json:"hits"`
+	// Fetches is the number of times those copies were fetched
+	Fetches uint64 `json:"fetches"`
+	// Announced is the number of times this node announced
+	// its hot keys
+	Announced uint64 `json:"announced"`
+}
+
+// hotKeys tracks the request rate of the keys a node owns,
+// and copies of the hot keys other nodes own
+type hotKeys struct {
+	limit uint32
+	top   int
+
+	mu         sync.Mutex
+	sketch     countMinSketch
+	start      time.Time
+	candidates map[string]uint32
+	owned      []HotKey
+	marked     map[string]time.Time
+
+	copies lruCache
+	flight singleflight.Group
+
+	hits      atomic.Uint64
+	fetches   atomic.Uint64
+	announced atomic.Uint64
+}
+
+// WithHotKeys creates a GroupOption to find the keys owned by this
+// node getting more than threshold requests per second, and announce
+// up to top of them every HotKeyWindow so the other nodes keep a copy,
+// up to maxBytes, instead of asking the owner. Copies are refreshed
+// while the key remains hot, so they may lag behind a Remove for a
+// few windows. Announcing requires WithHotKeyBroadcasts
+func WithHotKeys(threshold float64, top int, maxBytes int64) GroupOption {
+	return func(g *Group) error {
+		if threshold <= 0 || top < 1 || maxBytes <= 0 {
+			return core.Wrap(core.ErrInvalid, "hot keys")
+		}
+
+		hk := &hotKeys{
+			limit:      uint32(max(1, math.Ceil(threshold*HotKeyWindow.Seconds()))),
+			top:        top,
+			candidates: make(map[string]uint32),
+			marked:     make(map[string]time.Time),
+		}
+		hk.sketch.init(hotSketchWidth, hotSketchDepth)
+		hk.copies.init(maxBytes)
+
+		g.hot = hk
+		return nil
+	}
+}
+
+// recordHot counts a request for a key this node owns,
+// announcing the hot keys when a window ends
+func (g *Group) recordHot(key string) {
+	if g.hot == nil {
+		return
+	}
+
+	if owned, ok := g.hot.record(key, time.Now()); ok && len(owned) > 0 {
+		keys := make([]string, len(owned))
+		for i, hk := range owned {
+			keys[i] = hk.Key
+		}
+
+		if g.gc.announceHotKeys(g.Name(), keys) {
+			g.hot.announced.Add(1)
+		}
+	}
+}
+
+// record counts a request, reporting the hot keys of the
+// previous window if it just ended
+func (hk *hotKeys) record(key string, now time.Time) ([]HotKey, bool) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	ended := now.Sub(hk.start) >= HotKeyWindow
+	if ended {
+		hk.unsafeEndWindow(now)
+	}
+
+	if n := hk.sketch.Add(key); n >= hk.limit {
+		hk.unsafeAddCandidate(key, n)
+	}
+
+	return hk.owned, ended
+}
+
+// unsafeAddCandidate keeps the count of a key over the limit,
+// replacing the lowest candidate when there are too many
+func (hk *hotKeys) unsafeAddCandidate(key string, n uint32) {
+	if _, ok := hk.candidates[key]; !ok && len(hk.candidates) >= 4*hk.top {
+		lowest, count := "", uint32(math.MaxUint32)
+		for k, c := range hk.candidates {
+			if c < count {
+				lowest, count = k, c
+			}
+		}
+
+		if n <= count {
+			return
+		}
+		delete(hk.candidates, lowest)
+	}
+
+	hk.candidates[key] = n
+}
+
+func (hk *hotKeys) unsafeEndWindow(now time.Time) {
+	elapsed := max(now.Sub(hk.start), HotKeyWindow).Seconds()
+
+	owned := make([]HotKey, 0, len(hk.candidates))
+	for key, n := range hk.candidates {
+		owned = append(owned, HotKey{Key: key, Rate: float64(n) / elapsed})
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		a, b := owned[i], owned[j]
+		return a.Rate > b.Rate || (a.Rate == b.Rate && a.Key < b.Key)
+	})
+
+	hk.owned = owned[:min(len(owned), hk.top)]
+	clear(hk.candidates)
+	hk.sketch.Reset()
+	hk.start = now
+}
+
+// markHot records keys other nodes announced as hot, and
+// fetches a copy of them in the background
+func (g *Group) markHot(keys []string) {
+	until := time.Now().Add(hotKeyTTL)
+	for _, key := range keys {
+		if g.gc.isOwner(key) {
+			continue
+		}
+
+		g.hot.mark(key, until)
+		g.fetchHot(key)
+	}
+}
+
+func (hk *hotKeys) mark(key string, until time.Time) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	hk.marked[key] = until
+}
+
+// isMarked tells if a key announced as hot still is,
+// forgetting it otherwise
+func (hk *hotKeys) isMarked(key string, now time.Time) bool {
+	hk.mu.Lock()
+	until, ok := hk.marked[key]
+	if ok && !now.Before(until) {
+		delete(hk.marked, key)
+		ok = false
+	}
+	hk.mu.Unlock()
+
+	if !ok {
+		hk.copies.Remove(key)
+	}
+	return ok
+}
+
+// fetchHot gets a copy of a hot key in the background,
+// unless it's already being fetched
+func (g *Group) fetchHot(key string) {
+	_ = g.hot.flight.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultRevalidateTimeout)
+		defer cancel()
+
+		e, err := g.get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		g.hot.copies.Add(key, e)
+		g.hot.fetches.Add(1)
+		return e, nil
+	})
+}
+
+// hotCopy returns the fresh copy of a key announced as hot
+func (g *Group) hotCopy(key string, now time.Time) (*envelope, bool) {
+	if g.hot == nil || !g.hot.isMarked(key, now) {
+		return nil, false
+	}
+
+	e, ok := g.hot.copies.Get(key)
+	if !ok || !e.IsFresh(now) {
+		return nil, false
+	}
+
+	g.hot.hits.Add(1)
+	return e, true
+}
+
+// HotKeyStats returns the state of the hot keys of the Group on
+// this node. Groups not using WithHotKeys report nothing
+func (g *Group) HotKeyStats() HotKeyStats {
+	out := HotKeyStats{Group: g.Name()}
+
+	if hk := g.hot; hk != nil {
+		now := time.Now()
+
+		hk.mu.Lock()
+		out.Owned = slices.Clone(hk.owned)
+		for _, until := range hk.marked {
+			if now.Before(until) {
+				out.Replicated++
+			}
+		}
+		hk.mu.Unlock()
+
+		out.Hits = hk.hits.Load()
+		out.Fetches = hk.fetches.Load()
+		out.Announced = hk.announced.Load()
+	}
+	return out
+}
+
+// HotKeyStats returns the state of the hot keys of the Groups
+// using WithHotKeys, sorted by name
+func (gc *GossipCache) HotKeyStats() []HotKeyStats {
+	gc.mu.Lock()
+	groups := make([]*Group, 0, len(gc.groups))
+	for _, g := range gc.groups {
+		if g.hot != nil {
+			groups = append(groups, g)
+		}
+	}
+	gc.mu.Unlock()
+
+	out := make([]HotKeyStats, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, g.HotKeyStats())
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+// ServeHTTP handles the groupcache requests of other nodes,
+// counting them to find the hot keys
+func (gc *GossipCache) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if group, key, ok := groupcacheRequest(req); ok {
+		if g := gc.LoaderGroup(group); g != nil {
+			g.recordHot(key)
+		}
+	}
+
+	gc.HTTPPool.ServeHTTP(rw, req)
+}
+
+// groupcacheRequest extracts the group and key of a groupcache
+// GET request, {base}/{group}/{key}
+func groupcacheRequest(req *http.Request) (group, key string, ok bool) {
+	if req.Method != http.MethodGet {
+		return "", "", false
+	}
+
+	p := req.URL.EscapedPath()
+	i := strings.LastIndexByte(p, '/')
+	if i < 1 {
+		return "", "", false
+	}
+
+	j := strings.LastIndexByte(p[:i], '/')
+	group, err1 := url.PathUnescape(p[j+1 : i])
+	key, err2 := url.PathUnescape(p[i+1:])
+	if err1 != nil || err2 != nil || group == "" {
+		return "", "", false
+	}
+	return group, key, true
+}
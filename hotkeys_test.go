@@ -0,0 +1,36 @@
+package gossipcache
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHotKeysLateCandidate checks a key becoming hot late in a window
+// is reported even when many others reached the threshold before
+func TestHotKeysLateCandidate(t *testing.T) {
+	g := &Group{}
+	if err := WithHotKeys(1, 1, 1<<20)(g); err != nil {
+		t.Fatal(err)
+	}
+
+	hk := g.hot
+	now := time.Now()
+	hk.start = now
+
+	// fill the candidates with keys barely over the threshold
+	for i := 0; i < 8; i++ {
+		hk.record(string(rune('a'+i)), now)
+	}
+
+	for i := 0; i < 100; i++ {
+		hk.record("late", now)
+	}
+
+	owned, ended := hk.record("x", now.Add(HotKeyWindow))
+	switch {
+	case !ended:
+		t.Fatal("window not ended")
+	case len(owned) != 1 || owned[0].Key != "late":
+		t.Fatalf("expected late to be the hot key, got %+v", owned)
+	}
+}
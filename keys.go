@@ -0,0 +1,61 @@
+package gossipcache
+
+import (
+	"strconv"
+	"unsafe"
+)
+
+// KeyEncoder converts the keys of a TypedGroup to and from
+// the strings used by the cache
+type KeyEncoder[K any] interface {
+	EncodeKey(K) string
+	DecodeKey(string) (K, error)
+}
+
+// KeyFuncs is a KeyEncoder using the given functions
+type KeyFuncs[K any] struct {
+	Encode func(K) string
+	Decode func(string) (K, error)
+}
+
+// EncodeKey converts a key into a string
+func (kf KeyFuncs[K]) EncodeKey(key K) string { return kf.Encode(key) }
+
+// DecodeKey converts a string into a key
+func (kf KeyFuncs[K]) DecodeKey(s string) (K, error) { return kf.Decode(s) }
+
+// StringKeys returns a KeyEncoder for string keys
+func StringKeys[K ~string]() KeyEncoder[K] {
+	return KeyFuncs[K]{
+		Encode: func(key K) string { return string(key) },
+		Decode: func(s string) (K, error) { return K(s), nil },
+	}
+}
+
+// IntKeys returns a KeyEncoder for signed integer keys
+func IntKeys[K ~int | ~int8 | ~int16 | ~int32 | ~int64]() KeyEncoder[K] {
+	return KeyFuncs[K]{
+		Encode: func(key K) string {
+			return strconv.FormatInt(int64(key), 10)
+		},
+		Decode: func(s string) (K, error) {
+			var key K
+			n, err := strconv.ParseInt(s, 10, int(unsafe.Sizeof(key))*8)
+			return K(n), err
+		},
+	}
+}
+
+// UintKeys returns a KeyEncoder for unsigned integer keys
+func UintKeys[K ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64]() KeyEncoder[K] {
+	return KeyFuncs[K]{
+		Encode: func(key K) string {
+			return strconv.FormatUint(uint64(key), 10)
+		},
+		Decode: func(s string) (K, error) {
+			var key K
+			n, err := strconv.ParseUint(s, 10, int(unsafe.Sizeof(key))*8)
+			return K(n), err
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package gossipcache
+
+import (
+	"math"
+	"testing"
+)
+
+func testKeyRoundTrip[K comparable](t *testing.T, keys KeyEncoder[K], key K, s string) {
+	t.Helper()
+
+	if got := keys.EncodeKey(key); got != s {
+		t.Fatalf("expected %q, got %q", s, got)
+	}
+
+	got, err := keys.DecodeKey(s)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case got != key:
+		t.Fatalf("expected %v, got %v", key, got)
+	}
+}
+
+type testStringKey string
+
+func TestKeyEncoders(t *testing.T) {
+	testKeyRoundTrip(t, StringKeys[string](), "key", "key")
+	testKeyRoundTrip(t, StringKeys[testStringKey](), "key", "key")
+
+	testKeyRoundTrip(t, IntKeys[int](), -42, "-42")
+	testKeyRoundTrip(t, IntKeys[int8](), math.MinInt8, "-128")
+	testKeyRoundTrip(t, IntKeys[int64](), math.MaxInt64, "9223372036854775807")
+
+	testKeyRoundTrip(t, UintKeys[uint](), 42, "42")
+	testKeyRoundTrip(t, UintKeys[uint16](), math.MaxUint16, "65535")
+	testKeyRoundTrip(t, UintKeys[uint64](), math.MaxUint64, "18446744073709551615")
+
+	testKeyRoundTrip(t, KeyFuncs[bool]{
+		Encode: func(key bool) string { return map[bool]string{true: "y", false: "n"}[key] },
+		Decode: func(s string) (bool, error) { return s == "y", nil },
+	}, true, "y")
+}
+
+func TestKeyEncodersRange(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"int8", func() error { _, err := IntKeys[int8]().DecodeKey("128"); return err }},
+		{"int32", func() error { _, err := IntKeys[int32]().DecodeKey("x"); return err }},
+		{"uint8", func() error { _, err := UintKeys[uint8]().DecodeKey("256"); return err }},
+		{"uint", func() error { _, err := UintKeys[uint]().DecodeKey("-1"); return err }},
+	} {
+		if err := tc.fn(); err == nil {
+			t.Errorf("%s: invalid key decoded", tc.name)
+		}
+	}
+}
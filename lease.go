@@ -0,0 +1,311 @@
+package gossipcache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLeaseWindow is how long after a change of peers loads
+	// are coordinated when WithLeases isn't given a window
+	DefaultLeaseWindow = 30 * time.Second
+	// DefaultLeaseTimeout is how long a node waits for another to
+	// load a value when WithLeases isn't given a timeout
+	DefaultLeaseTimeout = 5 * time.Second
+)
+
+// leases tracks the loads of a Group happening on this node or
+// on the nodes this one allowed to, so a key is loaded once
+type leases struct {
+	window  time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	m         map[string]*lease
+	lastSweep time.Time
+}
+
+// lease is the right to load a key
+type lease struct {
+	holder string
+	expire time.Time
+	done   chan struct{}
+	// e is the loaded value, nil if loading failed
+	e *envelope
+	// keep is until when the loaded value is kept
+	keep time.Time
+}
+
+// WithLeases creates a GroupOption to load each key once cluster-wide
+// while nodes disagree on its owner. For up to window after a change
+// of peers, a node about to load a key asks the node that owned it
+// before, and waits up to timeout for the value if that node, or
+// another it allowed, is already loading it, or loads it on its own
+func WithLeases(window, timeout time.Duration) GroupOption {
+	return func(g *Group) error {
+		if window <= 0 {
+			window = DefaultLeaseWindow
+		}
+		if timeout <= 0 {
+			timeout = DefaultLeaseTimeout
+		}
+
+		g.leases = &leases{
+			window:  window,
+			timeout: timeout,
+			m:       make(map[string]*lease),
+		}
+		return nil
+	}
+}
+
+// acquire returns the lease of a key, reporting true if it's
+// granted to the given holder, or false if someone else
+// has it
+func (ls *leases) acquire(key, holder string) (*lease, bool) {
+	now := time.Now()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.unsafeSweep(now)
+
+	if l, ok := ls.m[key]; ok && l.isValid(now) {
+		return l, false
+	}
+
+	l := &lease{
+		holder: holder,
+		expire: now.Add(ls.timeout),
+		done:   make(chan struct{}),
+	}
+	ls.m[key] = l
+	return l, true
+}
+
+// release records the value loaded by the holder of a lease.
+// It's kept until the lease expires for those asking late
+func (ls *leases) release(key, holder string, e *envelope) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.m[key]
+	if !ok || l.holder != holder || l.isDone() {
+		return
+	}
+
+	l.e = e
+	if e == nil {
+		delete(ls.m, key)
+	} else {
+		l.keep = time.Now().Add(ls.timeout)
+	}
+	close(l.done)
+}
+
+// unsafeSweep forgets expired leases, at most once per timeout
+func (ls *leases) unsafeSweep(now time.Time) {
+	if now.Sub(ls.lastSweep) < ls.timeout {
+		return
+	}
+
+	for key, l := range ls.m {
+		if !l.isValid(now) {
+			delete(ls.m, key)
+		}
+	}
+	ls.lastSweep = now
+}
+
+// isValid tells if the holder is still loading the value,
+// or it's still kept
+func (l *lease) isValid(now time.Time) bool {
+	return now.Before(l.expire) || now.Before(l.keep)
+}
+
+func (l *lease) isDone() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the holder of a lease to load the value,
+// returning nil if it failed or took too long
+func (l *lease) wait(ctx context.Context) *envelope {
+	ctx, cancel := context.WithDeadline(ctx, l.expire)
+	defer cancel()
+
+	select {
+	case <-l.done:
+		return l.e
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// loadLeased calls the Loader unless another node is already
+// loading the key, in which case its value is used
+func (g *Group) loadLeased(ctx context.Context, key string) (*envelope, error) {
+	if g.leases == nil {
+		return g.callLoader(ctx, key)
+	}
+
+	if prev := g.gc.previousOwner(key, g.leases.window); prev != "" {
+		// the previous owner may be loading it
+		e, granted := g.requestLease(ctx, prev, key)
+		switch {
+		case e != nil:
+			return e, nil
+		case granted:
+			e, err := g.loadHeld(ctx, key)
+			g.releaseLease(prev, key, e)
+			return e, err
+		}
+	}
+
+	return g.loadHeld(ctx, key)
+}
+
+// loadHeld calls the Loader holding the lease of the key on
+// this node, or waits for the value if someone else holds it
+func (g *Group) loadHeld(ctx context.Context, key string) (*envelope, error) {
+	self := g.gc.BaseURL
+
+	l, granted := g.leases.acquire(key, self)
+	if !granted {
+		if e := l.wait(ctx); e != nil {
+			return e, nil
+		}
+	}
+
+	e, err := g.callLoader(ctx, key)
+	if granted {
+		g.leases.release(key, self, e)
+	}
+	return e, err
+}
+
+// requestLease asks another node for the lease of a key. It returns
+// the value if that node has it, or reports if the lease was granted.
+// Neither means we load it on our own
+func (g *Group) requestLease(ctx context.Context, peer, key string) (*envelope, bool) {
+	ctx, cancel := context.WithTimeout(ctx, g.leases.timeout)
+	defer cancel()
+
+	b, err := g.gc.postPeer(ctx, peer, []byte(g.gc.BaseURL), "lease", g.Name(), key)
+	switch {
+	case err != nil:
+		return nil, false
+	case len(b) == 0:
+		return nil, true
+	}
+
+	e, err := decodeEnvelope(b)
+	if err != nil || e.tag != g.tag {
+		return nil, false
+	}
+	return e, false
+}
+
+// releaseLease tells the node that granted us a lease what we
+// loaded, in the background
+func (g *Group) releaseLease(peer, key string, e *envelope) {
+	body := binary.AppendUvarint(nil, uint64(len(g.gc.BaseURL)))
+	body = append(body, g.gc.BaseURL...)
+	if e != nil {
+		body = append(body, e.Bytes()...)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), g.leases.timeout)
+		defer cancel()
+
+		_, err := g.gc.postPeer(ctx, peer, body, "lease", g.Name(), key, "release")
+		if err != nil {
+			g.gc.error(err).WithField("group", g.Name()).Print("Failed to release lease")
+		}
+	}()
+}
+
+// leaseGroup returns the Group a lease request is for,
+// or nil if it doesn't use WithLeases
+func (gc *GossipCache) leaseGroup(req *http.Request) *Group {
+	g := gc.LoaderGroup(req.PathValue("group"))
+	if g == nil || g.leases == nil {
+		return nil
+	}
+	return g
+}
+
+// serveLease grants the lease of a key to the node asking, or
+// returns the value once whoever holds it loads it. A conflict
+// tells the node to load it on its own
+func (gc *GossipCache) serveLease(rw http.ResponseWriter, req *http.Request) {
+	g := gc.leaseGroup(req)
+	if g == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	holder, err := io.ReadAll(io.LimitReader(req.Body, 4096))
+	if err != nil || len(holder) == 0 {
+		http.Error(rw, "invalid node", http.StatusBadRequest)
+		return
+	}
+
+	l, granted := g.leases.acquire(req.PathValue("key"), string(holder))
+	if granted {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e := l.wait(req.Context())
+	if e == nil {
+		http.Error(rw, "lease not released", http.StatusConflict)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = rw.Write(e.Bytes())
+}
+
+// serveLeaseRelease receives the value loaded by the holder
+// of a lease, empty if it failed
+func (gc *GossipCache) serveLeaseRelease(rw http.ResponseWriter, req *http.Request) {
+	g := gc.leaseGroup(req)
+	if g == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxPeerResponse))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	holder, rest, ok := nextField(buf)
+	if !ok || len(holder) == 0 {
+		http.Error(rw, "invalid node", http.StatusBadRequest)
+		return
+	}
+
+	var e *envelope
+	if len(rest) > 0 {
+		e, err = decodeEnvelope(rest)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	g.leases.release(req.PathValue("key"), string(holder), e)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,213 @@
+package gossipcache
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"darvaza.org/cache"
+)
+
+func newTestLeases(t *testing.T, timeout time.Duration) *leases {
+	t.Helper()
+
+	g := &Group{}
+	if err := WithLeases(time.Minute, timeout)(g); err != nil {
+		t.Fatal(err)
+	}
+	return g.leases
+}
+
+func TestLeases(t *testing.T) {
+	ls := newTestLeases(t, time.Minute)
+	e := &envelope{value: []byte("value")}
+
+	l, granted := ls.acquire("key", "a")
+	if !granted {
+		t.Fatal("lease not granted")
+	}
+
+	// others wait for the holder
+	l2, granted := ls.acquire("key", "b")
+	switch {
+	case granted:
+		t.Fatal("lease granted twice")
+	case l2 != l:
+		t.Fatal("different lease returned")
+	}
+
+	waited := make(chan *envelope, 1)
+	go func() { waited <- l2.wait(context.Background()) }()
+
+	// only the holder releases it
+	ls.release("key", "b", nil)
+	if l.isDone() {
+		t.Fatal("lease released by another node")
+	}
+
+	ls.release("key", "a", e)
+	select {
+	case v := <-waited:
+		if v != e {
+			t.Fatalf("unexpected value %+v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not woken by the release")
+	}
+
+	// the value is kept for those asking late
+	if l3, granted := ls.acquire("key", "c"); granted || l3.wait(context.Background()) != e {
+		t.Fatal("released value not kept")
+	}
+}
+
+func TestLeaseFailed(t *testing.T) {
+	ls := newTestLeases(t, time.Minute)
+
+	l, _ := ls.acquire("key", "a")
+	ls.release("key", "a", nil)
+
+	switch {
+	case l.wait(context.Background()) != nil:
+		t.Fatal("value of a failed load")
+	case func() bool { _, granted := ls.acquire("key", "b"); return !granted }():
+		t.Fatal("lease kept after the load failed")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	ls := newTestLeases(t, 50*time.Millisecond)
+
+	l, _ := ls.acquire("key", "a")
+
+	start := time.Now()
+	if e := l.wait(context.Background()); e != nil {
+		t.Fatal("value of an expired lease")
+	} else if d := time.Since(start); d > time.Second {
+		t.Fatalf("waited %v for a lease of 50ms", d)
+	}
+
+	// expired leases are given to others
+	if _, granted := ls.acquire("key", "b"); !granted {
+		t.Fatal("expired lease not granted")
+	}
+
+	// and the old holder can't release them
+	ls.release("key", "a", &envelope{})
+	if l2, _ := ls.acquire("key", "c"); l2.isDone() {
+		t.Fatal("lease released by its old holder")
+	}
+}
+
+// findMovedKey returns a key owned by from before a change of
+// peers, and by to after it
+func findMovedKey(t *testing.T, before, after *ring, from, to string) string {
+	t.Helper()
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i))))
+		if before.Owner(key) == from && after.Owner(key) == to {
+			return key
+		}
+	}
+
+	t.Fatal("no key found")
+	return ""
+}
+
+// closeWindow makes a GossipCache forget the last change of peers
+func closeWindow(gc *GossipCache) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.ringChanged = time.Time{}
+}
+
+// TestLeasesJoin simulates a node joining while the previous owner
+// of a key is loading it, and counts the calls to the origin as the
+// nodes disagree on who owns it
+func TestLeasesJoin(t *testing.T) {
+	nodes := newTestNodes(t, 3, "join", WithLeases(time.Minute, 5*time.Second))
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	gate := make(chan struct{})
+	for _, node := range nodes {
+		node.gate = gate
+	}
+
+	// a and b were a cluster for a while
+	before := []string{a.gc.BaseURL, b.gc.BaseURL}
+	for _, node := range []*testNode{a, b} {
+		node.gc.setPeers(before)
+		closeWindow(node.gc)
+	}
+	c.gc.setPeers(nil)
+
+	all := []string{a.gc.BaseURL, b.gc.BaseURL, c.gc.BaseURL}
+	key := findMovedKey(t, newRing(a.gc.replicas(), before...),
+		newRing(a.gc.replicas(), all...), a.gc.BaseURL, c.gc.BaseURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	load := func(node *testNode) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var sink bytesSink
+			if err := node.g.load(ctx, key, &sink); err != nil {
+				t.Error(err)
+			} else if node == c {
+				// kept by the new owner, as groupcache does
+				_ = c.g.g.Set(ctx, key, sink.b, sink.e, cache.MainCache)
+			}
+		}()
+	}
+
+	// the owner starts loading the key
+	load(a)
+	waitFor(t, 5*time.Second, "the owner to load", func() bool {
+		return a.calls.Load() == 1
+	})
+
+	// c joins, and everyone asks for the key
+	for _, node := range nodes {
+		node.gc.setPeers(all)
+	}
+	for _, node := range nodes {
+		load(node)
+		load(node)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	calls := func() int32 {
+		return a.calls.Load() + b.calls.Load() + c.calls.Load()
+	}
+	if n := calls(); n != 1 {
+		t.Fatalf("expected the origin to be called once, got %v", n)
+	}
+
+	// once settled, everyone gets it from the new owner
+	linkTestNodes(nodes)
+	for _, node := range nodes {
+		closeWindow(node.gc)
+	}
+	for _, node := range nodes {
+		if _, err := node.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := calls(); n != 1 {
+		t.Fatalf("expected the origin to be called once after the window, got %v", n)
+	}
+}
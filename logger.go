@@ -0,0 +1,25 @@
+package gossipcache
+
+import (
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+)
+
+func (gc *GossipCache) logger() slog.Logger {
+	if gc.Logger == nil {
+		return discard.New()
+	}
+	return gc.Logger
+}
+
+func (gc *GossipCache) warn() slog.Logger {
+	return gc.logger().Warn()
+}
+
+func (gc *GossipCache) error(err error) slog.Logger {
+	l := gc.logger().Error()
+	if err != nil {
+		l = l.WithField(slog.ErrorFieldName, err)
+	}
+	return l
+}
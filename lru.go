@@ -0,0 +1,100 @@
+package gossipcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache keeps the most recently used envelopes of a Group on
+// this node, up to a number of bytes
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	e   *envelope
+}
+
+func (c *lruCache) init(maxBytes int64) {
+	c.maxBytes = maxBytes
+	c.items = make(map[string]*list.Element)
+}
+
+func entrySize(key string, e *envelope) int64 {
+	return int64(len(key) + len(e.value))
+}
+
+// Add stores an envelope, evicting the least recently
+// used ones if needed
+func (c *lruCache) Add(key string, e *envelope) {
+	if entrySize(key, e) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		le := el.Value.(*lruEntry)
+		c.bytes += entrySize(key, e) - entrySize(key, le.e)
+		le.e = e
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, e: e})
+		c.bytes += entrySize(key, e)
+	}
+
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Get returns a stored envelope
+func (c *lruCache) Get(key string) (*envelope, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry).e, true
+	}
+	return nil, false
+}
+
+// Remove forgets a stored envelope
+func (c *lruCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	le := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, le.key)
+	c.bytes -= entrySize(le.key, le.e)
+}
+
+// Range calls fn for each stored envelope, most recently used
+// first, until it returns false
+func (c *lruCache) Range(fn func(key string, e *envelope) bool) {
+	c.mu.Lock()
+	entries := make([]lruEntry, 0, len(c.items))
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*lruEntry))
+	}
+	c.mu.Unlock()
+
+	for _, le := range entries {
+		if !fn(le.key, le.e) {
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package gossipcache
+
+import (
+	"errors"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// DefaultNegativeTTL is how long a key is remembered as not found
+// when neither the Loader nor WithNegativeTTL say
+const DefaultNegativeTTL = 30 * time.Second
+
+var (
+	// ErrNotFound indicates the key doesn't exist. Loaders return it,
+	// or an error wrapping it like NotFound(), to have the absence
+	// cached, and Groups return it when the absence is cached
+	ErrNotFound = errors.New("not found")
+)
+
+// NotFound returns an error for Loaders to report a key doesn't
+// exist, and how long to remember that. Zero uses the Group's
+// negative TTL
+func NotFound(ttl time.Duration) error {
+	return &notFoundError{ttl: ttl}
+}
+
+type notFoundError struct {
+	ttl time.Duration
+}
+
+func (*notFoundError) Error() string { return ErrNotFound.Error() }
+
+func (*notFoundError) Is(err error) bool { return err == ErrNotFound }
+
+// WithNegativeTTL creates a GroupOption setting how long keys the
+// Loader reports as not found are remembered as such, unless the
+// Loader says otherwise
+func WithNegativeTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) error {
+		if ttl <= 0 {
+			return core.Wrap(core.ErrInvalid, "negative TTL")
+		}
+
+		g.negativeTTL = ttl
+		return nil
+	}
+}
+
+// newNotFoundEnvelope creates the envelope remembering
+// a key doesn't exist
+func (g *Group) newNotFoundEnvelope(err error, now time.Time) *envelope {
+	var ttl time.Duration
+
+	var nf *notFoundError
+	if errors.As(err, &nf) {
+		ttl = nf.ttl
+	}
+
+	switch {
+	case ttl > 0:
+	case g.negativeTTL > 0:
+		ttl = g.negativeTTL
+	default:
+		ttl = DefaultNegativeTTL
+	}
+
+	fresh := now.Add(g.withJitter(ttl))
+	return &envelope{
+		tag:      g.tag,
+		notFound: true,
+		fresh:    fresh,
+		expire:   fresh,
+	}
+}
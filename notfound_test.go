@@ -0,0 +1,54 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestNegativeCaching checks keys the Loader doesn't find are
+// served as ErrNotFound from the cache until their negative TTL
+// passes, the Loader's own first
+func TestNegativeCaching(t *testing.T) {
+	const negativeTTL = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		ttl  time.Duration
+	}{
+		{"group", ErrNotFound, negativeTTL},
+		{"loader", NotFound(negativeTTL / 2), negativeTTL / 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+
+			g := newTestGroup(t, &GossipCache{}, "notfound",
+				func(context.Context, string) (Entry, error) {
+					calls.Add(1)
+					return Entry{}, tc.err
+				}, WithNegativeTTL(negativeTTL))
+
+			ctx := context.Background()
+			for i := 0; i < 3; i++ {
+				if _, err := g.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+					t.Fatalf("expected %v, got %v", ErrNotFound, err)
+				}
+			}
+			if n := calls.Load(); n != 1 {
+				t.Fatalf("expected one Loader call, got %v", n)
+			}
+
+			time.Sleep(tc.ttl + 10*time.Millisecond)
+
+			if _, err := g.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected %v, got %v", ErrNotFound, err)
+			}
+			if n := calls.Load(); n != 2 {
+				t.Fatalf("expected the key loaded again, got %v calls", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gossipcache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers identifying the node sending a request to a PeerHandler
+const (
+	headerPeer      = "Gossipcache-Peer"
+	headerTime      = "Gossipcache-Time"
+	headerSignature = "Gossipcache-Signature"
+)
+
+// peerRequestMaxAge is how far the time of a signed request
+// can be from ours
+const peerRequestMaxAge = time.Minute
+
+var (
+	errUnknownPeer      = errors.New("unknown peer")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// fromPeer wraps a handler of the PeerHandler so it's only called
+// for requests of the current peers, or of any node if not member,
+// signed with the PeerSecret when there is one
+func (gc *GossipCache) fromPeer(member bool, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxPeerResponse))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := gc.verifyPeer(req, body, member); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		fn(rw, req)
+	})
+}
+
+// verifyPeer checks the node sending a request
+func (gc *GossipCache) verifyPeer(req *http.Request, body []byte, member bool) error {
+	peer := req.Header.Get(headerPeer)
+	switch {
+	case peer == "", peer == gc.BaseURL:
+		return errUnknownPeer
+	case member && !slices.Contains(gc.Peers(), peer):
+		return errUnknownPeer
+	case len(gc.PeerSecret) == 0:
+		return nil
+	}
+
+	ts, err := strconv.ParseInt(req.Header.Get(headerTime), 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	if d := time.Since(time.Unix(ts, 0)); d > peerRequestMaxAge || d < -peerRequestMaxAge {
+		return errInvalidSignature
+	}
+
+	mac, err := base64.StdEncoding.DecodeString(req.Header.Get(headerSignature))
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if !hmac.Equal(mac, gc.peerMAC(req.Method, path, peer, ts, body)) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// signPeerRequest identifies this node on a request to
+// the PeerHandler of another, signing it if there is
+// a PeerSecret
+func (gc *GossipCache) signPeerRequest(req *http.Request, path string, body []byte) {
+	req.Header.Set(headerPeer, gc.BaseURL)
+	if len(gc.PeerSecret) == 0 {
+		return
+	}
+
+	ts := time.Now().Unix()
+	mac := gc.peerMAC(req.Method, path, gc.BaseURL, ts, body)
+
+	req.Header.Set(headerTime, strconv.FormatInt(ts, 10))
+	req.Header.Set(headerSignature, base64.StdEncoding.EncodeToString(mac))
+}
+
+// peerMAC computes the HMAC-SHA256 of a request, using the PeerSecret,
+// over its method, path relative to the PeerBasePath, sender, time
+// and body
+func (gc *GossipCache) peerMAC(method, path, peer string, ts int64, body []byte) []byte {
+	var buf []byte
+
+	for _, s := range []string{method, path, peer} {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = binary.AppendVarint(buf, ts)
+
+	mac := hmac.New(sha256.New, gc.PeerSecret)
+	_, _ = mac.Write(buf)
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,76 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestPeerServer serves the PeerHandler of a GossipCache,
+// setting its BaseURL
+func newTestPeerServer(t *testing.T, gc *GossipCache) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.StripPrefix(strings.TrimSuffix(DefaultPeerBasePath, "/"),
+		gc.PeerHandler()))
+	t.Cleanup(srv.Close)
+
+	gc.BaseURL = srv.URL
+	return srv
+}
+
+func peerStatus(err error) string {
+	var pe *peerError
+	if errors.As(err, &pe) {
+		return pe.status
+	}
+	return ""
+}
+
+func TestPeerHandlerAuth(t *testing.T) {
+	secret := []byte("peer secret")
+
+	for _, tc := range []struct {
+		name     string
+		secret   []byte
+		sender   []byte
+		member   bool
+		parts    []string
+		expected string
+	}{
+		{"signed", secret, secret, true, []string{"replica", "g", "k"}, "404 Not Found"},
+		{"wrong secret", secret, []byte("wrong"), true, []string{"replica", "g", "k"}, "403 Forbidden"},
+		{"unsigned", secret, nil, true, []string{"replica", "g", "k"}, "403 Forbidden"},
+		{"not a peer", secret, secret, false, []string{"replica", "g", "k"}, "403 Forbidden"},
+		{"joining", secret, secret, false, []string{"handoff", "g", "pull"}, "404 Not Found"},
+		{"no secret", nil, nil, true, []string{"lease", "g", "k"}, "404 Not Found"},
+		{"no secret not a peer", nil, nil, false, []string{"lease", "g", "k"}, "403 Forbidden"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &GossipCache{PeerSecret: tc.secret}
+			newTestPeerServer(t, server)
+
+			sender := &GossipCache{
+				BaseURL:    "http://sender.invalid",
+				PeerSecret: tc.sender,
+			}
+
+			peers := []string{server.BaseURL}
+			if tc.member {
+				peers = append(peers, sender.BaseURL)
+			}
+			server.peers = peers
+
+			// an unknown group is only reported once
+			// the sender is accepted
+			_, err := sender.postPeer(context.Background(), server.BaseURL,
+				[]byte("body"), tc.parts...)
+			if s := peerStatus(err); s != tc.expected {
+				t.Fatalf("expected %q, got %q (%v)", tc.expected, s, err)
+			}
+		})
+	}
+}
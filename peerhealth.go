@@ -0,0 +1,379 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// peerBreakerThreshold is how many requests in a row a peer
+	// can fail before we stop asking it
+	peerBreakerThreshold = 3
+	// peerBreakerCooldown is how long a peer is skipped once its
+	// circuit breaker opens, doubling every time the next request
+	// fails too
+	peerBreakerCooldown = time.Second
+	// peerBreakerMaxCooldown is the longest a peer is skipped
+	peerBreakerMaxCooldown = 30 * time.Second
+
+	// suspectTimeoutRTTs is how many round trips a request to a
+	// suspect peer can take
+	suspectTimeoutRTTs = 4
+	// suspectTimeoutMin is the shortest timeout given to a
+	// request to a suspect peer
+	suspectTimeoutMin = 100 * time.Millisecond
+	// suspectTimeoutMax is the longest timeout given to a
+	// request to a suspect peer, or the one used when its
+	// round trip time isn't known
+	suspectTimeoutMax = time.Second
+
+	// rttWeight is the weight of a new sample on the
+	// smoothed round trip time
+	rttWeight = 0.2
+)
+
+var (
+	errPeerUnavailable = errors.New("peer unavailable")
+)
+
+// PeerStatus describes what this node knows about a peer
+type PeerStatus struct {
+	// Peer is the CacheBaseURL of the node
+	Peer string `json:"peer"`
+	// Node is the memberlist name of the node, if known
+	Node string `json:"node,omitempty"`
+	// State is the memberlist state of the node, alive, suspect,
+	// dead or left, or unknown
+	State string `json:"state"`
+	// RTT is the smoothed round trip time of memberlist pings
+	RTT time.Duration `json:"rtt"`
+	// Failures is the number of requests in a row that failed
+	Failures int `json:"failures"`
+	// Breaker is the state of the circuit breaker, closed
+	// when the peer is asked, open when it's skipped, or
+	// half-open when the next request decides
+	Breaker string `json:"breaker"`
+	// RetryAt is when an open circuit breaker becomes half-open
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// peerHealth tracks what we know about the state
+// of the other nodes
+type peerHealth struct {
+	mu      sync.Mutex
+	cluster *Cluster
+	peers   map[string]*peerStats
+}
+
+type peerStats struct {
+	name    string
+	rtt     time.Duration
+	lastAck time.Time
+
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+}
+
+// WithPeerHealth creates a configuration option to tell the
+// GossipCache what memberlist knows about the health of its peers,
+// their state and round trip time, using the given callback to
+// extract the CacheBaseURL from the Node, typically from its metadata
+func WithPeerHealth(gc *GossipCache,
+	cacheURL func(*memberlist.Node) (string, bool)) ClusterConfigOption {
+	opt := func(cluster *Cluster, conf *memberlist.Config) error {
+		if gc == nil || cacheURL == nil {
+			return errors.New("invalid peer health")
+		}
+
+		h := &gc.health
+		h.setCluster(cluster)
+
+		delegate := &cluster.delegate
+		// nodes leaving are remembered, to know they are gone,
+		// until Set forgets them
+		delegate.addEventHook(func(_ *Cluster, node *memberlist.Node,
+			ev memberlist.NodeEventType) {
+			if u, ok := cacheURL(node); ok && ev != memberlist.NodeLeave {
+				h.setNode(u, node.Name)
+			}
+		})
+		delegate.addPingHook(func(_ *Cluster, node *memberlist.Node, rtt time.Duration) {
+			if u, ok := cacheURL(node); ok {
+				h.addRTT(u, rtt)
+			}
+		})
+
+		conf.Events = delegate
+		conf.Ping = delegate
+		return nil
+	}
+	return opt
+}
+
+func (h *peerHealth) setCluster(cluster *Cluster) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cluster = cluster
+}
+
+// unsafeStats returns the stats of a peer, creating them if needed
+func (h *peerHealth) unsafeStats(peer string) *peerStats {
+	ps, ok := h.peers[peer]
+	if !ok {
+		if h.peers == nil {
+			h.peers = make(map[string]*peerStats)
+		}
+
+		ps = new(peerStats)
+		h.peers[peer] = ps
+	}
+	return ps
+}
+
+func (h *peerHealth) setNode(peer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsafeStats(peer).name = name
+}
+
+func (h *peerHealth) addRTT(peer string, rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ps, ok := h.peers[peer]
+	if !ok {
+		return
+	}
+
+	if ps.rtt == 0 {
+		ps.rtt = rtt
+	} else {
+		ps.rtt += time.Duration(rttWeight * float64(rtt-ps.rtt))
+	}
+	ps.lastAck = time.Now()
+}
+
+// retain forgets about the peers not in the list
+func (h *peerHealth) retain(peers []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for peer := range h.peers {
+		if !slices.Contains(peers, peer) {
+			delete(h.peers, peer)
+		}
+	}
+}
+
+// nodeState returns the memberlist state of a peer, if known.
+// memberlist reports suspect nodes as alive, so they are
+// suspected here when its probes go unacknowledged
+func (h *peerHealth) nodeState(peer string) (memberlist.NodeStateType, bool) {
+	h.mu.Lock()
+	var name string
+	var lastAck time.Time
+	if ps, ok := h.peers[peer]; ok {
+		name, lastAck = ps.name, ps.lastAck
+	}
+	cluster := h.cluster
+	h.mu.Unlock()
+
+	if name == "" || cluster == nil || cluster.members == nil {
+		return 0, false
+	}
+
+	for _, node := range cluster.members.Members() {
+		if node.Name != name {
+			continue
+		}
+
+		if !lastAck.IsZero() && time.Since(lastAck) > suspectAfter(cluster) {
+			return memberlist.StateSuspect, true
+		}
+		return node.State, true
+	}
+	return memberlist.StateDead, true
+}
+
+// suspectAfter returns how long a peer can go without acknowledging
+// a probe. memberlist probes one node per ProbeInterval in turn,
+// so every node is probed at least once every two rounds
+func suspectAfter(cluster *Cluster) time.Duration {
+	conf := &cluster.config
+	n := time.Duration(cluster.members.NumMembers())
+	return 2*n*conf.ProbeInterval + conf.ProbeTimeout
+}
+
+// succeeded records a peer answered, closing its
+// circuit breaker
+func (h *peerHealth) succeeded(peer string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ps, ok := h.peers[peer]; ok {
+		ps.failures = 0
+		ps.cooldown = 0
+		ps.openUntil = time.Time{}
+	}
+}
+
+// failed records a peer failed to answer, opening its
+// circuit breaker after too many failures in a row
+func (h *peerHealth) failed(peer string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ps := h.unsafeStats(peer)
+	ps.failures++
+	if ps.failures >= peerBreakerThreshold {
+		ps.cooldown = min(max(2*ps.cooldown, peerBreakerCooldown), peerBreakerMaxCooldown)
+		ps.openUntil = time.Now().Add(ps.cooldown)
+	}
+}
+
+// breakerOpen tells if a peer is skipped because of
+// its recent failures
+func (h *peerHealth) breakerOpen(peer string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ps, ok := h.peers[peer]
+	return ok && time.Now().Before(ps.openUntil)
+}
+
+// suspectTimeout returns how long to wait for a
+// suspect peer
+func (h *peerHealth) suspectTimeout(peer string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ps, ok := h.peers[peer]
+	if !ok || ps.rtt == 0 {
+		return suspectTimeoutMax
+	}
+	return min(max(suspectTimeoutRTTs*ps.rtt, suspectTimeoutMin), suspectTimeoutMax)
+}
+
+// peerAvailable tells if a peer is worth asking, as it's alive
+// according to memberlist, or not known to it, and its circuit
+// breaker isn't open. This node is always available
+func (gc *GossipCache) peerAvailable(peer string) bool {
+	if peer == gc.BaseURL {
+		return true
+	}
+
+	if state, ok := gc.health.nodeState(peer); ok && state != memberlist.StateAlive {
+		return false
+	}
+	return !gc.health.breakerOpen(peer)
+}
+
+// PeerTransport wraps the http.RoundTripper the HTTPPool uses to get
+// values from other nodes, so their failures count towards the circuit
+// breaker of each peer, and requests to peers whose breaker is open
+// fail right away, having the value loaded without waiting for a node
+// that is probably gone. If next is nil http.DefaultTransport is used.
+// Requests to the PeerHandler are already counted
+func (gc *GossipCache) PeerTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &peerTransport{gc: gc, next: next}
+}
+
+type peerTransport struct {
+	gc   *GossipCache
+	next http.RoundTripper
+}
+
+func (pt *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := &pt.gc.health
+	peer, ok := pt.gc.peerOf(req.URL.String())
+	switch {
+	case !ok:
+		return pt.next.RoundTrip(req)
+	case h.breakerOpen(peer):
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, errPeerUnavailable
+	}
+
+	resp, err := pt.next.RoundTrip(req)
+	switch {
+	case err == nil:
+		h.succeeded(peer)
+	case !errors.Is(err, context.Canceled):
+		h.failed(peer)
+	}
+	return resp, err
+}
+
+// peerSuspect tells if memberlist suspects a peer is down
+func (gc *GossipCache) peerSuspect(peer string) bool {
+	state, ok := gc.health.nodeState(peer)
+	return ok && state == memberlist.StateSuspect
+}
+
+// PeerStatus returns what this node knows about its
+// peers, sorted
+func (gc *GossipCache) PeerStatus() []PeerStatus {
+	now := time.Now()
+	out := make([]PeerStatus, 0)
+	for _, peer := range gc.otherPeers() {
+		out = append(out, gc.health.status(peer, now))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
+
+func (h *peerHealth) status(peer string, now time.Time) PeerStatus {
+	state := "unknown"
+	if s, ok := h.nodeState(peer); ok {
+		state = nodeStateNames[s]
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := PeerStatus{
+		Peer:    peer,
+		State:   state,
+		Breaker: "closed",
+	}
+
+	if ps, ok := h.peers[peer]; ok {
+		out.Node = ps.name
+		out.RTT = ps.rtt
+		out.Failures = ps.failures
+
+		switch {
+		case now.Before(ps.openUntil):
+			out.Breaker = "open"
+			out.RetryAt = ps.openUntil
+		case ps.failures >= peerBreakerThreshold:
+			out.Breaker = "half-open"
+		}
+	}
+	return out
+}
+
+var nodeStateNames = map[memberlist.NodeStateType]string{
+	memberlist.StateAlive:   "alive",
+	memberlist.StateSuspect: "suspect",
+	memberlist.StateDead:    "dead",
+	memberlist.StateLeft:    "left",
+}
@@ -0,0 +1,51 @@
+package gossipcache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPeerTransport checks failures of groupcache requests open the
+// circuit breaker of the peer, and then fail right away
+func TestPeerTransport(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer live.Close()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	gc := &GossipCache{BaseURL: "http://self.invalid"}
+	gc.setPeers([]string{gc.BaseURL, live.URL, dead.URL})
+
+	client := &http.Client{Transport: gc.PeerTransport(nil)}
+	get := func(peer string) error {
+		resp, err := client.Get(peer + "/_groupcache/group/key")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < peerBreakerThreshold; i++ {
+		if err := get(dead.URL); err == nil || errors.Is(err, errPeerUnavailable) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	switch {
+	case gc.peerAvailable(dead.URL):
+		t.Fatal("circuit breaker still closed")
+	case !errors.Is(get(dead.URL), errPeerUnavailable):
+		t.Fatal("request sent to a peer with its circuit breaker open")
+	}
+
+	if err := get(live.URL); err != nil {
+		t.Fatal(err)
+	} else if !gc.peerAvailable(live.URL) {
+		t.Fatal("live peer unavailable")
+	}
+}
@@ -0,0 +1,214 @@
+package gossipcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"darvaza.org/core"
+)
+
+const (
+	// DefaultPeerBasePath is the default path under the CacheBaseURL
+	// of each node where its PeerHandler is mounted
+	DefaultPeerBasePath = "/_gossipcache/"
+
+	// maxPeerResponse is the largest response we read from a peer
+	maxPeerResponse = 64 << 20
+)
+
+// Set updates the peers of the groupcache, given as the CacheBaseURL
+// of every node including this one, and remembers them to know the
+// owner of each key
+func (gc *GossipCache) Set(peers ...string) {
+	peers = gc.setPeers(peers)
+	gc.HTTPPool.Set(peers...)
+}
+
+// setPeers remembers the peers and who owns what, returning
+// them sorted and without duplicates
+func (gc *GossipCache) setPeers(peers []string) []string {
+	peers = core.SliceUnique(slices.Clone(peers))
+	slices.Sort(peers)
+
+	r := newRing(gc.replicas(), peers...)
+
+	gc.mu.Lock()
+	if !slices.Equal(gc.peers, peers) {
+		// remember who owned what before, assuming the others
+		// didn't have us if we didn't have them
+		prev := gc.ring
+		if prev.IsEmpty() {
+			prev = newRing(gc.replicas(), core.SliceMinus(peers, []string{gc.BaseURL})...)
+		}
+
+		gc.prevRing = prev
+		gc.ringChanged = time.Now()
+	}
+	gc.peers = peers
+	gc.ring = r
+	gc.mu.Unlock()
+
+	gc.health.retain(peers)
+	return peers
+}
+
+// Peers returns the peers last given to Set
+func (gc *GossipCache) Peers() []string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	return slices.Clone(gc.peers)
+}
+
+// otherPeers returns the peers except this node
+func (gc *GossipCache) otherPeers() []string {
+	return core.SliceMinus(gc.Peers(), []string{gc.BaseURL})
+}
+
+func (gc *GossipCache) replicas() int {
+	if gc.Replicas > 0 {
+		return gc.Replicas
+	}
+	return DefaultCacheReplicas
+}
+
+func (gc *GossipCache) currentRing() *ring {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	return gc.ring
+}
+
+// previousOwner returns the node that owned a key before the
+// last change of peers, if it happened within the given window
+// and it was another node
+func (gc *GossipCache) previousOwner(key string, window time.Duration) string {
+	gc.mu.Lock()
+	prev, changed := gc.prevRing, gc.ringChanged
+	gc.mu.Unlock()
+
+	if prev.IsEmpty() || time.Since(changed) > window {
+		return ""
+	}
+
+	owner := prev.Owner(key)
+	if owner == gc.BaseURL || !gc.peerAvailable(owner) {
+		return ""
+	}
+	return owner
+}
+
+// isOwner tells if this node owns a key. Without peers
+// every key is ours
+func (gc *GossipCache) isOwner(key string) bool {
+	r := gc.currentRing()
+	return r.IsEmpty() || r.Owner(key) == gc.BaseURL
+}
+
+// PeerHandler returns the http.Handler other nodes talk to, to be
+// mounted on PeerBasePath using http.StripPrefix without its trailing
+// slash. Requests are only accepted from the current peers, except
+// those of joining nodes pulling their values, and if PeerSecret is
+// set, only when signed with it. Without a PeerSecret the sender
+// can't be verified, so the handler must only be reachable by the
+// nodes, like on a private network or behind mutual TLS
+func (gc *GossipCache) PeerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /handoff/{group}", gc.fromPeer(true, gc.serveHandoffPush))
+	mux.Handle("POST /handoff/{group}/pull", gc.fromPeer(false, gc.serveHandoffPull))
+	mux.Handle("POST /replica/{group}/{key}", gc.fromPeer(true, gc.serveReplica))
+	mux.Handle("POST /refresh/{group}/{key}", gc.fromPeer(true, gc.serveRefresh))
+	mux.Handle("POST /lease/{group}/{key}", gc.fromPeer(true, gc.serveLease))
+	mux.Handle("POST /lease/{group}/{key}/release", gc.fromPeer(true, gc.serveLeaseRelease))
+	return mux
+}
+
+// peerURL builds the URL of an endpoint of the PeerHandler
+// of a node
+func (gc *GossipCache) peerURL(peer string, parts ...string) string {
+	base := gc.PeerBasePath
+	if base == "" {
+		base = DefaultPeerBasePath
+	}
+
+	for i, s := range parts {
+		parts[i] = url.PathEscape(s)
+	}
+
+	return strings.TrimSuffix(peer, "/") +
+		strings.TrimSuffix(base, "/") + "/" +
+		strings.Join(parts, "/")
+}
+
+// peerOf returns the other node a URL belongs to
+func (gc *GossipCache) peerOf(u string) (string, bool) {
+	for _, peer := range gc.otherPeers() {
+		base := strings.TrimSuffix(peer, "/")
+		if rest, ok := strings.CutPrefix(u, base); ok &&
+			(rest == "" || rest[0] == '/') {
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+func (gc *GossipCache) client() *http.Client {
+	if gc.Client != nil {
+		return gc.Client
+	}
+	return http.DefaultClient
+}
+
+// postPeer sends a request to the PeerHandler of a node
+// and returns the response body
+func (gc *GossipCache) postPeer(ctx context.Context, peer string, body []byte,
+	parts ...string) ([]byte, error) {
+	path := strings.Join(parts, "/")
+	u := gc.peerURL(peer, parts...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	gc.signPeerRequest(req, path, body)
+
+	resp, err := gc.client().Do(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			gc.health.failed(peer)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	gc.health.succeeded(peer)
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxPeerResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, &peerError{url: u, status: resp.Status}
+	}
+	return b, nil
+}
+
+// peerError indicates a peer answered but failed
+// to handle the request
+type peerError struct {
+	url    string
+	status string
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.url, e.status)
+}
@@ -0,0 +1,276 @@
+package gossipcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"darvaza.org/cache"
+	"github.com/hashicorp/memberlist"
+)
+
+// registryStateVersion identifies the format of the state
+// exchanged on push/pull
+const registryStateVersion = 1
+
+// gossipStateRegistry identifies the registry state within
+// the push/pull state
+const gossipStateRegistry byte = 1
+
+// GroupSpec describes a group as registered on a node. Every node
+// of the cluster needs to register the same
+type GroupSpec struct {
+	Name       string `json:"name"`
+	CacheBytes int64  `json:"cache_bytes"`
+	Codec      string `json:"codec,omitempty"`
+}
+
+// GroupMismatch describes a group registered differently
+// on another node
+type GroupMismatch struct {
+	Node  string `json:"node"`
+	Group string `json:"group"`
+	// Local is how the group is registered on this node,
+	// or nil if it isn't
+	Local *GroupSpec `json:"local,omitempty"`
+	// Remote is how the group is registered on the other node,
+	// or nil if it isn't
+	Remote *GroupSpec `json:"remote,omitempty"`
+}
+
+// registryState is what nodes tell each other about their groups
+type registryState struct {
+	Node   string      `json:"node"`
+	Groups []GroupSpec `json:"groups"`
+}
+
+// NewGroup creates a cache group, recording its definition
+// to compare with other nodes
+func (gc *GossipCache) NewGroup(name string, cacheBytes int64,
+	getter cache.Getter[string]) cache.Group[string] {
+	g := gc.HTTPPool.NewGroup(name, cacheBytes, getter)
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	gc.unsafeSetSpec(GroupSpec{
+		Name:       name,
+		CacheBytes: cacheBytes,
+	})
+	return g
+}
+
+// DeregisterGroup removes a cache group
+func (gc *GossipCache) DeregisterGroup(name string) {
+	gc.HTTPPool.DeregisterGroup(name)
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	delete(gc.specs, name)
+	delete(gc.groups, name)
+}
+
+func (gc *GossipCache) unsafeSetSpec(spec GroupSpec) {
+	if gc.specs == nil {
+		gc.specs = make(map[string]GroupSpec)
+	}
+	gc.specs[spec.Name] = spec
+}
+
+// GroupSpecs returns the definition of the groups
+// registered on this node, sorted by name
+func (gc *GossipCache) GroupSpecs() []GroupSpec {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	out := make([]GroupSpec, 0, len(gc.specs))
+	for _, spec := range gc.specs {
+		out = append(out, spec)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// GroupMismatches returns the groups other nodes have
+// registered differently, as learnt on push/pull
+func (gc *GossipCache) GroupMismatches() []GroupMismatch {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	var out []GroupMismatch
+	for _, mm := range gc.mismatches {
+		out = append(out, mm...)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		return a.Node < b.Node || (a.Node == b.Node && a.Group < b.Group)
+	})
+	return out
+}
+
+// hasMismatches tells if a node is known to register
+// groups differently
+func (gc *GossipCache) hasMismatches(node string) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	return len(gc.mismatches[node]) > 0
+}
+
+func (gc *GossipCache) localRegistryState(node string) []byte {
+	state := registryState{
+		Node:   node,
+		Groups: gc.GroupSpecs(),
+	}
+
+	b, err := json.Marshal(&state)
+	if err != nil {
+		return nil
+	}
+	return append([]byte{registryStateVersion}, b...)
+}
+
+func (gc *GossipCache) mergeRegistryState(buf []byte) {
+	var state registryState
+
+	if len(buf) < 1 || buf[0] != registryStateVersion {
+		return
+	} else if err := json.Unmarshal(buf[1:], &state); err != nil || state.Node == "" {
+		gc.error(err).Print("Invalid group registry state received")
+		return
+	}
+
+	mm := compareGroupSpecs(state.Node, gc.GroupSpecs(), state.Groups)
+
+	gc.mu.Lock()
+	old := gc.mismatches[state.Node]
+	if len(mm) > 0 {
+		if gc.mismatches == nil {
+			gc.mismatches = make(map[string][]GroupMismatch)
+		}
+		gc.mismatches[state.Node] = mm
+	} else {
+		delete(gc.mismatches, state.Node)
+	}
+	gc.mu.Unlock()
+
+	if len(mm) > 0 && !slices.EqualFunc(old, mm, sameGroupMismatch) {
+		for _, m := range mm {
+			gc.warn().
+				WithField("node", m.Node).
+				WithField("group", m.Group).
+				Printf("Group registered differently: local:%s remote:%s",
+					m.Local, m.Remote)
+		}
+	}
+}
+
+// forgetNode drops what we know about a node
+// that left the cluster
+func (gc *GossipCache) forgetNode(node string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	delete(gc.mismatches, node)
+}
+
+func (spec *GroupSpec) String() string {
+	if spec == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%d bytes codec:%q", spec.CacheBytes, spec.Codec)
+}
+
+func sameGroupMismatch(a, b GroupMismatch) bool {
+	return a.Group == b.Group &&
+		sameGroupSpec(a.Local, b.Local) &&
+		sameGroupSpec(a.Remote, b.Remote)
+}
+
+func sameGroupSpec(a, b *GroupSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func compareGroupSpecs(node string, local, remote []GroupSpec) []GroupMismatch {
+	var out []GroupMismatch
+
+	index := make(map[string]GroupSpec, len(remote))
+	for _, spec := range remote {
+		index[spec.Name] = spec
+	}
+
+	for _, l := range local {
+		r, ok := index[l.Name]
+		delete(index, l.Name)
+
+		switch {
+		case !ok:
+			out = append(out, GroupMismatch{Node: node, Group: l.Name, Local: &l})
+		case r != l:
+			out = append(out, GroupMismatch{Node: node, Group: l.Name, Local: &l, Remote: &r})
+		}
+	}
+
+	for _, r := range remote {
+		if _, ok := index[r.Name]; ok {
+			out = append(out, GroupMismatch{Node: node, Group: r.Name, Remote: &r})
+		}
+	}
+	return out
+}
+
+// WithGroupRegistry creates a configuration option to compare the
+// groups registered on the GossipCache with other nodes on push/pull.
+// Differences are logged and reported by GroupMismatches, and if
+// reject is set, alive messages from nodes already known to differ
+// are ignored. memberlist merges the nodes of a push/pull before
+// handing over their groups, so this doesn't keep a node that differs
+// from joining, it only stops its later updates, like it rejoining
+// after leaving. The LocalState, MergeRemoteState and Alive delegates
+// of the user keep working alongside
+func WithGroupRegistry(gc *GossipCache, reject bool) ClusterConfigOption {
+	opt := func(cluster *Cluster, conf *memberlist.Config) error {
+		if gc == nil {
+			return errors.New("invalid GossipCache")
+		}
+
+		delegate := &cluster.delegate
+		delegate.addStateHook(gossipStateRegistry,
+			func(c *Cluster, _ bool) []byte {
+				return gc.localRegistryState(c.config.Name)
+			},
+			func(_ *Cluster, buf []byte, _ bool) {
+				gc.mergeRegistryState(buf)
+			})
+		delegate.addEventHook(func(_ *Cluster, node *memberlist.Node, ev memberlist.NodeEventType) {
+			if ev == memberlist.NodeLeave {
+				gc.forgetNode(node.Name)
+			}
+		})
+
+		if reject {
+			delegate.addAliveHook(func(c *Cluster, node *memberlist.Node) error {
+				if node.Name != c.config.Name && gc.hasMismatches(node.Name) {
+					return fmt.Errorf("%s: groups registered differently", node.Name)
+				}
+				return nil
+			})
+			conf.Alive = delegate
+		}
+
+		conf.Delegate = delegate
+		conf.Events = delegate
+		return nil
+	}
+	return opt
+}
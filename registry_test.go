@@ -0,0 +1,89 @@
+package gossipcache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// newTestNamedDelegate prepares a Cluster of the given node name,
+// returning its delegate
+func newTestNamedDelegate(t *testing.T, name string,
+	options ...ClusterConfigOption) *ClusterDelegate {
+	t.Helper()
+
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = name
+
+	cluster, _, err := Prepare(conf, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cluster.delegate
+}
+
+// TestGroupRegistryChained checks the user's delegates keep
+// working alongside the group registry
+func TestGroupRegistryChained(t *testing.T) {
+	errUserRejected := errors.New("rejected by the user")
+
+	var merged []string
+	newNode := func(name string, specs ...GroupSpec) (*GossipCache, *ClusterDelegate) {
+		gc := &GossipCache{}
+		gc.mu.Lock()
+		for _, spec := range specs {
+			gc.unsafeSetSpec(spec)
+		}
+		gc.mu.Unlock()
+
+		delegate := newTestNamedDelegate(t, name,
+			WithLocalStateDelegate(func(*Cluster, bool) []byte {
+				return []byte(name + " state")
+			}),
+			WithMergeRemoteStateDelegate(func(_ *Cluster, buf []byte, _ bool) {
+				merged = append(merged, string(buf))
+			}),
+			WithAliveDelegate(func(_ *Cluster, node *memberlist.Node) error {
+				if node.Name == "stranger" {
+					return errUserRejected
+				}
+				return nil
+			}),
+			WithGroupRegistry(gc, true),
+		)
+		return gc, delegate
+	}
+
+	a, da := newNode("a", GroupSpec{Name: "group", CacheBytes: 1 << 20})
+	_, db := newNode("b", GroupSpec{Name: "group", CacheBytes: 2 << 20})
+
+	// both states go through
+	db.MergeRemoteState(da.LocalState(false), false)
+	da.MergeRemoteState(db.LocalState(false), false)
+
+	if len(merged) != 2 || merged[0] != "a state" || merged[1] != "b state" {
+		t.Fatalf("unexpected user states %q", merged)
+	}
+	if mm := a.GroupMismatches(); len(mm) != 1 || mm[0].Node != "b" {
+		t.Fatalf("unexpected mismatches %+v", mm)
+	}
+
+	// and both checks of alive messages
+	if err := da.NotifyAlive(&memberlist.Node{Name: "b"}); err == nil {
+		t.Fatal("node with different groups accepted")
+	}
+	if err := da.NotifyAlive(&memberlist.Node{Name: "stranger"}); !errors.Is(err, errUserRejected) {
+		t.Fatalf("expected %v, got %v", errUserRejected, err)
+	}
+	if err := da.NotifyAlive(&memberlist.Node{Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// states of nodes without the registry are the user's alone
+	merged = nil
+	da.MergeRemoteState([]byte("plain state"), false)
+	if len(merged) != 1 || merged[0] != "plain state" {
+		t.Fatalf("unexpected user states %q", merged)
+	}
+}
@@ -0,0 +1,207 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"darvaza.org/core"
+	"golang.org/x/sync/singleflight"
+)
+
+// replication holds the values of a Group this node serves
+// on behalf of an unavailable primary owner
+type replication struct {
+	owners int
+	store  lruCache
+	flight singleflight.Group
+}
+
+// WithOwners creates a GroupOption giving each key n owners, the
+// one groupcache uses followed by the next peers on the ring. When
+// the first owner is suspect or doesn't answer, values are fetched
+// from the next available owner instead of being loaded by every
+// node asking. Owners keep up to maxBytes of the values they serve
+// this way, until their TTL. WithPeerHealth tells which peers are
+// suspect, and PeerTransport which fail to answer groupcache
+func WithOwners(n int, maxBytes int64) GroupOption {
+	return func(g *Group) error {
+		if n < 1 || maxBytes <= 0 {
+			return core.Wrap(core.ErrInvalid, "owners")
+		}
+
+		r := &replication{
+			owners: n,
+		}
+		r.store.init(maxBytes)
+
+		g.replication = r
+		return nil
+	}
+}
+
+// failoverOwners returns the owners to ask for a key, in order,
+// reporting false if the first one is available. Suspect owners
+// are left for last
+func (g *Group) failoverOwners(key string) ([]string, bool) {
+	n := 1
+	if g.replication != nil {
+		n = g.replication.owners
+	}
+
+	owners := g.gc.currentRing().Owners(key, n)
+	if len(owners) == 0 || g.gc.peerAvailable(owners[0]) {
+		return nil, false
+	}
+
+	var out, suspect []string
+	for _, peer := range owners[1:] {
+		switch {
+		case g.gc.peerAvailable(peer):
+			out = append(out, peer)
+		case g.gc.peerSuspect(peer) && !g.gc.health.breakerOpen(peer):
+			suspect = append(suspect, peer)
+		}
+	}
+	return append(out, suspect...), true
+}
+
+// getFromOwners gets a value from the next available owner when
+// the first one isn't, or loads it on this node if none answers,
+// instead of waiting for groupcache to give up on the first.
+// It reports false if the first owner is available
+func (g *Group) getFromOwners(ctx context.Context, key string) (*envelope, bool, error) {
+	owners, ok := g.failoverOwners(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	for _, peer := range owners {
+		e, err := g.getFromOwner(ctx, peer, key)
+
+		var pe *peerError
+		switch {
+		case err == nil:
+			return e, true, nil
+		case errors.As(err, &pe), ctx.Err() != nil:
+			// the owner answered, or we gave up
+			return nil, true, err
+		}
+	}
+
+	e, err := g.loadAround(ctx, key)
+	return e, true, err
+}
+
+// getFromNextOwners gets a value from the owners after the first
+// when this node doesn't own the key, as when groupcache failed to
+// get it from the first owner. It stops at this node, reporting
+// false if the value is to be loaded here
+func (g *Group) getFromNextOwners(ctx context.Context, key string) (*envelope, bool) {
+	if g.replication == nil || g.gc.isOwner(key) {
+		return nil, false
+	}
+
+	owners := g.gc.currentRing().Owners(key, g.replication.owners)
+	for _, peer := range owners[1:] {
+		switch {
+		case peer == g.gc.BaseURL, ctx.Err() != nil:
+			return nil, false
+		case !g.gc.peerAvailable(peer):
+			continue
+		}
+
+		if e, err := g.getFromOwner(ctx, peer, key); err == nil {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// loadAround calls the Loader bypassing the cache, once per key
+// no matter how many are asking, when no owner can be asked
+func (g *Group) loadAround(ctx context.Context, key string) (*envelope, error) {
+	v, err, _ := g.local.Do(key, func() (any, error) {
+		return g.loadLocal(ctx, key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return v.(*envelope), nil
+}
+
+func (g *Group) getFromOwner(ctx context.Context, peer, key string) (*envelope, error) {
+	if peer == g.gc.BaseURL {
+		return g.getReplica(ctx, key)
+	}
+
+	if g.gc.peerSuspect(peer) {
+		// don't wait long for a node that is probably gone
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.gc.health.suspectTimeout(peer))
+		defer cancel()
+	}
+
+	b, err := g.gc.postPeer(ctx, peer, nil, "replica", g.Name(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decodeEnvelope(b)
+	switch {
+	case err != nil:
+		return nil, err
+	case e.tag != g.tag:
+		return g.loadMismatched(ctx, key)
+	default:
+		return e, nil
+	}
+}
+
+// getReplica returns a value this node serves on behalf of
+// the first owner, loading it once if needed
+func (g *Group) getReplica(ctx context.Context, key string) (*envelope, error) {
+	r := g.replication
+	if e, ok := r.store.Get(key); ok && e.IsFresh(time.Now()) {
+		return e, nil
+	}
+
+	v, err, _ := r.flight.Do(key, func() (any, error) {
+		e, err := g.loadLocal(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		r.store.Add(key, e)
+		return e, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return v.(*envelope), nil
+}
+
+// serveReplica returns a value on behalf of the first owner
+// of its key
+func (gc *GossipCache) serveReplica(rw http.ResponseWriter, req *http.Request) {
+	g := gc.LoaderGroup(req.PathValue("group"))
+	if g == nil || g.replication == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, req.Body)
+
+	e, err := g.getReplica(req.Context(), req.PathValue("key"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = rw.Write(e.Bytes())
+}
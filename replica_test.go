@@ -0,0 +1,132 @@
+package gossipcache
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNode is a GossipCache serving its PeerHandler,
+// with a Group counting the calls to its Loader
+type testNode struct {
+	srv   *httptest.Server
+	gc    *GossipCache
+	g     *Group
+	calls atomic.Int32
+	// gate, if set, holds the Loader until closed
+	gate chan struct{}
+}
+
+// newTestNodes creates n nodes peering with each other, with a
+// Group of the given name on each
+func newTestNodes(t *testing.T, n int, name string, options ...GroupOption) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, n)
+	peers := make([]string, n)
+	for i := range nodes {
+		node := &testNode{gc: &GossipCache{}}
+		node.srv = newTestPeerServer(t, node.gc)
+		node.g = newTestGroup(t, node.gc, name,
+			func(_ context.Context, key string) (Entry, error) {
+				node.calls.Add(1)
+				if node.gate != nil {
+					<-node.gate
+				}
+				return Entry{Value: []byte(key)}, nil
+			}, options...)
+
+		nodes[i] = node
+		peers[i] = node.gc.BaseURL
+	}
+
+	for _, node := range nodes {
+		node.gc.setPeers(peers)
+	}
+	return nodes
+}
+
+// linkTestNodes has the testCacheGroup of each node ask the one of
+// the owner of a key, as groupcache does, instead of loading it
+func linkTestNodes(nodes []*testNode) {
+	for _, node := range nodes {
+		tg := node.g.g.(*testCacheGroup)
+		tg.owner = func(key string) *testCacheGroup {
+			owner := findNode(nodes, node.gc.currentRing().Owner(key))
+			if owner == nil || owner == node {
+				return nil
+			}
+			return owner.g.g.(*testCacheGroup)
+		}
+	}
+}
+
+// findNode returns the node with the given CacheBaseURL
+func findNode(nodes []*testNode, peer string) *testNode {
+	for _, node := range nodes {
+		if node.gc.BaseURL == peer {
+			return node
+		}
+	}
+	return nil
+}
+
+// findKey returns a key the given node doesn't own
+// in any of the first n places
+func findKey(t *testing.T, node *testNode, n int) string {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		// spread over the ring
+		key := fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i))))
+		owners := node.gc.currentRing().Owners(key, n)
+		if !slices.Contains(owners, node.gc.BaseURL) {
+			return key
+		}
+	}
+
+	t.Fatal("no key found")
+	return ""
+}
+
+// TestFailoverKilledOwner kills the first owner of a key and checks
+// the value is fetched from the second instead of loaded by the node
+// asking
+func TestFailoverKilledOwner(t *testing.T) {
+	nodes := newTestNodes(t, 3, "failover", WithOwners(2, 1<<20))
+	asking := nodes[0]
+	key := findKey(t, asking, 2)
+
+	owners := asking.gc.currentRing().Owners(key, 2)
+	first, second := findNode(nodes, owners[0]), findNode(nodes, owners[1])
+
+	// kill the first owner, groupcache gives up on it
+	// and has the asking node load the key
+	first.srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		if v, err := asking.g.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if string(v) != key {
+			t.Fatalf("unexpected value %q", v)
+		}
+	}
+
+	switch {
+	case asking.calls.Load() != 0:
+		t.Fatal("the asking node loaded the key")
+	case second.calls.Load() != 1:
+		t.Fatalf("expected the second owner to load it once, got %v", second.calls.Load())
+	case first.calls.Load() != 0:
+		t.Fatal("the killed owner loaded the key")
+	}
+}
@@ -0,0 +1,81 @@
+package gossipcache
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// ring mirrors the consistent hash groupcache uses to choose
+// the owner of a key, so we can tell who owns what before and
+// after a membership change
+type ring struct {
+	hashes []int
+	owners map[int]string
+}
+
+func newRing(replicas int, peers ...string) *ring {
+	r := &ring{
+		owners: make(map[int]string, replicas*len(peers)),
+	}
+
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			sum := md5.Sum([]byte(strconv.Itoa(i) + peer))
+			hash := ringHash(fmt.Sprintf("%x", sum))
+			r.hashes = append(r.hashes, hash)
+			r.owners[hash] = peer
+		}
+	}
+
+	sort.Ints(r.hashes)
+	return r
+}
+
+func ringHash(s string) int {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(s))
+	return int(h.Sum64())
+}
+
+// IsEmpty tells if the ring has no peers
+func (r *ring) IsEmpty() bool {
+	return r == nil || len(r.hashes) == 0
+}
+
+// Owner returns the peer owning a key
+func (r *ring) Owner(key string) string {
+	if r.IsEmpty() {
+		return ""
+	}
+
+	hash := ringHash(key)
+	i := sort.SearchInts(r.hashes, hash)
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Owners returns up to n distinct peers for a key, the
+// owner first followed by the next ones on the ring
+func (r *ring) Owners(key string, n int) []string {
+	if r.IsEmpty() || n < 1 {
+		return nil
+	}
+
+	hash := ringHash(key)
+	i := sort.SearchInts(r.hashes, hash)
+
+	out := make([]string, 0, n)
+	for j := 0; j < len(r.hashes) && len(out) < n; j++ {
+		peer := r.owners[r.hashes[(i+j)%len(r.hashes)]]
+		if !slices.Contains(out, peer) {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
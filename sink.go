@@ -0,0 +1,60 @@
+package gossipcache
+
+import (
+	"fmt"
+	"time"
+
+	"darvaza.org/cache"
+)
+
+var (
+	_ cache.Sink = (*bytesSink)(nil)
+)
+
+// bytesSink is a cache.Sink keeping a copy of the bytes
+// it's given
+type bytesSink struct {
+	b []byte
+	e time.Time
+}
+
+// SetBytes stores a copy of the value and its expiration time
+func (s *bytesSink) SetBytes(v []byte, e time.Time) error {
+	s.b = append(s.b[:0], v...)
+	s.e = e
+	return nil
+}
+
+// SetString stores the string value and its expiration time
+func (s *bytesSink) SetString(v string, e time.Time) error {
+	s.b = append(s.b[:0], v...)
+	s.e = e
+	return nil
+}
+
+// SetValue stores []byte and string values
+func (s *bytesSink) SetValue(v any, e time.Time) error {
+	switch x := v.(type) {
+	case []byte:
+		return s.SetBytes(x, e)
+	case string:
+		return s.SetString(x, e)
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// Bytes returns the stored value
+func (s *bytesSink) Bytes() []byte { return s.b }
+
+// Len returns the length of the stored value
+func (s *bytesSink) Len() int { return len(s.b) }
+
+// Expire returns the expiration time of the stored value
+func (s *bytesSink) Expire() time.Time { return s.e }
+
+// Reset forgets the stored value
+func (s *bytesSink) Reset() {
+	s.b = s.b[:0]
+	s.e = time.Time{}
+}
@@ -0,0 +1,44 @@
+package gossipcache
+
+import "hash/maphash"
+
+// countMinSketch estimates how many times each key was seen
+// using a fixed amount of memory. Estimates never fall short
+// but may exceed the real count when keys collide
+type countMinSketch struct {
+	seeds []maphash.Seed
+	rows  [][]uint32
+}
+
+func (s *countMinSketch) init(width, depth int) {
+	s.seeds = make([]maphash.Seed, depth)
+	s.rows = make([][]uint32, depth)
+	for i := range s.rows {
+		s.seeds[i] = maphash.MakeSeed()
+		s.rows[i] = make([]uint32, width)
+	}
+}
+
+// Add counts a key and returns its estimated count
+func (s *countMinSketch) Add(key string) uint32 {
+	var n uint32
+
+	for i, row := range s.rows {
+		j := maphash.String(s.seeds[i], key) % uint64(len(row))
+		if row[j] < ^uint32(0) {
+			row[j]++
+		}
+
+		if i == 0 || row[j] < n {
+			n = row[j]
+		}
+	}
+	return n
+}
+
+// Reset forgets all counts
+func (s *countMinSketch) Reset() {
+	for _, row := range s.rows {
+		clear(row)
+	}
+}
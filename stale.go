@@ -0,0 +1,215 @@
+package gossipcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// DefaultRevalidateTimeout is how long a background refresh can
+// take when WithStaleWhileRevalidate isn't given one
+const DefaultRevalidateTimeout = 10 * time.Second
+
+// Info describes a value returned by a Group
+type Info struct {
+	// Stale indicates the value is past its TTL
+	Stale bool
+	// Fresh is when the value stops being fresh, zero if never
+	Fresh time.Time
+	// Expire is when the cluster stops serving the value,
+	// zero if never
+	Expire time.Time
+	// Err is the error that prevented getting a fresh value,
+	// when a stale one is served instead
+	Err error
+}
+
+func (e *envelope) Info(now time.Time) Info {
+	return Info{
+		Stale:  !e.IsFresh(now),
+		Fresh:  e.fresh,
+		Expire: e.expire,
+	}
+}
+
+// WithStaleWhileRevalidate creates a GroupOption to serve values
+// within their stale window while a single background refresh,
+// taking up to the given timeout, replaces them
+func WithStaleWhileRevalidate(timeout time.Duration) GroupOption {
+	return func(g *Group) error {
+		if timeout <= 0 {
+			timeout = DefaultRevalidateTimeout
+		}
+
+		g.revalidate = timeout
+		return nil
+	}
+}
+
+// WithServeStaleOnError creates a GroupOption to keep a copy of the
+// last values this node got, up to maxBytes, and serve them when
+// getting a fresh one fails, as long as they are no more than
+// maxStale past their TTL
+func WithServeStaleOnError(maxStale time.Duration, maxBytes int64) GroupOption {
+	return func(g *Group) error {
+		if maxStale <= 0 || maxBytes <= 0 {
+			return core.Wrap(core.ErrInvalid, "serve stale")
+		}
+
+		g.maxStale = maxStale
+		g.lastKnown = new(lruCache)
+		g.lastKnown.init(maxBytes)
+		return nil
+	}
+}
+
+// GetWithInfo returns the value of a key and details about it,
+// loading it if needed. Depending on the options of the Group,
+// stale values may be served
+func (g *Group) GetWithInfo(ctx context.Context, key string) ([]byte, Info, error) {
+	now := time.Now()
+
+	if g.gc.isOwner(key) {
+		g.recordHot(key)
+	} else if e, ok := g.hotCopy(key, now); ok {
+		return e.result(now)
+	}
+
+	e, err := g.get(ctx, key)
+	switch {
+	case err != nil:
+		return g.serveStale(key, now, err)
+	case e.IsFresh(now):
+		// fresh
+	case g.revalidate > 0 && !e.IsExpired(now):
+		// stale while revalidate
+		g.startRefresh(key)
+	default:
+		e, err = g.refresh(ctx, key)
+		if err != nil {
+			return g.serveStale(key, now, err)
+		}
+	}
+
+	g.remember(key, e)
+	g.trackOwned(key, e)
+	return e.result(now)
+}
+
+// result returns the value of the envelope, or ErrNotFound
+func (e *envelope) result(now time.Time) ([]byte, Info, error) {
+	if e.notFound {
+		return nil, e.Info(now), ErrNotFound
+	}
+	return e.value, e.Info(now), nil
+}
+
+// startRefresh refreshes a value in the background, unless
+// it's already being refreshed
+func (g *Group) startRefresh(key string) {
+	_ = g.flight.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), g.revalidate)
+		defer cancel()
+
+		return g.doRefresh(ctx, key)
+	})
+}
+
+// refreshAtOwner asks the owner of a key for a fresh value,
+// reporting false if this node owns it or the owner can't
+// give it
+func (g *Group) refreshAtOwner(ctx context.Context, key string) (*envelope, bool) {
+	r := g.gc.currentRing()
+	if r.IsEmpty() {
+		return nil, false
+	}
+
+	owner := r.Owner(key)
+	if owner == g.gc.BaseURL || !g.gc.peerAvailable(owner) {
+		return nil, false
+	}
+
+	b, err := g.gc.postPeer(ctx, owner, nil, "refresh", g.Name(), key)
+	if err != nil {
+		return nil, false
+	}
+
+	e, err := decodeEnvelope(b)
+	if err != nil || e.tag != g.tag {
+		return nil, false
+	}
+	return e, true
+}
+
+// refreshOwned returns a fresh value of a key this node owns,
+// loading it again only if the one cached isn't, once per key
+// no matter how many nodes are asking
+func (g *Group) refreshOwned(ctx context.Context, key string) (*envelope, error) {
+	if e, err := g.get(ctx, key); err == nil && e.IsFresh(time.Now()) {
+		return e, nil
+	}
+
+	// never asked around, so nodes disagreeing on the
+	// owner don't bounce the request
+	v, err, _ := g.flight.Do(key, func() (any, error) {
+		return g.reload(ctx, key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return v.(*envelope), nil
+}
+
+// serveRefresh returns a fresh value of a key this node owns
+// to a node that found it stale
+func (gc *GossipCache) serveRefresh(rw http.ResponseWriter, req *http.Request) {
+	g := gc.LoaderGroup(req.PathValue("group"))
+	if g == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, req.Body)
+
+	e, err := g.refreshOwned(req.Context(), req.PathValue("key"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = rw.Write(e.Bytes())
+}
+
+// remember keeps a copy of a value to serve if
+// getting it fails later
+func (g *Group) remember(key string, e *envelope) {
+	if g.lastKnown != nil {
+		g.lastKnown.Add(key, e)
+	}
+}
+
+// serveStale returns the last known value of a key when getting
+// a fresh one failed, if it isn't too old
+func (g *Group) serveStale(key string, now time.Time, err error) ([]byte, Info, error) {
+	if g.lastKnown != nil {
+		e, ok := g.lastKnown.Get(key)
+		switch {
+		case !ok:
+			// unknown
+		case e.fresh.IsZero(), now.Before(e.fresh.Add(g.maxStale)):
+			v, info, err2 := e.result(now)
+			info.Err = err
+			return v, info, err2
+		default:
+			// too old
+			g.lastKnown.Remove(key)
+		}
+	}
+
+	return nil, Info{}, err
+}
@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"darvaza.org/core"
+)
+
+const (
+	// SystemdListenFDsStart is the first file descriptor passed by
+	// systemd socket activation
+	SystemdListenFDsStart = 3
+
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// NewFromSystemd creates a new Transport using the sockets passed by
+// systemd socket activation. If names are given, only sockets with
+// those FileDescriptorName are used.
+// If succeeds, the created transport needs to be explicitly Close()ed
+// once it's no longer used
+func NewFromSystemd(config *Config, names ...string) (*Transport, error) {
+	lsn, err := SystemdListeners(true, names...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWithListenersOrClose(config, lsn)
+}
+
+// NewFromFiles creates a new Transport using inherited sockets.
+// The given files are closed, as the Transport uses duplicates.
+// If succeeds, the created transport needs to be explicitly Close()ed
+// once it's no longer used
+func NewFromFiles(config *Config, files ...*os.File) (*Transport, error) {
+	lsn, err := ListenersFromFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWithListenersOrClose(config, lsn)
+}
+
+func newWithListenersOrClose(config *Config, lsn *Listeners) (*Transport, error) {
+	t, err := NewWithListeners(config, lsn)
+	if err != nil {
+		_ = lsn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// SystemdListeners builds Listeners out of the sockets passed by systemd
+// socket activation. If names are given, only sockets with those
+// FileDescriptorName are used and the rest are left untouched, open
+// and not owned by any *os.File.
+// unsetEnv tells if the LISTEN_* environment variables should be removed
+// so child processes don't inherit them
+func SystemdListeners(unsetEnv bool, names ...string) (*Listeners, error) {
+	fds, fdNames, err := systemdFDs(unsetEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(fds))
+	for i, fd := range fds {
+		if len(names) == 0 || core.SliceContains(names, fdNames[i]) {
+			files = append(files, os.NewFile(fd, fdNames[i]))
+		}
+	}
+
+	return ListenersFromFiles(files...)
+}
+
+// SystemdFiles returns the files passed by systemd socket activation,
+// named after LISTEN_FDNAMES when available. The returned files own
+// the descriptors, and close them when garbage collected.
+// unsetEnv tells if the LISTEN_* environment variables should be removed
+// so child processes don't inherit them
+func SystemdFiles(unsetEnv bool) ([]*os.File, error) {
+	fds, names, err := systemdFDs(unsetEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(fds))
+	for i, fd := range fds {
+		files = append(files, os.NewFile(fd, names[i]))
+	}
+	return files, nil
+}
+
+// systemdFDs returns the file descriptors passed by systemd socket
+// activation, and their names
+func systemdFDs(unsetEnv bool) ([]uintptr, []string, error) {
+	if unsetEnv {
+		defer func() {
+			_ = os.Unsetenv(envListenPID)
+			_ = os.Unsetenv(envListenFDs)
+			_ = os.Unsetenv(envListenFDNames)
+		}()
+	}
+
+	n, err := systemdListenFDs()
+	if err != nil || n == 0 {
+		return nil, nil, err
+	}
+
+	given := strings.Split(os.Getenv(envListenFDNames), ":")
+	fds := make([]uintptr, 0, n)
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		fd := SystemdListenFDsStart + i
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(given) && given[i] != "" {
+			name = given[i]
+		}
+
+		fds = append(fds, uintptr(fd))
+		names = append(names, name)
+	}
+
+	return fds, names, nil
+}
+
+// systemdListenFDs returns the number of file descriptors passed to
+// this process by systemd
+func systemdListenFDs() (int, error) {
+	s := os.Getenv(envListenPID)
+	if s == "" {
+		// not activated
+		return 0, nil
+	}
+
+	pid, err := strconv.Atoi(s)
+	switch {
+	case err != nil:
+		return 0, core.Wrapf(err, "%s: invalid", envListenPID)
+	case pid != os.Getpid():
+		// not for us
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	switch {
+	case err != nil:
+		return 0, core.Wrapf(err, "%s: invalid", envListenFDs)
+	case n < 0:
+		return 0, fmt.Errorf("%s: invalid: %v", envListenFDs, n)
+	default:
+		return n, nil
+	}
+}
+
+// ListenersFromFDs builds Listeners out of inherited file descriptors.
+// The given descriptors are closed, as the Listeners use duplicates
+func ListenersFromFDs(fds ...uintptr) (*Listeners, error) {
+	files := make([]*os.File, 0, len(fds))
+	for _, fd := range fds {
+		name := "fd" + strconv.FormatUint(uint64(fd), 10)
+		files = append(files, os.NewFile(fd, name))
+	}
+
+	return ListenersFromFiles(files...)
+}
+
+// ListenersFromFiles builds Listeners out of inherited sockets, and
+// validates TCP listeners and UDP sockets pair by address and port.
+// The given files are closed, as the Listeners use duplicates
+func ListenersFromFiles(files ...*os.File) (*Listeners, error) {
+	lsn := &Listeners{}
+
+	for _, f := range files {
+		err := lsn.appendFile(f)
+		_ = f.Close()
+
+		if err != nil {
+			_ = lsn.Close()
+			return nil, err
+		}
+	}
+
+	if _, _, err := lsn.Validate(); err != nil {
+		_ = lsn.Close()
+		return nil, err
+	}
+
+	return lsn, nil
+}
+
+// appendFile converts an inherited socket into a TCP listener
+// or UDP socket
+func (lsn *Listeners) appendFile(f *os.File) error {
+	if f == nil {
+		return core.Wrap(core.ErrInvalid, "nil file")
+	}
+
+	if ln, err := net.FileListener(f); err == nil {
+		if tcpLn, ok := ln.(*net.TCPListener); ok {
+			lsn.TCP = append(lsn.TCP, tcpLn)
+			return nil
+		}
+
+		_ = ln.Close()
+		return fmt.Errorf("%s: unsupported listener %s", f.Name(), ln.Addr().Network())
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return core.Wrapf(err, "%s: not a socket", f.Name())
+	}
+
+	if udpLn, ok := pc.(*net.UDPConn); ok {
+		lsn.UDP = append(lsn.UDP, udpLn)
+		return nil
+	}
+
+	_ = pc.Close()
+	return fmt.Errorf("%s: unsupported socket %s", f.Name(), pc.LocalAddr().Network())
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package transport
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const envActivationChild = "GOSSIPCACHE_TEST_ACTIVATION_CHILD"
+
+// TestSystemdListeners passes a TCP listener, a UDP socket and an
+// unrelated socket to a child process the way systemd does
+func TestSystemdListeners(t *testing.T) {
+	if os.Getenv(envActivationChild) != "" {
+		runActivationChild(t)
+		return
+	}
+
+	tcpLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+
+	port := tcpLn.Addr().(*net.TCPAddr).Port
+	udpLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skip("UDP port taken:", err)
+	}
+	defer udpLn.Close()
+
+	otherLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherLn.Close()
+
+	var files []*os.File
+	for _, c := range []interface{ File() (*os.File, error) }{tcpLn, udpLn, otherLn} {
+		f, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$", "-test.v")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envActivationChild+"="+strconv.Itoa(port),
+		envListenFDs+"=3",
+		envListenFDNames+"=gossip-tcp:gossip-udp:other",
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+func runActivationChild(t *testing.T) {
+	port, _ := strconv.Atoi(os.Getenv(envActivationChild))
+	// systemd sets LISTEN_PID after forking
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+
+	lsn, err := SystemdListeners(true, "gossip-tcp", "gossip-udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsn.Close()
+
+	addrs, p, err := lsn.Validate()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case p != port, len(addrs) != 1:
+		t.Fatalf("unexpected listeners: %v %v", addrs, p)
+	case os.Getenv(envListenFDs) != "":
+		t.Fatal("LISTEN_FDS not removed")
+	}
+
+	// the unselected socket must remain open
+	runtime.GC()
+	runtime.GC()
+
+	fd := SystemdListenFDsStart + 2
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil {
+		t.Fatalf("fd %v closed: %v", fd, err)
+	}
+}
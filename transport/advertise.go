@@ -0,0 +1,281 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+
+	"darvaza.org/core"
+)
+
+var (
+	// ErrNoAdvertiseAddr indicates the AdvertisePolicy found no suitable
+	// address
+	ErrNoAdvertiseAddr = errors.New("no suitable address to advertise")
+)
+
+// AddressFamily indicates the preferred IP version when choosing
+// an address to advertise
+type AddressFamily int
+
+const (
+	// AnyFamily doesn't prefer IPv4 or IPv6
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 sorts IPv4 addresses first
+	PreferIPv4
+	// PreferIPv6 sorts IPv6 addresses first
+	PreferIPv6
+	// OnlyIPv4 discards IPv6 addresses
+	OnlyIPv4
+	// OnlyIPv6 discards IPv4 addresses
+	OnlyIPv6
+)
+
+// AddressScope indicates the preferred kind of address when choosing
+// an address to advertise
+type AddressScope int
+
+const (
+	// AnyScope doesn't prefer private or global addresses
+	AnyScope AddressScope = iota
+	// PreferPrivate sorts RFC1918/RFC4193 addresses first
+	PreferPrivate
+	// PreferGlobal sorts global unicast non-private addresses first
+	PreferGlobal
+)
+
+// AdvertiseCandidate is an address considered by an AdvertisePolicy
+type AdvertiseCandidate struct {
+	// Interface is the name of the interface holding the address
+	Interface string
+	// Addr is the IP address
+	Addr netip.Addr
+}
+
+// AdvertisePolicy describes how to choose the address to advertise
+// when the node listens on unspecified addresses.
+// The zero value, and nil, pick the first address of any interface
+// other than "lo". Unlike previous versions, link-local and loopback
+// addresses are left for when there is nothing else, whatever the
+// Family and Scope preferred.
+type AdvertisePolicy struct {
+	// Interfaces is an ordered list of preferred interface names.
+	// Addresses of other interfaces are considered after them
+	Interfaces []string
+	// ExcludeInterfaces is the list of interface names never to be used.
+	// If nil, "lo" is excluded
+	ExcludeInterfaces []string
+
+	// Allow restricts the candidates to addresses within these prefixes,
+	// unless empty
+	Allow []netip.Prefix
+	// Deny discards candidates within these prefixes
+	Deny []netip.Prefix
+
+	// Family indicates the preferred IP version
+	Family AddressFamily
+	// Scope indicates the preferred kind of address
+	Scope AddressScope
+
+	// Select is an optional callback to make the final choice out of
+	// the filtered and sorted candidates
+	Select func([]AdvertiseCandidate) (netip.Addr, error)
+}
+
+// ResolveAdvertiseAddr returns the given address if it's specified,
+// otherwise one chosen by the policy
+func ResolveAdvertiseAddr(addr netip.Addr, policy *AdvertisePolicy) (netip.Addr, error) {
+	if addr.IsValid() && !addr.IsUnspecified() {
+		return addr, nil
+	}
+
+	// listening all addresses, pick one
+	return policy.Pick()
+}
+
+// Pick chooses an address to advertise following the policy
+func (p *AdvertisePolicy) Pick() (netip.Addr, error) {
+	if p == nil {
+		p = &AdvertisePolicy{}
+	}
+
+	candidates, err := p.Candidates()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return p.pick(candidates)
+}
+
+// pick chooses one of the filtered and sorted candidates
+func (p *AdvertisePolicy) pick(candidates []AdvertiseCandidate) (netip.Addr, error) {
+	if fn := p.Select; fn != nil {
+		return fn(candidates)
+	}
+
+	if len(candidates) == 0 {
+		return netip.Addr{}, ErrNoAdvertiseAddr
+	}
+
+	// pick the first
+	return candidates[0].Addr, nil
+}
+
+// Candidates returns the filtered list of addresses on the host sorted
+// by preference
+func (p *AdvertisePolicy) Candidates() ([]AdvertiseCandidate, error) {
+	if p == nil {
+		p = &AdvertisePolicy{}
+	}
+
+	all, err := getAdvertiseCandidates(p.excludedInterfaces()...)
+	if err != nil {
+		return nil, err
+	}
+	return p.order(all), nil
+}
+
+// order returns the candidates passing the filters of the
+// policy, sorted by preference
+func (p *AdvertisePolicy) order(all []AdvertiseCandidate) []AdvertiseCandidate {
+	out := make([]AdvertiseCandidate, 0, len(all))
+	for _, c := range all {
+		if p.Accepts(c.Addr) {
+			out = append(out, c)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return p.less(out[i], out[j])
+	})
+	return out
+}
+
+func (p *AdvertisePolicy) excludedInterfaces() []string {
+	if p.ExcludeInterfaces == nil {
+		return []string{"lo"}
+	}
+	return p.ExcludeInterfaces
+}
+
+// Accepts tells if an address passes the filters of the policy
+func (p *AdvertisePolicy) Accepts(addr netip.Addr) bool {
+	if p == nil {
+		return addr.IsValid()
+	}
+
+	addr = addr.Unmap()
+	switch {
+	case !addr.IsValid(), addr.IsUnspecified():
+		return false
+	case p.Family == OnlyIPv4 && !addr.Is4(),
+		p.Family == OnlyIPv6 && !addr.Is6():
+		return false
+	case prefixesContain(p.Deny, addr):
+		return false
+	case len(p.Allow) > 0:
+		return prefixesContain(p.Allow, addr)
+	default:
+		return true
+	}
+}
+
+// less sorts by interface, leaving link-local and loopback
+// addresses last, then by family, then by scope
+func (p *AdvertisePolicy) less(a, b AdvertiseCandidate) bool {
+	if ia, ib := p.interfaceRank(a), p.interfaceRank(b); ia != ib {
+		return ia < ib
+	}
+
+	if la, lb := isLastResort(a.Addr), isLastResort(b.Addr); la != lb {
+		return lb
+	}
+
+	if fa, fb := p.familyRank(a.Addr), p.familyRank(b.Addr); fa != fb {
+		return fa < fb
+	}
+
+	return p.scopeRank(a.Addr) < p.scopeRank(b.Addr)
+}
+
+func (p *AdvertisePolicy) interfaceRank(c AdvertiseCandidate) int {
+	for i, name := range p.Interfaces {
+		if name == c.Interface {
+			return i
+		}
+	}
+	return len(p.Interfaces)
+}
+
+func (p *AdvertisePolicy) familyRank(addr netip.Addr) int {
+	switch {
+	case p.Family == PreferIPv4 && !addr.Is4(),
+		p.Family == PreferIPv6 && !addr.Is6():
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (p *AdvertisePolicy) scopeRank(addr netip.Addr) int {
+	switch {
+	case p.Scope == PreferPrivate && !addr.IsPrivate(),
+		p.Scope == PreferGlobal && addr.IsPrivate():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// isLastResort tells if an address is only to be
+// advertised if there is nothing else
+func isLastResort(addr netip.Addr) bool {
+	return addr.IsLinkLocalUnicast() || addr.IsLoopback()
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAdvertiseCandidates returns all addresses of all interfaces
+// except the given ones. If that produces nothing, we try again
+// including them.
+func getAdvertiseCandidates(except ...string) ([]AdvertiseCandidate, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	out := appendAdvertiseCandidates(nil, ifaces, except)
+	if len(out) == 0 && len(except) > 0 {
+		out = appendAdvertiseCandidates(nil, ifaces, nil)
+	}
+
+	return out, nil
+}
+
+func appendAdvertiseCandidates(out []AdvertiseCandidate,
+	ifaces []net.Interface, except []string) []AdvertiseCandidate {
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		if core.SliceContains(except, ifi.Name) {
+			continue
+		}
+
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if addr, ok := core.AddrFromNetIP(a); ok {
+				out = append(out, AdvertiseCandidate{
+					Interface: ifi.Name,
+					Addr:      addr.Unmap(),
+				})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+var testAdvertiseCandidates = []AdvertiseCandidate{
+	{"lo", netip.MustParseAddr("127.0.0.1")},
+	{"eth0", netip.MustParseAddr("fe80::1")},
+	{"eth0", netip.MustParseAddr("169.254.0.1")},
+	{"eth0", netip.MustParseAddr("2001:db8::1")},
+	{"eth0", netip.MustParseAddr("192.168.1.1")},
+	{"eth1", netip.MustParseAddr("fd00::1")},
+	{"eth1", netip.MustParseAddr("203.0.113.1")},
+}
+
+func TestAdvertisePolicyOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   AdvertisePolicy
+		expected []string
+	}{
+		{"default", AdvertisePolicy{}, []string{
+			"2001:db8::1", "192.168.1.1", "fd00::1", "203.0.113.1",
+			"127.0.0.1", "fe80::1", "169.254.0.1",
+		}},
+		{"prefer IPv4", AdvertisePolicy{Family: PreferIPv4}, []string{
+			"192.168.1.1", "203.0.113.1", "2001:db8::1", "fd00::1",
+			"127.0.0.1", "169.254.0.1", "fe80::1",
+		}},
+		{"prefer IPv6", AdvertisePolicy{Family: PreferIPv6}, []string{
+			"2001:db8::1", "fd00::1", "192.168.1.1", "203.0.113.1",
+			"fe80::1", "127.0.0.1", "169.254.0.1",
+		}},
+		{"only IPv4", AdvertisePolicy{Family: OnlyIPv4}, []string{
+			"192.168.1.1", "203.0.113.1", "127.0.0.1", "169.254.0.1",
+		}},
+		{"only IPv6", AdvertisePolicy{Family: OnlyIPv6}, []string{
+			"2001:db8::1", "fd00::1", "fe80::1",
+		}},
+		{"prefer private", AdvertisePolicy{Scope: PreferPrivate}, []string{
+			"192.168.1.1", "fd00::1", "2001:db8::1", "203.0.113.1",
+			"127.0.0.1", "fe80::1", "169.254.0.1",
+		}},
+		{"prefer global", AdvertisePolicy{Scope: PreferGlobal}, []string{
+			"2001:db8::1", "203.0.113.1", "192.168.1.1", "fd00::1",
+			"127.0.0.1", "fe80::1", "169.254.0.1",
+		}},
+		{"interfaces", AdvertisePolicy{Interfaces: []string{"eth1", "eth0"}}, []string{
+			"fd00::1", "203.0.113.1", "2001:db8::1", "192.168.1.1",
+			"fe80::1", "169.254.0.1", "127.0.0.1",
+		}},
+		{"allow", AdvertisePolicy{
+			Allow: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		}, []string{"192.168.1.1"}},
+		{"deny", AdvertisePolicy{
+			Family: OnlyIPv4,
+			Deny:   []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		}, []string{"203.0.113.1", "127.0.0.1", "169.254.0.1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range tc.policy.order(testAdvertiseCandidates) {
+				got = append(got, c.Addr.String())
+			}
+
+			if !slices.Equal(got, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAdvertisePolicyPick(t *testing.T) {
+	p := &AdvertisePolicy{Family: PreferIPv4}
+	candidates := p.order(testAdvertiseCandidates)
+
+	if addr, err := p.pick(candidates); err != nil || addr.String() != "192.168.1.1" {
+		t.Fatalf("unexpected pick %v: %v", addr, err)
+	}
+
+	if _, err := p.pick(nil); !errors.Is(err, ErrNoAdvertiseAddr) {
+		t.Fatalf("expected ErrNoAdvertiseAddr, got %v", err)
+	}
+
+	p.Select = func(c []AdvertiseCandidate) (netip.Addr, error) {
+		return c[len(c)-1].Addr, nil
+	}
+	if addr, _ := p.pick(candidates); addr.String() != "fe80::1" {
+		t.Fatalf("Select not used, got %v", addr)
+	}
+}
+
+// TestAdvertisePolicyCandidates checks the addresses of the host
+// pass the filters of the policy
+func TestAdvertisePolicyCandidates(t *testing.T) {
+	p := &AdvertisePolicy{Family: OnlyIPv4}
+	candidates, err := p.Candidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range candidates {
+		if !c.Addr.Is4() {
+			t.Errorf("%v passed OnlyIPv4", c.Addr)
+		}
+	}
+
+	if len(candidates) > 0 {
+		if addr, err := p.Pick(); err != nil || addr != candidates[0].Addr {
+			t.Fatalf("expected %v, got %v: %v", candidates[0].Addr, addr, err)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compression identifies the algorithm used to compress packets
+// and streams
+type Compression byte
+
+const (
+	// NoCompression disables compression of outbound traffic.
+	// Compressed inbound traffic is always accepted
+	NoCompression Compression = iota
+	// FlateCompression uses DEFLATE
+	FlateCompression
+)
+
+const (
+	// compressMagic prefixes compressed packets and compression offers
+	// on streams, followed by the Compression byte. It can't be mistaken
+	// for a memberlist message type nor for a tunnelMagic
+	compressMagic = 0xc7
+
+	// DefaultCompressMinSize is the smallest packet compressed when
+	// CompressMinSize isn't set
+	DefaultCompressMinSize = 256
+
+	// compressMaxPacketSize limits the size of decompressed packets
+	compressMaxPacketSize = 16 * udpPacketBufSize
+
+	// compressRetryInterval is how long we wait before offering
+	// compression again to a node that refused it
+	compressRetryInterval = 10 * time.Minute
+)
+
+var (
+	errCompressRefused  = errors.New("compression refused")
+	errCompressTooLarge = errors.New("decompressed packet too large")
+)
+
+// CompressionCounters describes compressed traffic in one direction
+type CompressionCounters struct {
+	// Packets is the number of compressed packets
+	Packets uint64
+	// Streams is the number of compressed streams
+	Streams uint64
+	// RawBytes is the size of the traffic before compression
+	RawBytes uint64
+	// WireBytes is the size of the traffic after compression
+	WireBytes uint64
+}
+
+// Saved returns how many bytes compression saved. Negative if it
+// made things worse
+func (c CompressionCounters) Saved() int64 {
+	return int64(c.RawBytes) - int64(c.WireBytes)
+}
+
+// CompressionStats describes the compressed traffic of a Transport
+type CompressionStats struct {
+	Sent     CompressionCounters
+	Received CompressionCounters
+}
+
+type compressionCounters struct {
+	packets   atomic.Uint64
+	streams   atomic.Uint64
+	rawBytes  atomic.Uint64
+	wireBytes atomic.Uint64
+}
+
+func (c *compressionCounters) addPacket(raw, wire int) {
+	c.packets.Add(1)
+	c.rawBytes.Add(uint64(raw))
+	c.wireBytes.Add(uint64(wire))
+}
+
+func (c *compressionCounters) export() CompressionCounters {
+	return CompressionCounters{
+		Packets:   c.packets.Load(),
+		Streams:   c.streams.Load(),
+		RawBytes:  c.rawBytes.Load(),
+		WireBytes: c.wireBytes.Load(),
+	}
+}
+
+// compressor handles the compression of a Transport's traffic
+type compressor struct {
+	algo    Compression
+	minSize int
+
+	sent     compressionCounters
+	received compressionCounters
+
+	// peers remembers which nodes support compression, and when
+	// the ones that don't refused it
+	mu      sync.Mutex
+	capable map[string]bool
+	refused map[string]time.Time
+
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *compressor) init(config *Config) {
+	c.algo = config.Compression
+	c.minSize = config.CompressMinSize
+	if c.minSize <= 0 {
+		c.minSize = DefaultCompressMinSize
+	}
+
+	c.capable = make(map[string]bool)
+	c.refused = make(map[string]time.Time)
+}
+
+// CompressionStats returns the counters of compressed traffic
+func (t *Transport) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Sent:     t.compress.sent.export(),
+		Received: t.compress.received.export(),
+	}
+}
+
+// setCapable records a node that sent us compressed traffic
+func (c *compressor) setCapable(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capable[addr] = true
+	delete(c.refused, addr)
+}
+
+// setRefused records a node that doesn't understand compression
+func (c *compressor) setRefused(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.capable, addr)
+	c.refused[addr] = time.Now()
+}
+
+// isCapable tells if a node is known to support compression
+func (c *compressor) isCapable(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.capable[addr]
+}
+
+// shouldOffer tells if compression should be offered on a stream
+// to the given node
+func (c *compressor) shouldOffer(addr string) bool {
+	if c.algo == NoCompression {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts, ok := c.refused[addr]
+	return !ok || time.Since(ts) > compressRetryInterval
+}
+
+func (c *compressor) getWriter(w io.Writer) *flate.Writer {
+	if fw, ok := c.writers.Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+
+func (c *compressor) putWriter(fw *flate.Writer) {
+	fw.Reset(io.Discard)
+	c.writers.Put(fw)
+}
+
+func (c *compressor) getReader(r io.Reader) io.ReadCloser {
+	if fr, ok := c.readers.Get().(io.ReadCloser); ok {
+		_ = fr.(flate.Resetter).Reset(r, nil)
+		return fr
+	}
+
+	return flate.NewReader(r)
+}
+
+func (c *compressor) putReader(fr io.ReadCloser) {
+	c.readers.Put(fr)
+}
+
+// compressPacket returns the compressed version of a packet if the
+// destination supports it and it's worth it, or the original otherwise
+func (c *compressor) compressPacket(b []byte, addr string) []byte {
+	if c.algo == NoCompression || len(b) < c.minSize || !c.isCapable(addr) {
+		return b
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(b))
+	buf.WriteByte(compressMagic)
+	buf.WriteByte(byte(c.algo))
+
+	fw := c.getWriter(&buf)
+	defer c.putWriter(fw)
+
+	if _, err := fw.Write(b); err != nil {
+		return b
+	}
+	if err := fw.Close(); err != nil {
+		return b
+	}
+
+	if buf.Len() >= len(b) {
+		// not worth it
+		return b
+	}
+
+	c.sent.addPacket(len(b), buf.Len())
+	return buf.Bytes()
+}
+
+// decompressPacket returns the decompressed version of a packet
+// if compressed, or the original otherwise
+func (c *compressor) decompressPacket(b []byte, from net.Addr) ([]byte, error) {
+	if len(b) < 2 || b[0] != compressMagic {
+		return b, nil
+	}
+
+	if Compression(b[1]) != FlateCompression {
+		return nil, errCompressRefused
+	}
+
+	fr := c.getReader(bytes.NewReader(b[2:]))
+	defer c.putReader(fr)
+
+	out, err := io.ReadAll(io.LimitReader(fr, compressMaxPacketSize+1))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(out) > compressMaxPacketSize:
+		return nil, errCompressTooLarge
+	}
+
+	c.received.addPacket(len(out), len(b))
+	if from != nil {
+		c.setCapable(from.String())
+	}
+	return out, nil
+}
+
+// offer proposes compression on an outbound stream and waits for
+// the other side to accept it
+func (c *compressor) offer(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	hdr := []byte{compressMagic, byte(c.algo)}
+	if _, err := conn.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	var ack [2]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// nodes that don't support compression close the stream
+		c.setRefused(addr)
+		return nil, errCompressRefused
+	}
+
+	switch {
+	case ack[0] != compressMagic:
+		c.setRefused(addr)
+		return nil, errCompressRefused
+	case Compression(ack[1]) == NoCompression:
+		// supported, but not this algorithm, so packets
+		// can't be compressed either
+		c.setRefused(addr)
+		return conn, nil
+	default:
+		c.setCapable(addr)
+		return c.newConn(conn), nil
+	}
+}
+
+// accept wraps an inbound stream to detect and answer compression
+// offers on its first read
+func (c *compressor) accept(conn net.Conn) net.Conn {
+	return &acceptCompressConn{
+		Conn: conn,
+		c:    c,
+	}
+}
+
+// newConn wraps a stream with compression in both directions
+func (c *compressor) newConn(conn net.Conn) *compressConn {
+	c.sent.streams.Add(1)
+	c.received.streams.Add(1)
+
+	cc := &compressConn{
+		Conn: conn,
+		c:    c,
+	}
+	cc.fw = c.getWriter(countingWriter{w: conn, n: &c.sent.wireBytes})
+	cc.fr = c.getReader(countingReader{r: conn, n: &c.received.wireBytes})
+	return cc
+}
+
+// compressConn is a stream compressed in both directions
+type compressConn struct {
+	net.Conn
+	c *compressor
+
+	rmu sync.Mutex
+	fr  io.ReadCloser
+
+	wmu sync.Mutex
+	fw  *flate.Writer
+
+	closed atomic.Bool
+}
+
+func (cc *compressConn) Read(b []byte) (int, error) {
+	cc.rmu.Lock()
+	defer cc.rmu.Unlock()
+
+	if cc.fr == nil {
+		return 0, net.ErrClosed
+	}
+
+	n, err := cc.fr.Read(b)
+	cc.c.received.rawBytes.Add(uint64(n))
+	return n, err
+}
+
+func (cc *compressConn) Write(b []byte) (int, error) {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	if cc.fw == nil {
+		return 0, net.ErrClosed
+	}
+
+	n, err := cc.fw.Write(b)
+	if err == nil {
+		// memberlist expects what it writes to be sent
+		err = cc.fw.Flush()
+	}
+	cc.c.sent.rawBytes.Add(uint64(n))
+	return n, err
+}
+
+func (cc *compressConn) Close() error {
+	if !cc.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+
+	err := cc.Conn.Close()
+
+	cc.wmu.Lock()
+	if cc.fw != nil {
+		cc.c.putWriter(cc.fw)
+		cc.fw = nil
+	}
+	cc.wmu.Unlock()
+
+	cc.rmu.Lock()
+	if cc.fr != nil {
+		cc.c.putReader(cc.fr)
+		cc.fr = nil
+	}
+	cc.rmu.Unlock()
+
+	return err
+}
+
+// acceptCompressConn is an inbound stream that may start with
+// a compression offer
+type acceptCompressConn struct {
+	net.Conn
+	c *compressor
+
+	once sync.Once
+	err  error
+	// r is used to read once the offer was handled
+	r io.Reader
+	// cc is set if compression was accepted
+	cc atomic.Pointer[compressConn]
+}
+
+func (ac *acceptCompressConn) init() {
+	var first [1]byte
+
+	n, err := io.ReadFull(ac.Conn, first[:])
+	switch {
+	case err != nil:
+		ac.err = err
+	case first[0] != compressMagic:
+		// plain stream, put the byte back
+		ac.r = io.MultiReader(bytes.NewReader(first[:n]), ac.Conn)
+	default:
+		ac.err = ac.answer()
+	}
+}
+
+// answer responds to a compression offer
+func (ac *acceptCompressConn) answer() error {
+	var algo [1]byte
+	if _, err := io.ReadFull(ac.Conn, algo[:]); err != nil {
+		return err
+	}
+
+	if Compression(algo[0]) != FlateCompression {
+		// decline, continue uncompressed
+		ac.r = ac.Conn
+		_, err := ac.Conn.Write([]byte{compressMagic, byte(NoCompression)})
+		return err
+	}
+
+	if _, err := ac.Conn.Write([]byte{compressMagic, algo[0]}); err != nil {
+		return err
+	}
+
+	cc := ac.c.newConn(ac.Conn)
+	ac.cc.Store(cc)
+	ac.r = cc
+	return nil
+}
+
+func (ac *acceptCompressConn) Read(b []byte) (int, error) {
+	ac.once.Do(ac.init)
+	if ac.err != nil {
+		return 0, ac.err
+	}
+	return ac.r.Read(b)
+}
+
+func (ac *acceptCompressConn) Write(b []byte) (int, error) {
+	ac.once.Do(ac.init)
+	if ac.err != nil {
+		return 0, ac.err
+	}
+
+	if cc := ac.cc.Load(); cc != nil {
+		return cc.Write(b)
+	}
+	return ac.Conn.Write(b)
+}
+
+func (ac *acceptCompressConn) Close() error {
+	err := ac.Conn.Close()
+	if cc := ac.cc.Load(); cc != nil {
+		_ = cc.Close()
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (cr countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n.Add(uint64(n))
+	return n, err
+}
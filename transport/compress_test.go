@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// TestCompressOfferDeclined checks a node declining the algorithm
+// doesn't get compressed packets
+func TestCompressOfferDeclined(t *testing.T) {
+	var c compressor
+	c.init(&Config{Compression: FlateCompression})
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		var hdr [2]byte
+		if _, err := io.ReadFull(remote, hdr[:]); err == nil {
+			_, _ = remote.Write([]byte{compressMagic, byte(NoCompression)})
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const addr = "192.0.2.1:7946"
+	conn, err := c.offer(ctx, local, addr)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case conn != local:
+		t.Fatal("declined stream compressed")
+	case c.isCapable(addr):
+		t.Fatal("node declining compression recorded as capable")
+	case c.shouldOffer(addr):
+		t.Fatal("compression offered again right away")
+	}
+
+	b := bytes.Repeat([]byte("gossip"), 1024)
+	if out := c.compressPacket(b, addr); !bytes.Equal(out, b) {
+		t.Fatal("packet compressed for a node declining compression")
+	}
+}
+
+// TestCompressTunnelAcceptor checks a compressing node reaches
+// one accepting tunnels, both with plain streams and tunnels
+func TestCompressTunnelAcceptor(t *testing.T) {
+	relay, relayAddr := newTestTransport(t, &Config{
+		AcceptTunnels: true,
+		TunnelSecret:  testTunnelSecret,
+		Compression:   FlateCompression,
+	})
+
+	go func() {
+		for conn := range relay.StreamCh() {
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	other, otherAddr := newTestTransport(t, &Config{
+		Relays:       []string{relayAddr},
+		TunnelSecret: testTunnelSecret,
+		Compression:  FlateCompression,
+	})
+
+	conn, err := other.DialAddressTimeout(memberlist.Address{Addr: relayAddr}, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn, "ping")
+	if !other.compress.isCapable(relayAddr) {
+		t.Fatal("compression not accepted")
+	}
+
+	// well within tunnelHelloTimeout
+	waitTunnelClient(t, relay, otherAddr)
+}
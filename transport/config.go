@@ -2,7 +2,10 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"net/netip"
+	"time"
 
 	"darvaza.org/core"
 	"darvaza.org/slog"
@@ -28,14 +31,83 @@ type Config struct {
 	BindPortStrict bool
 	// BindPortRetry indicates how many times we will try finding a port
 	BindPortRetry int
+	// BindReusePort indicates how many TCP and UDP sockets to open on
+	// each address using SO_REUSEPORT, so the kernel spreads inbound
+	// gossip between several readers. Zero or one disables it.
+	// The port is checked to be free before binding it, but another
+	// process of the same user setting SO_REUSEPORT could still
+	// bind it afterwards
+	BindReusePort int
+
+	// AdvertisePolicy describes how to choose the address to advertise
+	// when listening on unspecified addresses
+	AdvertisePolicy *AdvertisePolicy
 
 	// ListenTCP is the helper to use to listen on a TCP port
 	ListenTCP func(network string, laddr *net.TCPAddr) (*net.TCPListener, error)
 	// ListenUDP is the helper to use to listen on a UDP port
 	ListenUDP func(network string, laddr *net.UDPAddr) (*net.UDPConn, error)
 
-	// OnError is called when a worker returns an error, before initiating
-	// a shutdown
+	// DialContext is the optional helper to use to establish outbound
+	// TCP streams. If nil DialTCP will be used
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// DialTCP is the helper to use to establish outbound TCP streams
+	// when DialContext isn't provided
+	DialTCP func(ctx context.Context, network string, laddr, raddr *net.TCPAddr) (*net.TCPConn, error)
+	// DialFromBindAddress tells DialTCP to use the address we are bound to
+	// as source of outbound streams, when not bound to unspecified addresses
+	DialFromBindAddress bool
+	// Proxy is an optional socks5:// or http:// URL of a proxy to route
+	// outbound streams through
+	Proxy string
+
+	// Routes is the initial name-to-route table used to reach
+	// particular nodes
+	Routes map[string]Route
+	// ResolveRoute is an optional callback to find the Route to nodes
+	// not on the table
+	ResolveRoute RouteResolver
+	// StreamTLS is an optional TLS configuration to protect TCP streams,
+	// used as server on inbound streams and as client on outbound
+	StreamTLS *tls.Config
+
+	// Relays is the list of host:port of nodes to keep tunnels to, so
+	// packets and streams can reach this node when inbound traffic is
+	// blocked
+	Relays []string
+	// AcceptTunnels allows other nodes to tunnel their traffic through
+	// this one
+	AcceptTunnels bool
+	// TunnelSecret authenticates the nodes establishing tunnels. It
+	// must be the same on all nodes, and is required to dial or
+	// accept tunnels
+	TunnelSecret []byte
+
+	// Compression is the algorithm used to compress outbound streams,
+	// and packets to nodes known to support it. Compressed inbound
+	// traffic is always accepted
+	Compression Compression
+	// CompressMinSize is the size of the smallest packet to compress.
+	// If zero DefaultCompressMinSize is used
+	CompressMinSize int
+
+	// WatchInterfaces is the interval to check for address changes on
+	// the host, to follow the addresses of BindInterface and to choose
+	// a new address to advertise when the current disappears.
+	// Zero disables it
+	WatchInterfaces time.Duration
+	// OnAdvertiseChange is called when the address to advertise
+	// changes. Memberlist keeps announcing the address the node
+	// joined with, so the new one has to reach the other nodes by
+	// other means, like the node metadata, and be used as their
+	// Route to this node
+	OnAdvertiseChange func(netip.AddrPort)
+
+	// Restart describes how listening workers that fail are restarted.
+	// By default any failure shuts the Transport down
+	Restart RestartPolicy
+	// OnError is called when a worker fails and can't be restarted,
+	// before initiating a shutdown
 	OnError func(error)
 
 	// Context
@@ -65,14 +137,13 @@ func (cfg *Config) SetDefaults() error {
 		cfg.BindPortRetry = DefaultBindRetry
 	}
 
-	// Callbacks
-	if cfg.ListenTCP == nil {
-		cfg.ListenTCP = net.ListenTCP
+	// Tunnels
+	if cfg.AcceptTunnels && len(cfg.TunnelSecret) == 0 {
+		return core.Wrap(core.ErrInvalid, "AcceptTunnels without TunnelSecret")
 	}
 
-	if cfg.ListenUDP == nil {
-		cfg.ListenUDP = net.ListenUDP
-	}
+	// Callbacks
+	cfg.setListenDefaults()
 
 	// Context
 	if cfg.Context == nil {
@@ -87,6 +158,22 @@ func (cfg *Config) SetDefaults() error {
 	return nil
 }
 
+func (cfg *Config) setListenDefaults() {
+	reusePort := cfg.BindReusePort > 1
+
+	if cfg.ListenTCP == nil {
+		cfg.ListenTCP = core.IIf(reusePort, ListenTCPReusePort, net.ListenTCP)
+	}
+
+	if cfg.ListenUDP == nil {
+		cfg.ListenUDP = core.IIf(reusePort, ListenUDPReusePort, net.ListenUDP)
+	}
+
+	if cfg.DialTCP == nil {
+		cfg.DialTCP = dialTCP
+	}
+}
+
 func (cfg *Config) getStringIPAddresses() ([]string, error) {
 	if len(cfg.BindInterface) > 0 {
 		// All addresses of given interfaces
@@ -0,0 +1,209 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"darvaza.org/core"
+	"golang.org/x/net/proxy"
+)
+
+// DialContextFunc is the signature of the helpers used to establish
+// outbound connections
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext makes DialContextFunc satisfy proxy.ContextDialer
+func (fn DialContextFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return fn(ctx, network, addr)
+}
+
+// Dial makes DialContextFunc satisfy proxy.Dialer
+func (fn DialContextFunc) Dial(network, addr string) (net.Conn, error) {
+	return fn(context.Background(), network, addr)
+}
+
+// dialTCP is the default DialTCP helper
+func dialTCP(ctx context.Context, network string, laddr, raddr *net.TCPAddr) (*net.TCPConn, error) {
+	d := net.Dialer{}
+	if laddr != nil {
+		d.LocalAddr = laddr
+	}
+
+	conn, err := d.DialContext(ctx, network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.TCPConn), nil
+}
+
+// newDialer assembles the helper used by the Transport to establish
+// outbound streams
+func (t *Transport) newDialer(config *Config) (DialContextFunc, error) {
+	dial := DialContextFunc(config.DialContext)
+	if dial == nil {
+		dial = t.dialDirect(config)
+	}
+
+	if config.Proxy == "" {
+		return dial, nil
+	}
+
+	u, err := url.Parse(config.Proxy)
+	if err != nil {
+		return nil, core.Wrap(err, "Proxy")
+	}
+
+	return newProxyDialer(u, dial)
+}
+
+// dialDirect returns a DialContextFunc that uses the DialTCP helper,
+// optionally binding the source address to the one we listen on
+func (t *Transport) dialDirect(config *Config) DialContextFunc {
+	dialTCP := config.DialTCP
+	bindSource := config.DialFromBindAddress
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		raddr, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var laddr *net.TCPAddr
+		if bindSource {
+			laddr = t.sourceAddr(raddr)
+		}
+
+		conn, err := dialTCP(ctx, network, laddr, raddr)
+		if err != nil {
+			// don't return a typed nil
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// sourceAddr finds a bound address of the same family as the remote,
+// and nil if there is none or we are bound to unspecified addresses
+func (t *Transport) sourceAddr(raddr *net.TCPAddr) *net.TCPAddr {
+	is4 := raddr.IP.To4() != nil
+
+	tcpListeners, _ := t.listeners()
+	for _, ln := range tcpListeners {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		switch {
+		case !ok, addr.IP.IsUnspecified(), addr.IP.IsLoopback() != raddr.IP.IsLoopback():
+			continue
+		case (addr.IP.To4() != nil) == is4:
+			return &net.TCPAddr{IP: addr.IP, Zone: addr.Zone}
+		}
+	}
+	return nil
+}
+
+// newProxyDialer wraps a DialContextFunc to route connections
+// through a SOCKS5 or HTTP CONNECT proxy
+func newProxyDialer(u *url.URL, forward DialContextFunc) (DialContextFunc, error) {
+	switch u.Scheme {
+	case "http":
+		return newHTTPConnectDialer(u, forward), nil
+	default:
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, err
+		}
+
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext, nil
+		}
+
+		return func(_ context.Context, network, addr string) (net.Conn, error) {
+			return d.Dial(network, addr)
+		}, nil
+	}
+}
+
+// newHTTPConnectDialer returns a DialContextFunc that tunnels connections
+// through an HTTP proxy using the CONNECT method
+func newHTTPConnectDialer(u *url.URL, forward DialContextFunc) DialContextFunc {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	var auth string
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		s := u.User.Username() + ":" + pass
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err = httpConnect(ctx, conn, addr, auth)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// httpConnect asks an HTTP proxy to tunnel conn to addr
+func httpConnect(ctx context.Context, conn net.Conn, addr, auth string) (net.Conn, error) {
+	defer context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// the tunnel already carries data
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,205 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newEchoServer starts a TCP server echoing back whatever it receives
+func newEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go serveConns(ln, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	return ln.Addr().String()
+}
+
+// newProxyStandIn starts a proxy stand-in that reports the
+// address each client asks for and connects them to it
+func newProxyStandIn(t *testing.T, handshake func(net.Conn) (string, error)) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	targets := make(chan string, 8)
+	go serveConns(ln, func(conn net.Conn) {
+		addr, err := handshake(conn)
+		if err != nil {
+			return
+		}
+		targets <- addr
+
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	})
+	return ln.Addr().String(), targets
+}
+
+func serveConns(ln net.Listener, fn func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			fn(conn)
+		}()
+	}
+}
+
+func httpConnectHandshake(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+
+	if user, pass, _ := parseProxyAuth(req); req.Method != http.MethodConnect ||
+		user != "user" || pass != "secret" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", io.EOF
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, err
+}
+
+func parseProxyAuth(req *http.Request) (string, string, bool) {
+	req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+	return req.BasicAuth()
+}
+
+// socks5Handshake handles a SOCKS5 CONNECT without authentication
+// to an IPv4 address
+func socks5Handshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 262)
+
+	// greeting, [ver][n][methods...]
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	// request, [ver][cmd][rsv][atyp=1][ip4][port]
+	if _, err := io.ReadFull(conn, buf[:10]); err != nil {
+		return "", err
+	} else if buf[1] != 1 || buf[3] != 1 {
+		return "", io.EOF
+	}
+
+	ip := net.IP(buf[4:8])
+	port := binary.BigEndian.Uint16(buf[8:10])
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+func TestDialProxy(t *testing.T) {
+	target := newEchoServer(t)
+
+	for _, tc := range []struct {
+		name      string
+		scheme    string
+		handshake func(net.Conn) (string, error)
+	}{
+		{"http", "http://user:secret@", httpConnectHandshake},
+		{"socks5", "socks5://", socks5Handshake},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyAddr, targets := newProxyStandIn(t, tc.handshake)
+
+			var direct int
+			tr := &Transport{}
+			dial, err := tr.newDialer(&Config{
+				Proxy: tc.scheme + proxyAddr,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					direct++
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := dial(ctx, "tcp", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			assertEcho(t, conn, "ping")
+
+			switch {
+			case direct != 1:
+				t.Errorf("expected DialContext to reach the proxy once, got %v", direct)
+			case <-targets != target:
+				t.Error("proxy asked for the wrong address")
+			}
+		})
+	}
+}
+
+func TestDialProxyRejected(t *testing.T) {
+	proxyAddr, _ := newProxyStandIn(t, httpConnectHandshake)
+
+	tr := &Transport{}
+	dial, err := tr.newDialer(&Config{
+		Proxy:   "http://" + proxyAddr,
+		DialTCP: dialTCP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn, err := dial(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		_ = conn.Close()
+		t.Fatal("unauthenticated CONNECT accepted")
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn, s string) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, s); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(s))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != s {
+		t.Fatalf("expected %q, got %q", s, buf)
+	}
+}
@@ -0,0 +1,375 @@
+// Package faults provides a memberlist.Transport decorator that injects
+// faults for chaos and integration testing
+package faults
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"github.com/hashicorp/memberlist"
+)
+
+var (
+	_ memberlist.Transport          = (*Transport)(nil)
+	_ memberlist.NodeAwareTransport = (*Transport)(nil)
+)
+
+var (
+	// ErrInjected is returned by dials failed on purpose
+	ErrInjected = errors.New("injected fault")
+	// ErrPartitioned is returned by dials to partitioned addresses
+	ErrPartitioned = errors.New("partitioned")
+)
+
+// reorderMaxHold is how long a held packet waits for another
+// one to overtake it
+const reorderMaxHold = 100 * time.Millisecond
+
+// Transport wraps a memberlist.Transport injecting faults as described
+// by its Rules, which can be changed at any time
+type Transport struct {
+	wg     core.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   memberlist.Transport
+
+	mu    sync.RWMutex
+	rules Rules
+	self  atomic.Value
+
+	held   *heldPacket
+	heldMu sync.Mutex
+
+	streamCh chan net.Conn
+	packetCh chan *memberlist.Packet
+}
+
+type heldPacket struct {
+	b     []byte
+	addr  memberlist.Address
+	timer *time.Timer
+}
+
+// New wraps a memberlist.Transport. Shutting down the returned
+// Transport shuts down the wrapped one too
+func New(next memberlist.Transport) *Transport {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t := &Transport{
+		ctx:      ctx,
+		cancel:   cancel,
+		next:     next,
+		streamCh: make(chan net.Conn),
+		packetCh: make(chan *memberlist.Packet),
+	}
+
+	t.wg.Go(t.packetLoop)
+	t.wg.Go(t.streamLoop)
+	return t
+}
+
+// Unwrap returns the wrapped memberlist.Transport
+func (t *Transport) Unwrap() memberlist.Transport {
+	return t.next
+}
+
+// Rules returns the current Rules
+func (t *Transport) Rules() Rules {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.rules
+}
+
+// SetRules replaces the current Rules
+func (t *Transport) SetRules(rules Rules) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules = rules
+}
+
+// Reset stops injecting faults
+func (t *Transport) Reset() {
+	t.SetRules(Rules{})
+}
+
+// Partition blocks traffic between the given sets of addresses
+func (t *Transport) Partition(sets ...[]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules.Partitions = sets
+}
+
+// Heal removes all partitions
+func (t *Transport) Heal() {
+	t.Partition()
+}
+
+// getSelf returns the address we advertise, if known
+func (t *Transport) getSelf() string {
+	s, _ := t.self.Load().(string)
+	return s
+}
+
+// partitioned tells if we can't talk to the given address
+func (t *Transport) partitioned(rules *Rules, addr string) bool {
+	return rules.Partitioned(t.getSelf(), addr)
+}
+
+// FinalAdvertiseAddr calls the wrapped transport, remembering the result
+// to apply partitions
+func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	addr, port, err := t.next.FinalAdvertiseAddr(ip, port)
+	if err == nil {
+		t.self.Store(net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+	}
+	return addr, port, err
+}
+
+// WriteToAddress sends a packet through the wrapped transport,
+// unless the Rules decide otherwise
+func (t *Transport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	rules := t.Rules()
+	now := time.Now()
+
+	switch {
+	case t.partitioned(&rules, addr.Addr), chance(rules.Drop):
+		// lost
+		return now, nil
+	}
+
+	b = append([]byte(nil), b...)
+	if chance(rules.Corrupt) && len(b) > 0 {
+		b[rand.IntN(len(b))] ^= byte(1 + rand.IntN(255))
+	}
+
+	copies := 1
+	if chance(rules.Duplicate) {
+		copies = 2
+	}
+
+	if chance(rules.Reorder) && t.hold(b, addr) {
+		return now, nil
+	}
+
+	if delay := randDelay(rules.Delay, rules.Jitter); delay > 0 {
+		time.AfterFunc(delay, func() {
+			t.send(b, addr, copies)
+		})
+		return now, nil
+	}
+
+	return now, t.send(b, addr, copies)
+}
+
+// send writes a packet through the wrapped transport, releasing
+// any held packet afterwards
+func (t *Transport) send(b []byte, addr memberlist.Address, copies int) error {
+	var err error
+	for i := 0; i < copies && err == nil; i++ {
+		err = t.writeNext(b, addr)
+	}
+
+	if held := t.release(); held != nil {
+		_ = t.writeNext(held.b, held.addr)
+	}
+	return err
+}
+
+// hold keeps a packet to be sent after the next, unless there is
+// one held already
+func (t *Transport) hold(b []byte, addr memberlist.Address) bool {
+	t.heldMu.Lock()
+	defer t.heldMu.Unlock()
+
+	if t.held != nil {
+		return false
+	}
+
+	p := &heldPacket{b: b, addr: addr}
+	p.timer = time.AfterFunc(reorderMaxHold, func() {
+		t.heldMu.Lock()
+		ok := t.held == p
+		if ok {
+			t.held = nil
+		}
+		t.heldMu.Unlock()
+
+		if ok {
+			_ = t.writeNext(p.b, p.addr)
+		}
+	})
+	t.held = p
+	return true
+}
+
+// release returns the held packet, if any
+func (t *Transport) release() *heldPacket {
+	t.heldMu.Lock()
+	defer t.heldMu.Unlock()
+
+	p := t.held
+	if p != nil {
+		p.timer.Stop()
+		t.held = nil
+	}
+	return p
+}
+
+func (t *Transport) writeNext(b []byte, addr memberlist.Address) error {
+	var err error
+	if nt, ok := t.next.(memberlist.NodeAwareTransport); ok {
+		_, err = nt.WriteToAddress(b, addr)
+	} else {
+		_, err = t.next.WriteTo(b, addr.Addr)
+	}
+	return err
+}
+
+// WriteTo sends a packet to the given address
+func (t *Transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+// DialAddressTimeout establishes a stream through the wrapped
+// transport, unless the Rules decide otherwise
+func (t *Transport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (
+	net.Conn, error) {
+	rules := t.Rules()
+
+	switch {
+	case t.partitioned(&rules, addr.Addr):
+		return nil, ErrPartitioned
+	case chance(rules.DialFailure):
+		return nil, ErrInjected
+	}
+
+	if delay := time.Duration(rules.DialDelay); delay > 0 {
+		if delay >= timeout {
+			if err := t.wait(timeout); err != nil {
+				return nil, err
+			}
+			return nil, context.DeadlineExceeded
+		}
+
+		if err := t.wait(delay); err != nil {
+			return nil, err
+		}
+		timeout -= delay
+	}
+
+	if nt, ok := t.next.(memberlist.NodeAwareTransport); ok {
+		return nt.DialAddressTimeout(addr, timeout)
+	}
+	return t.next.DialTimeout(addr.Addr, timeout)
+}
+
+// wait sleeps for the given duration, unless the Transport
+// is shut down first
+func (t *Transport) wait(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+// DialTimeout establishes a stream to the given address
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+// PacketCh returns the packets received by the wrapped transport
+// that aren't blocked by partitions
+func (t *Transport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// StreamCh returns the streams accepted by the wrapped transport
+// that aren't blocked by partitions
+func (t *Transport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown stops the workers and shuts down the wrapped transport
+func (t *Transport) Shutdown() error {
+	// wake pending dials first
+	t.cancel()
+	err := t.next.Shutdown()
+	_ = t.wg.Wait()
+
+	if p := t.release(); p != nil {
+		p.timer.Stop()
+	}
+	return err
+}
+
+func (t *Transport) packetLoop() error {
+	in := t.next.PacketCh()
+	for {
+		select {
+		case p := <-in:
+			rules := t.Rules()
+			if p.From != nil && t.partitioned(&rules, p.From.String()) {
+				continue
+			}
+
+			select {
+			case t.packetCh <- p:
+			case <-t.ctx.Done():
+				return nil
+			}
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *Transport) streamLoop() error {
+	in := t.next.StreamCh()
+	for {
+		select {
+		case conn := <-in:
+			rules := t.Rules()
+			if addr := conn.RemoteAddr(); addr != nil && t.partitioned(&rules, addr.String()) {
+				_ = conn.Close()
+				continue
+			}
+
+			select {
+			case t.streamCh <- conn:
+			case <-t.ctx.Done():
+				_ = conn.Close()
+				return nil
+			}
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// chance returns true with the given probability
+func chance(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+func randDelay(delay, jitter Duration) time.Duration {
+	d := time.Duration(delay)
+	if jitter > 0 {
+		d += rand.N(time.Duration(jitter))
+	}
+	return d
+}
@@ -0,0 +1,265 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	testSelf  = "192.0.2.1:7946"
+	testOther = "192.0.2.2:7946"
+	testThird = "192.0.2.3:7946"
+)
+
+var _ memberlist.Transport = (*mockTransport)(nil)
+
+// mockTransport is a memberlist.Transport recording the packets
+// and dials it's asked for
+type mockTransport struct {
+	written  chan string
+	dials    chan string
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+}
+
+func newMockTransport() *mockTransport {
+	return &mockTransport{
+		written:  make(chan string, 16),
+		dials:    make(chan string, 16),
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+	}
+}
+
+func (*mockTransport) FinalAdvertiseAddr(string, int) (net.IP, int, error) {
+	ap, _ := net.ResolveTCPAddr("tcp", testSelf)
+	return ap.IP, ap.Port, nil
+}
+
+func (m *mockTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	m.written <- addr + " " + string(b)
+	return time.Now(), nil
+}
+
+func (m *mockTransport) DialTimeout(addr string, _ time.Duration) (net.Conn, error) {
+	m.dials <- addr
+	a, b := net.Pipe()
+	_ = b.Close()
+	return a, nil
+}
+
+func (m *mockTransport) PacketCh() <-chan *memberlist.Packet { return m.packetCh }
+func (m *mockTransport) StreamCh() <-chan net.Conn           { return m.streamCh }
+func (*mockTransport) Shutdown() error                       { return nil }
+
+func newTestTransport(t *testing.T) (*Transport, *mockTransport) {
+	t.Helper()
+
+	next := newMockTransport()
+	tr := New(next)
+	t.Cleanup(func() { _ = tr.Shutdown() })
+
+	if _, _, err := tr.FinalAdvertiseAddr("", 0); err != nil {
+		t.Fatal(err)
+	}
+	return tr, next
+}
+
+// expectWritten waits for a packet to reach the wrapped transport
+func expectWritten(t *testing.T, next *mockTransport, expected string, timeout time.Duration) bool {
+	t.Helper()
+
+	select {
+	case s := <-next.written:
+		if s != expected {
+			t.Fatalf("expected %q, got %q", expected, s)
+		}
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// expectPacket waits for an inbound packet to pass through
+func expectPacket(t *testing.T, tr *Transport, from string, timeout time.Duration) bool {
+	t.Helper()
+
+	select {
+	case p := <-tr.PacketCh():
+		if s := p.From.String(); s != from {
+			t.Fatalf("expected packet from %q, got %q", from, s)
+		}
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func inbound(t *testing.T, next *mockTransport, from string) {
+	t.Helper()
+
+	addr, err := net.ResolveUDPAddr("udp", from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.packetCh <- &memberlist.Packet{Buf: []byte("in"), From: addr}
+}
+
+func TestDrop(t *testing.T) {
+	tr, next := newTestTransport(t)
+
+	tr.SetRules(Rules{Drop: 1})
+	for i := 0; i < 10; i++ {
+		if _, err := tr.WriteTo([]byte("lost"), testOther); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expectWritten(t, next, "", 100*time.Millisecond) {
+		t.Fatal("packet not dropped")
+	}
+
+	tr.Reset()
+	if _, err := tr.WriteTo([]byte("sent"), testOther); err != nil {
+		t.Fatal(err)
+	}
+	if !expectWritten(t, next, testOther+" sent", time.Second) {
+		t.Fatal("packet dropped after Reset")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	tr, next := newTestTransport(t)
+
+	const delay = 200 * time.Millisecond
+	tr.SetRules(Rules{Delay: Duration(delay)})
+
+	start := time.Now()
+	if _, err := tr.WriteTo([]byte("late"), testOther); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= delay {
+		t.Fatal("write held the caller")
+	}
+
+	if !expectWritten(t, next, testOther+" late", 5*time.Second) {
+		t.Fatal("delayed packet lost")
+	}
+	if d := time.Since(start); d < delay {
+		t.Fatalf("packet sent after %v, expected %v", d, delay)
+	}
+}
+
+func TestDialDelay(t *testing.T) {
+	tr, next := newTestTransport(t)
+
+	const delay = 200 * time.Millisecond
+	tr.SetRules(Rules{DialDelay: Duration(delay)})
+
+	// within the timeout
+	start := time.Now()
+	conn, err := tr.DialTimeout(testOther, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	if d := time.Since(start); d < delay {
+		t.Fatalf("dialled after %v, expected %v", d, delay)
+	}
+	if s := <-next.dials; s != testOther {
+		t.Fatalf("dialled %q", s)
+	}
+
+	// past it
+	_, err = tr.DialTimeout(testOther, delay/2)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// TestDialDelayShutdown checks Shutdown interrupts delayed dials
+func TestDialDelayShutdown(t *testing.T) {
+	tr, next := newTestTransport(t)
+	tr.SetRules(Rules{DialDelay: Duration(time.Hour)})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.DialTimeout(testOther, 2*time.Hour)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := tr.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't interrupt the dial")
+	}
+
+	if len(next.dials) > 0 {
+		t.Fatal("dialled after Shutdown")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tr, next := newTestTransport(t)
+
+	// by address, and by host
+	tr.Partition([]string{testSelf}, []string{"192.0.2.2"})
+
+	// outbound
+	if _, err := tr.WriteTo([]byte("lost"), testOther); err != nil {
+		t.Fatal(err)
+	}
+	if expectWritten(t, next, "", 100*time.Millisecond) {
+		t.Fatal("packet crossed the partition")
+	}
+
+	if _, err := tr.DialTimeout(testOther, time.Second); !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("expected %v, got %v", ErrPartitioned, err)
+	}
+
+	// inbound
+	inbound(t, next, testOther)
+	if expectPacket(t, tr, testOther, 100*time.Millisecond) {
+		t.Fatal("inbound packet crossed the partition")
+	}
+
+	// not listed
+	if _, err := tr.WriteTo([]byte("sent"), testThird); err != nil {
+		t.Fatal(err)
+	}
+	if !expectWritten(t, next, testThird+" sent", time.Second) {
+		t.Fatal("packet to an address not partitioned lost")
+	}
+
+	inbound(t, next, testThird)
+	if !expectPacket(t, tr, testThird, time.Second) {
+		t.Fatal("packet from an address not partitioned lost")
+	}
+
+	// healed
+	tr.Heal()
+	if _, err := tr.WriteTo([]byte("healed"), testOther); err != nil {
+		t.Fatal(err)
+	}
+	if !expectWritten(t, next, testOther+" healed", time.Second) {
+		t.Fatal("packet lost after Heal")
+	}
+
+	inbound(t, next, testOther)
+	if !expectPacket(t, tr, testOther, time.Second) {
+		t.Fatal("inbound packet lost after Heal")
+	}
+}
@@ -0,0 +1,40 @@
+package faults
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+var _ http.Handler = (*Transport)(nil)
+
+// ServeHTTP allows changing the Rules at runtime. GET returns the
+// current Rules as JSON, PUT or POST replace them, and DELETE
+// stops injecting faults
+func (t *Transport) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		// show
+	case http.MethodPut, http.MethodPost:
+		var rules Rules
+
+		dec := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rules); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t.SetRules(rules)
+	case http.MethodDelete:
+		t.Reset()
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := t.Rules()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(&rules)
+}
@@ -0,0 +1,98 @@
+package faults
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// Rules describes the faults to inject. Probabilities go from
+// 0 (never) to 1 (always)
+type Rules struct {
+	// Drop is the probability of an outbound packet being lost
+	Drop float64 `json:"drop,omitempty"`
+	// Duplicate is the probability of an outbound packet being
+	// sent twice
+	Duplicate float64 `json:"duplicate,omitempty"`
+	// Corrupt is the probability of a byte of an outbound packet
+	// being altered
+	Corrupt float64 `json:"corrupt,omitempty"`
+	// Reorder is the probability of an outbound packet being held
+	// until the next one is sent
+	Reorder float64 `json:"reorder,omitempty"`
+	// Delay is how long outbound packets are held before being sent
+	Delay Duration `json:"delay,omitempty"`
+	// Jitter is the maximum random time added to Delay
+	Jitter Duration `json:"jitter,omitempty"`
+
+	// DialFailure is the probability of an outbound stream failing
+	// to be established
+	DialFailure float64 `json:"dial_failure,omitempty"`
+	// DialDelay is how long establishing an outbound stream takes
+	DialDelay Duration `json:"dial_delay,omitempty"`
+
+	// Partitions are sets of addresses that can't talk with addresses
+	// on other sets, in either direction. Addresses are given as
+	// host:port, or host alone to match any port. Addresses not
+	// listed are unaffected.
+	// Inbound streams can only be matched by their source address,
+	// so partitions are better given to every node of the cluster
+	Partitions [][]string `json:"partitions,omitempty"`
+}
+
+// partition returns the index of the set containing the address,
+// or -1 if not partitioned
+func (r *Rules) partition(addr string) int {
+	if addr == "" {
+		return -1
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	for i, set := range r.Partitions {
+		if core.SliceContains(set, addr) || core.SliceContains(set, host) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Partitioned tells if traffic between the two addresses is blocked
+func (r *Rules) Partitioned(a, b string) bool {
+	i, j := r.partition(a), r.partition(b)
+	return i >= 0 && j >= 0 && i != j
+}
+
+// Duration is a time.Duration represented as a string on JSON
+type Duration time.Duration
+
+// MarshalJSON encodes the Duration as a string like "1.5s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a Duration from a string like "1.5s", or
+// a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
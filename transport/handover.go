@@ -0,0 +1,279 @@
+//go:build unix
+
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"darvaza.org/core"
+)
+
+const (
+	handoverMagic = "GCHO\x01"
+	handoverAckOK = 0
+)
+
+var (
+	errBadHandover = errors.New("invalid handover message")
+)
+
+// Handover passes the listening sockets of the Transport to another
+// process connecting to the Unix socket at path via NewFromHandover, and
+// once it confirms the new Transport is running, stops reading from them
+// and shuts this Transport down. The sockets remain bound, owned by the
+// new process, so peers never see the gossip port closed.
+// If the handover fails the Transport continues running.
+func (t *Transport) Handover(ctx context.Context, path string) error {
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	conn, err := acceptHandover(ctx, ln)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	defer context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})()
+
+	if err := t.sendHandover(conn); err != nil {
+		return err
+	}
+
+	if err := readHandoverAck(conn); err != nil {
+		return core.Wrap(err, "handover rejected")
+	}
+
+	t.debug().
+		WithField(ListenerAddrLabel, path).
+		Print("Listeners handed over")
+
+	t.release()
+	<-t.done
+
+	// the new process has its own copies
+	t.closeListeners()
+	return nil
+}
+
+func acceptHandover(ctx context.Context, ln *net.UnixListener) (*net.UnixConn, error) {
+	defer context.AfterFunc(ctx, func() {
+		_ = ln.SetDeadline(time.Now())
+	})()
+
+	conn, err := ln.AcceptUnix()
+	if err != nil && ctx.Err() != nil {
+		// cancelled
+		err = ctx.Err()
+	}
+	return conn, err
+}
+
+// sendHandover sends duplicates of the listening sockets without
+// altering their blocking mode
+func (t *Transport) sendHandover(conn *net.UnixConn) error {
+	tcpListeners, udpListeners := t.listeners()
+
+	fds := make([]int, 0, len(tcpListeners)+len(udpListeners))
+	defer func() {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+	}()
+
+	conns := make([]syscall.Conn, 0, cap(fds))
+	for _, ln := range tcpListeners {
+		conns = append(conns, ln)
+	}
+	for _, ln := range udpListeners {
+		conns = append(conns, ln)
+	}
+
+	for _, c := range conns {
+		fd, err := dupConn(c)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+
+	msg := make([]byte, len(handoverMagic)+2)
+	copy(msg, handoverMagic)
+	binary.BigEndian.PutUint16(msg[len(handoverMagic):], uint16(len(fds)))
+
+	_, _, err := conn.WriteMsgUnix(msg, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+func dupConn(c syscall.Conn) (int, error) {
+	var fd int
+	var err error
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	err2 := rc.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+		if err == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+
+	return fd, core.CoalesceError(err2, err)
+}
+
+// release stops the workers without closing the sockets first, so
+// another process can continue using them. Tunnels can't be
+// handed over, so they are closed
+func (t *Transport) release() {
+	if t.stop() {
+		// stop workers
+		t.cancel()
+		t.relays.closeAll()
+
+		// and wake them up
+		now := time.Now()
+		tcpListeners, udpListeners := t.listeners()
+		for i := range tcpListeners {
+			_ = tcpListeners[i].SetDeadline(now)
+		}
+
+		for i := range udpListeners {
+			_ = udpListeners[i].SetReadDeadline(now)
+		}
+	}
+}
+
+// NewFromHandover creates a new Transport using the listening sockets
+// passed by another process's Transport.Handover() through the Unix
+// socket at path.
+// If succeeds, the created transport needs to be explicitly Close()ed
+// once it's no longer used
+func NewFromHandover(ctx context.Context, config *Config, path string) (*Transport, error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	defer context.AfterFunc(ctx, func() {
+		_ = c.SetDeadline(time.Now())
+	})()
+
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, core.ErrInvalid
+	}
+
+	t, err := startFromHandover(conn, config)
+	if err != nil {
+		_ = writeHandoverAck(conn, err)
+		return nil, err
+	}
+
+	if err := writeHandoverAck(conn, nil); err != nil {
+		// the old process will keep them
+		_ = t.Shutdown()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func startFromHandover(conn *net.UnixConn, config *Config) (*Transport, error) {
+	lsn, err := receiveHandover(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWithListenersOrClose(config, lsn)
+}
+
+func receiveHandover(conn *net.UnixConn) (*Listeners, error) {
+	buf := make([]byte, len(handoverMagic)+2)
+	oob := make([]byte, syscall.CmsgSpace(4*256))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := parseHandoverRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	if n != len(buf) || string(buf[:len(handoverMagic)]) != handoverMagic ||
+		int(binary.BigEndian.Uint16(buf[len(handoverMagic):])) != len(files) {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, errBadHandover
+	}
+
+	return ListenersFromFiles(files...)
+}
+
+func parseHandoverRights(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			name := fmt.Sprintf("handover[%v]", len(files))
+			files = append(files, os.NewFile(uintptr(fd), name))
+		}
+	}
+
+	return files, nil
+}
+
+func writeHandoverAck(conn *net.UnixConn, err error) error {
+	if err == nil {
+		_, err = conn.Write([]byte{handoverAckOK})
+		return err
+	}
+
+	msg := append([]byte{handoverAckOK + 1}, err.Error()...)
+	_, err = conn.Write(msg)
+	return err
+}
+
+func readHandoverAck(conn *net.UnixConn) error {
+	buf, err := io.ReadAll(io.LimitReader(conn, 1024))
+	switch {
+	case err != nil:
+		return err
+	case len(buf) == 0:
+		return io.ErrUnexpectedEOF
+	case buf[0] != handoverAckOK:
+		return errors.New(string(buf[1:]))
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package transport
+
+import (
+	"context"
+	"errors"
+)
+
+// Handover passes the listening sockets of the Transport to another
+// process. Not supported on this platform
+func (*Transport) Handover(context.Context, string) error {
+	return errors.ErrUnsupported
+}
+
+// NewFromHandover creates a new Transport using the listening sockets
+// passed by another process. Not supported on this platform
+func NewFromHandover(context.Context, *Config, string) (*Transport, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,151 @@
+//go:build unix
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const envHandoverChild = "GOSSIPCACHE_TEST_HANDOVER_CHILD"
+
+// TestHandover hands the listeners of a Transport over to a child
+// process, which must then answer packets sent to the same port
+func TestHandover(t *testing.T) {
+	if path := os.Getenv(envHandoverChild); path != "" {
+		runHandoverChild(t, path)
+		return
+	}
+
+	relay, relayAddr := newTestTransport(t, &Config{
+		AcceptTunnels: true,
+		TunnelSecret:  testTunnelSecret,
+	})
+
+	old, err := New(&Config{
+		BindAddress:  []string{"127.0.0.1"},
+		BindPort:     0,
+		Relays:       []string{relayAddr},
+		TunnelSecret: testTunnelSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Shutdown()
+
+	ip, port, err := old.FinalAdvertiseAddr("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldAddr := (&net.TCPAddr{IP: ip, Port: port}).String()
+	waitTunnelClient(t, relay, oldAddr)
+
+	path := filepath.Join(t.TempDir(), "handover.sock")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handedOver := make(chan error, 1)
+	go func() {
+		handedOver <- old.Handover(ctx, path)
+	}()
+
+	// wait for the handover socket
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		} else if ctx.Err() != nil {
+			t.Fatal(ctx.Err())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHandover$", "-test.v")
+	cmd.Env = append(os.Environ(), envHandoverChild+"="+path)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	if err := <-handedOver; err != nil {
+		t.Fatal("handover:", err)
+	}
+
+	// the old process closed its copies, and its tunnels
+	tcpListeners, udpListeners := old.listeners()
+	if err := tcpListeners[0].SetDeadline(time.Now()); !errors.Is(err, net.ErrClosed) {
+		t.Error("TCP listener left open:", err)
+	}
+	if err := udpListeners[0].SetDeadline(time.Now()); !errors.Is(err, net.ErrClosed) {
+		t.Error("UDP listener left open:", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for relay.relays.getClient(oldAddr) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel left open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the old process no longer reads, the new one answers
+	// on the same port
+	probe, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	if _, err := probe.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = probe.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := probe.Read(buf)
+	if err != nil {
+		logs := make([]byte, 4096)
+		m, _ := out.Read(logs)
+		t.Fatalf("no answer from the new process: %v\n%s", err, logs[:m])
+	}
+
+	if s := string(buf[:n]); s != "hello" {
+		t.Fatalf("unexpected answer %q", s)
+	}
+}
+
+// runHandoverChild takes the listeners over and echoes
+// the first packet received
+func runHandoverChild(t *testing.T, path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tr, err := NewFromHandover(ctx, nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Shutdown()
+
+	select {
+	case msg := <-tr.PacketCh():
+		if _, err := tr.WriteTo(msg.Buf, msg.From.String()); err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
@@ -20,10 +20,11 @@ type Listeners struct {
 }
 
 // Validate checks if the listeners are suitable, and returns
-// the addresses and port used
+// the addresses and port used. Several sockets can share an address
+// when using SO_REUSEPORT, but every address needs at least one
+// TCP listener and one UDP socket
 func (lsn *Listeners) Validate() ([]string, int, error) {
-	if lsn == nil || len(lsn.TCP) == 0 || len(lsn.UDP) == 0 ||
-		len(lsn.TCP) != len(lsn.UDP) {
+	if lsn == nil || len(lsn.TCP) == 0 || len(lsn.UDP) == 0 {
 		return nil, 0, errBadSet
 	}
 
@@ -31,68 +32,78 @@ func (lsn *Listeners) Validate() ([]string, int, error) {
 }
 
 func (lsn *Listeners) doValidate() ([]string, int, error) {
-	var addrs = make([]string, 0, len(lsn.TCP))
-	var port uint16
-	var err error
+	tcp, err := addrPorts("TCP", lsn.TCP, func(ln *net.TCPListener) net.Addr {
+		return ln.Addr()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-	for i := range lsn.TCP {
-		var addr string
+	udp, err := addrPorts("UDP", lsn.UDP, func(ln *net.UDPConn) net.Addr {
+		return ln.LocalAddr()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-		addr, port, err = lsn.doValidateOne(i, port)
-		if err != nil {
-			break
-		}
+	port := tcp[0].Port()
+	if port == 0 {
+		return nil, 0, fmt.Errorf("invalid port: %s", tcp[0].String())
+	}
 
-		addrs = append(addrs, addr)
+	if err := validateGroup(tcp, udp, port); err != nil {
+		return nil, 0, err
 	}
 
-	return addrs, int(port), err
-}
+	if err := validateGroup(udp, tcp, port); err != nil {
+		return nil, 0, err
+	}
 
-func (lsn *Listeners) doValidateOne(i int, port uint16) (string, uint16, error) {
-	var tcp, udp netip.AddrPort
-	var ok bool
-	var err error
+	addrs := make([]string, 0, len(tcp))
+	for _, ap := range core.SliceUnique(tcp) {
+		addrs = append(addrs, ap.Addr().Unmap().String())
+	}
 
-	aTCP := lsn.TCP[i].Addr()
-	aUDP := lsn.UDP[i].LocalAddr()
+	return addrs, int(port), nil
+}
 
-	tcp, ok = core.AddrPort(aTCP)
-	if !ok {
-		err = core.NewUnreachableErrorf(1, core.ErrInvalid, "TCP[%v]:%v", i, aTCP)
-		goto fail
-	}
+func addrPorts[T any](name string, lns []T, getAddr func(T) net.Addr) ([]netip.AddrPort, error) {
+	out := make([]netip.AddrPort, 0, len(lns))
+	for i, ln := range lns {
+		addr := getAddr(ln)
 
-	udp, ok = core.AddrPort(aUDP)
-	if !ok {
-		err = core.NewUnreachableErrorf(1, core.ErrInvalid, "UDP[%v]:%v", i, aUDP)
-		goto fail
-	}
+		ap, ok := core.AddrPort(addr)
+		if !ok {
+			return nil, core.NewUnreachableErrorf(1, core.ErrInvalid, "%s[%v]:%v", name, i, addr)
+		}
 
-	if port == 0 {
-		port = tcp.Port()
+		out = append(out, ap)
 	}
+	return out, nil
+}
 
-	err = validatePair(tcp, udp, port)
-	if err == nil {
-		// success
-		return tcp.String(), port, nil
+// validateGroup checks all sockets use the same port and
+// every address has a counterpart
+func validateGroup(these, others []netip.AddrPort, port uint16) error {
+	for _, ap := range these {
+		switch {
+		case ap.Port() != port:
+			return core.Wrapf(errBadSet, "%s (port:%v)", ap.String(), port)
+		case !core.SliceContains(others, ap):
+			return core.Wrapf(errBadSet, "%s unpaired", ap.String())
+		}
 	}
-
-fail:
-	return "", port, err
+	return nil
 }
 
-func validatePair(tcp, udp netip.AddrPort, port uint16) error {
-	switch {
-	case port == 0:
-		return fmt.Errorf("invalid port: %s", tcp.String())
-	case tcp.Compare(udp) != 0, tcp.Port() != port:
-		return core.Wrapf(errBadSet, "tcp:%s ≠ udp:%s (port:%v)",
-			tcp.String(), udp.String(), port)
-	default:
-		return nil
+// port returns the port of the first TCP listener
+func (lsn *Listeners) port() int {
+	if len(lsn.TCP) > 0 {
+		if ap, ok := core.AddrPort(lsn.TCP[0].Addr()); ok {
+			return int(ap.Port())
+		}
 	}
+	return 0
 }
 
 // Close closes all listeners
@@ -170,63 +181,89 @@ func (lsn *Listeners) tryListen(pass int, addrs []net.IP, port int, config *Conf
 	return lsn.listen(addrs, port, config)
 }
 
-// revive:disable:cognitive-complexity
-
 // listen attempts to listen all addresses on a given port,
 // and on success the listeners are stored on the Transport
 func (lsn *Listeners) listen(addrs []net.IP, port int, config *Config) (int, error) {
-	// revive:enable:cognitive-complexity
 	var ok bool
-
-	n := len(addrs)
-	tcpListeners := make([]*net.TCPListener, 0, n)
-	udpListeners := make([]*net.UDPConn, 0, n)
+	var out Listeners
 
 	// close any success when failing once
 	defer func() {
 		if !ok {
-			for _, tcpLn := range tcpListeners {
-				_ = tcpLn.Close()
-			}
-			for _, udpLn := range udpListeners {
-				_ = udpLn.Close()
-			}
+			_ = out.Close()
 		}
 	}()
 
+	readers := max(config.BindReusePort, 1)
 	for _, ip := range addrs {
-		// TCP
-		tcpAddr := &net.TCPAddr{IP: ip, Port: port}
-		tcpLn, err := config.ListenTCP("tcp", tcpAddr)
-		if err != nil {
-			return -1, err
+		if readers > 1 && port != 0 {
+			// SO_REUSEPORT would let us share the port
+			// with whoever else is using it
+			if err := checkPortFree(ip, port); err != nil {
+				return -1, err
+			}
 		}
 
-		// appended early so they get closed on error
-		tcpListeners = append(tcpListeners, tcpLn)
+		for i := 0; i < readers; i++ {
+			var err error
 
-		if port == 0 {
-			// port was random, now we stick to it
-			port = tcpLn.Addr().(*net.TCPAddr).Port
+			port, err = out.listenOne(ip, port, config)
+			if err != nil {
+				return -1, err
+			}
 		}
+	}
 
-		// UDP
-		udpAddr := &net.UDPAddr{IP: ip, Port: port}
-		udpLn, err := config.ListenUDP("udp", udpAddr)
-		if err != nil {
-			return -1, err
-		}
+	ok = true
+	*lsn = out
+	return len(addrs), nil
+}
 
-		// appended early so they get closed on error
-		udpListeners = append(udpListeners, udpLn)
+// checkPortFree tells if the TCP and UDP port on the given address
+// can be bound without SO_REUSEPORT, closing the probes right away
+func checkPortFree(ip net.IP, port int) error {
+	tcpLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+	if err != nil {
+		return err
+	}
+	_ = tcpLn.Close()
 
-		if _, err = setUDPRecvBuffer(udpLn); err != nil {
-			return -1, err
-		}
+	udpLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return err
 	}
+	_ = udpLn.Close()
+	return nil
+}
 
-	ok = true
-	lsn.TCP = tcpListeners
-	lsn.UDP = udpListeners
-	return n, nil
+// listenOne opens a TCP listener and a UDP socket on the given address
+// and port, and returns the port used
+func (lsn *Listeners) listenOne(ip net.IP, port int, config *Config) (int, error) {
+	// TCP
+	tcpAddr := &net.TCPAddr{IP: ip, Port: port}
+	tcpLn, err := config.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return port, err
+	}
+
+	// appended early so they get closed on error
+	lsn.TCP = append(lsn.TCP, tcpLn)
+
+	if port == 0 {
+		// port was random, now we stick to it
+		port = tcpLn.Addr().(*net.TCPAddr).Port
+	}
+
+	// UDP
+	udpAddr := &net.UDPAddr{IP: ip, Port: port}
+	udpLn, err := config.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return port, err
+	}
+
+	// appended early so they get closed on error
+	lsn.UDP = append(lsn.UDP, udpLn)
+
+	_, err = setUDPRecvBuffer(udpLn)
+	return port, err
 }
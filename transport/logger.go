@@ -16,12 +16,20 @@ const (
 )
 
 func (t *Transport) debug() slog.Logger {
-	return t.log.Debug().
-		WithField(SubsystemLabel, Subsystem)
+	return debugLogger(t.log)
 }
 
 func (t *Transport) error(err error) slog.Logger {
-	l := t.log.Error().
+	return errorLogger(t.log, err)
+}
+
+func debugLogger(log slog.Logger) slog.Logger {
+	return log.Debug().
+		WithField(SubsystemLabel, Subsystem)
+}
+
+func errorLogger(log slog.Logger, err error) slog.Logger {
+	l := log.Error().
 		WithField(SubsystemLabel, Subsystem)
 
 	if err != nil {
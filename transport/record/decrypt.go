@@ -0,0 +1,138 @@
+package record
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// memberlist wire details needed to decrypt its traffic
+const (
+	encryptMsg       = 10
+	encryptVersion0  = 0
+	encryptVersion1  = 1
+	encryptNonceSize = 12
+	encryptTagSize   = 16
+	encryptHdrSize   = 5
+)
+
+var (
+	// ErrNoKey indicates none of the keys could decrypt the message
+	ErrNoKey = errors.New("no key could decrypt the message")
+)
+
+// Decrypter decrypts memberlist traffic using the keys of a Keyring
+type Decrypter struct {
+	keys [][]byte
+}
+
+// NewDecrypter creates a Decrypter using the keys of the given Keyring
+func NewDecrypter(keyring *memberlist.Keyring) *Decrypter {
+	return &Decrypter{
+		keys: keyring.GetKeys(),
+	}
+}
+
+// Packet decrypts a packet, returning its label and
+// plain content
+func (d *Decrypter) Packet(b []byte) (string, []byte, error) {
+	b, label, err := memberlist.RemoveLabelHeaderFromPacket(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plain, err := d.decrypt(b, []byte(label))
+	return label, plain, err
+}
+
+// Stream decrypts the data sent in one direction of a stream,
+// returning its label and the plain content of each of its messages.
+// Unencrypted messages end the decryption, and the rest of the data
+// is returned as-is
+func (d *Decrypter) Stream(b []byte) (string, [][]byte, error) {
+	b, label, err := memberlist.RemoveLabelHeaderFromPacket(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var out [][]byte
+	for len(b) > 0 {
+		if len(b) < encryptHdrSize || b[0] != encryptMsg {
+			// not encrypted
+			return label, append(out, b), nil
+		}
+
+		size := int(binary.BigEndian.Uint32(b[1:encryptHdrSize]))
+		if len(b) < encryptHdrSize+size {
+			return label, out, ErrBadFormat
+		}
+
+		aad := append(bytes.Clone(b[:encryptHdrSize]), label...)
+		plain, err := d.decrypt(b[encryptHdrSize:encryptHdrSize+size], aad)
+		if err != nil {
+			return label, out, err
+		}
+
+		out = append(out, plain)
+		b = b[encryptHdrSize+size:]
+	}
+
+	return label, out, nil
+}
+
+// decrypt reverses memberlist's encryptPayload
+func (d *Decrypter) decrypt(msg, aad []byte) ([]byte, error) {
+	if len(msg) < 1+encryptNonceSize+encryptTagSize {
+		return nil, ErrBadFormat
+	}
+
+	vsn := msg[0]
+	if vsn != encryptVersion0 && vsn != encryptVersion1 {
+		return nil, ErrBadFormat
+	}
+
+	nonce := msg[1 : 1+encryptNonceSize]
+	ciphertext := msg[1+encryptNonceSize:]
+
+	for _, key := range d.keys {
+		plain, err := open(key, nonce, ciphertext, aad)
+		if err != nil {
+			continue
+		}
+
+		if vsn == encryptVersion0 {
+			plain = pkcs7decode(plain)
+		}
+		return plain, nil
+	}
+
+	return nil, ErrNoKey
+}
+
+func open(key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func pkcs7decode(b []byte) []byte {
+	if n := len(b); n > 0 {
+		pad := int(b[n-1])
+		if pad <= n {
+			return b[:n-pad]
+		}
+	}
+	return b
+}
@@ -0,0 +1,279 @@
+// Package record provides a memberlist.Transport decorator that records
+// gossip traffic, and the tools to inspect and replay those recordings
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// fileMagic identifies recording files
+const fileMagic = "GCRR\x01"
+
+// maxRecordSize limits the size of peer and data fields when reading
+const maxRecordSize = 64 << 20
+
+var (
+	// ErrBadFormat indicates the file isn't a valid recording
+	ErrBadFormat = errors.New("invalid recording")
+)
+
+// Kind identifies the type of recorded event
+type Kind byte
+
+const (
+	// KindSelf records the address the node advertises
+	KindSelf Kind = iota + 1
+	// KindPacketReceived records an inbound packet
+	KindPacketReceived
+	// KindPacketSent records an outbound packet
+	KindPacketSent
+	// KindStreamAccepted records a new inbound stream
+	KindStreamAccepted
+	// KindStreamDialed records a new outbound stream
+	KindStreamDialed
+	// KindStreamReceived records data read from a stream
+	KindStreamReceived
+	// KindStreamSent records data written to a stream
+	KindStreamSent
+	// KindStreamClosed records the end of a stream
+	KindStreamClosed
+)
+
+var kindNames = map[Kind]string{
+	KindSelf:           "self",
+	KindPacketReceived: "packet-recv",
+	KindPacketSent:     "packet-sent",
+	KindStreamAccepted: "stream-accepted",
+	KindStreamDialed:   "stream-dialed",
+	KindStreamReceived: "stream-recv",
+	KindStreamSent:     "stream-sent",
+	KindStreamClosed:   "stream-closed",
+}
+
+func (k Kind) String() string {
+	if s, ok := kindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("kind-%d", byte(k))
+}
+
+func (k Kind) valid() bool {
+	return k >= KindSelf && k <= KindStreamClosed
+}
+
+func (k Kind) hasStream() bool {
+	return k >= KindStreamAccepted
+}
+
+func (k Kind) hasPeer() bool {
+	return k <= KindStreamDialed
+}
+
+func (k Kind) hasData() bool {
+	switch k {
+	case KindPacketReceived, KindPacketSent, KindStreamReceived, KindStreamSent:
+		return true
+	default:
+		return false
+	}
+}
+
+// Record is an event of the recording
+type Record struct {
+	Kind Kind
+	Time time.Time
+	// Stream identifies the stream of Stream kinds
+	Stream uint64
+	// Peer is the address of the other side of packets and streams,
+	// or our own on KindSelf
+	Peer string
+	// Data is the content of packets, or what was read or written
+	// on a stream
+	Data []byte
+}
+
+// Writer encodes Records into a recording file. The format is a
+// magic header followed by the start time, and then each record
+// as kind, time since the previous record, and the fields that
+// apply to the kind, using varints for numbers and lengths
+type Writer struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	last time.Time
+	buf  []byte
+	err  error
+}
+
+// NewWriter starts a recording on the given io.Writer
+func NewWriter(w io.Writer) (*Writer, error) {
+	rw := &Writer{
+		w:    bufio.NewWriter(w),
+		last: time.Now().Round(0),
+	}
+
+	rw.buf = append(rw.buf, fileMagic...)
+	rw.buf = binary.AppendVarint(rw.buf, rw.last.UnixNano())
+	if err := rw.flush(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Write appends a Record to the recording. Records are expected
+// in chronological order
+func (rw *Writer) Write(r *Record) error {
+	if !r.Kind.valid() {
+		return ErrBadFormat
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.err != nil {
+		return rw.err
+	}
+
+	// wall clock, as read back
+	ts := r.Time.Round(0)
+	if ts.IsZero() || ts.Before(rw.last) {
+		ts = rw.last
+	}
+
+	rw.buf = append(rw.buf[:0], byte(r.Kind))
+	rw.buf = binary.AppendUvarint(rw.buf, uint64(ts.Sub(rw.last)))
+	rw.last = ts
+
+	if r.Kind.hasStream() {
+		rw.buf = binary.AppendUvarint(rw.buf, r.Stream)
+	}
+	if r.Kind.hasPeer() {
+		rw.buf = binary.AppendUvarint(rw.buf, uint64(len(r.Peer)))
+		rw.buf = append(rw.buf, r.Peer...)
+	}
+	if r.Kind.hasData() {
+		rw.buf = binary.AppendUvarint(rw.buf, uint64(len(r.Data)))
+		rw.buf = append(rw.buf, r.Data...)
+	}
+
+	return rw.flush()
+}
+
+func (rw *Writer) flush() error {
+	_, err := rw.w.Write(rw.buf)
+	if err == nil {
+		err = rw.w.Flush()
+	}
+	rw.err = err
+	return err
+}
+
+// Reader decodes Records from a recording file
+type Reader struct {
+	r     *bufio.Reader
+	Start time.Time
+	last  time.Time
+}
+
+// NewReader validates the header of a recording and prepares
+// to read its Records
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != fileMagic {
+		return nil, ErrBadFormat
+	}
+
+	start, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+
+	rr := &Reader{
+		r:     br,
+		Start: time.Unix(0, start),
+	}
+	rr.last = rr.Start
+	return rr, nil
+}
+
+// Next returns the next Record, or io.EOF at the end of
+// the recording
+func (rr *Reader) Next() (*Record, error) {
+	kind, err := rr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{Kind: Kind(kind)}
+	if !r.Kind.valid() {
+		return nil, ErrBadFormat
+	}
+
+	delta, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	rr.last = rr.last.Add(time.Duration(delta))
+	r.Time = rr.last
+
+	if err := rr.readFields(r); err != nil {
+		return nil, unexpected(err)
+	}
+	return r, nil
+}
+
+func (rr *Reader) readFields(r *Record) error {
+	var err error
+
+	if r.Kind.hasStream() {
+		if r.Stream, err = binary.ReadUvarint(rr.r); err != nil {
+			return err
+		}
+	}
+
+	if r.Kind.hasPeer() {
+		b, err := rr.readBytes()
+		if err != nil {
+			return err
+		}
+		r.Peer = string(b)
+	}
+
+	if r.Kind.hasData() {
+		if r.Data, err = rr.readBytes(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rr *Reader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(rr.r)
+	switch {
+	case err != nil:
+		return nil, err
+	case n > maxRecordSize:
+		return nil, ErrBadFormat
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
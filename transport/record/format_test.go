@@ -0,0 +1,156 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func testRecords(start time.Time) []*Record {
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	return []*Record{
+		{Kind: KindSelf, Time: at(0), Peer: "192.0.2.1:7946"},
+		{Kind: KindPacketReceived, Time: at(time.Millisecond), Peer: "192.0.2.2:7946",
+			Data: []byte("ping")},
+		{Kind: KindPacketSent, Time: at(2 * time.Millisecond), Peer: "192.0.2.2:7946",
+			Data: []byte("ack")},
+		{Kind: KindStreamDialed, Time: at(time.Second), Stream: 1, Peer: "192.0.2.3:7946"},
+		{Kind: KindStreamSent, Time: at(time.Second), Stream: 1, Data: []byte("push")},
+		{Kind: KindStreamReceived, Time: at(2 * time.Second), Stream: 1,
+			Data: bytes.Repeat([]byte("pull"), 1024)},
+		{Kind: KindStreamClosed, Time: at(3 * time.Second), Stream: 1},
+	}
+}
+
+// writeTestRecording writes the records, returning the size of
+// the recording after each
+func writeTestRecording(t *testing.T, buf *bytes.Buffer, records []*Record) []int {
+	t.Helper()
+
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make([]int, 0, len(records))
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, buf.Len())
+	}
+	return sizes
+}
+
+func assertRecord(t *testing.T, expected, got *Record) {
+	t.Helper()
+
+	switch {
+	case got.Kind != expected.Kind:
+		t.Fatalf("expected %v, got %v", expected.Kind, got.Kind)
+	case !got.Time.Equal(expected.Time):
+		t.Fatalf("%v: expected time %v, got %v", got.Kind, expected.Time, got.Time)
+	case got.Stream != expected.Stream:
+		t.Fatalf("%v: expected stream %v, got %v", got.Kind, expected.Stream, got.Stream)
+	case got.Peer != expected.Peer:
+		t.Fatalf("%v: expected peer %q, got %q", got.Kind, expected.Peer, got.Peer)
+	case !bytes.Equal(got.Data, expected.Data):
+		t.Fatalf("%v: unexpected data", got.Kind)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	start := time.Now()
+	// the Writer takes its start time on creation
+	records := testRecords(start.Add(time.Millisecond))
+	writeTestRecording(t, &buf, records)
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Start.Before(start) {
+		t.Fatalf("recording started at %v, before %v", r.Start, start)
+	}
+
+	for _, expected := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRecord(t, expected, got)
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+// TestTruncated checks a recording cut short, as left by a process
+// killed while writing, gives its complete records first
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+
+	records := testRecords(time.Now().Add(time.Millisecond))
+	sizes := writeTestRecording(t, &buf, records)
+	last := len(records) - 1
+
+	for _, cut := range []int{
+		sizes[last-1] + 1,  // kind only
+		sizes[last-1] + 2,  // kind and time
+		sizes[last-2] + 10, // half the data
+		sizes[last] - 1,    // all but the last byte
+	} {
+		b := buf.Bytes()[:cut]
+
+		r, err := NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		for {
+			_, err = r.Next()
+			if err != nil {
+				break
+			}
+			n++
+		}
+
+		switch {
+		case !errors.Is(err, io.ErrUnexpectedEOF):
+			t.Fatalf("cut at %v: expected io.ErrUnexpectedEOF, got %v", cut, err)
+		case cut < sizes[n-1] || cut >= sizes[n]:
+			t.Fatalf("cut at %v: %v complete records read", cut, n)
+		}
+	}
+}
+
+func TestBadFormat(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("GCRR"))); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("expected ErrBadFormat, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&Record{Kind: 0}); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("expected ErrBadFormat, got %v", err)
+	}
+
+	buf.WriteByte(0xff)
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("expected ErrBadFormat, got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package record
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"github.com/hashicorp/memberlist"
+)
+
+var (
+	_ memberlist.Transport          = (*Transport)(nil)
+	_ memberlist.NodeAwareTransport = (*Transport)(nil)
+)
+
+// Transport wraps a memberlist.Transport recording every packet
+// and stream passing through it
+type Transport struct {
+	wg     core.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   memberlist.Transport
+	w      *Writer
+
+	nextID atomic.Uint64
+	err    atomic.Pointer[error]
+
+	streamCh chan net.Conn
+	packetCh chan *memberlist.Packet
+}
+
+// New wraps a memberlist.Transport recording its traffic into
+// the given Writer. Shutting down the returned Transport shuts
+// down the wrapped one too
+func New(next memberlist.Transport, w *Writer) *Transport {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t := &Transport{
+		ctx:      ctx,
+		cancel:   cancel,
+		next:     next,
+		w:        w,
+		streamCh: make(chan net.Conn),
+		packetCh: make(chan *memberlist.Packet),
+	}
+
+	t.wg.Go(t.packetLoop)
+	t.wg.Go(t.streamLoop)
+	return t
+}
+
+// Unwrap returns the wrapped memberlist.Transport
+func (t *Transport) Unwrap() memberlist.Transport {
+	return t.next
+}
+
+// Err returns the first error writing the recording, after which
+// traffic is no longer recorded
+func (t *Transport) Err() error {
+	if p := t.err.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (t *Transport) record(r *Record) {
+	if t.err.Load() != nil {
+		return
+	}
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	if err := t.w.Write(r); err != nil {
+		t.err.CompareAndSwap(nil, &err)
+	}
+}
+
+// FinalAdvertiseAddr calls the wrapped transport, recording the result
+func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	addr, port, err := t.next.FinalAdvertiseAddr(ip, port)
+	if err == nil {
+		t.record(&Record{
+			Kind: KindSelf,
+			Peer: net.JoinHostPort(addr.String(), strconv.Itoa(port)),
+		})
+	}
+	return addr, port, err
+}
+
+// WriteToAddress sends and records a packet
+func (t *Transport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	var ts time.Time
+	var err error
+
+	if nt, ok := t.next.(memberlist.NodeAwareTransport); ok {
+		ts, err = nt.WriteToAddress(b, addr)
+	} else {
+		ts, err = t.next.WriteTo(b, addr.Addr)
+	}
+
+	if err == nil {
+		t.record(&Record{
+			Kind: KindPacketSent,
+			Time: ts,
+			Peer: addr.Addr,
+			Data: b,
+		})
+	}
+	return ts, err
+}
+
+// WriteTo sends and records a packet
+func (t *Transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+// DialAddressTimeout establishes a stream through the wrapped transport,
+// recording what goes through it
+func (t *Transport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (
+	net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if nt, ok := t.next.(memberlist.NodeAwareTransport); ok {
+		conn, err = nt.DialAddressTimeout(addr, timeout)
+	} else {
+		conn, err = t.next.DialTimeout(addr.Addr, timeout)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return t.newConn(conn, KindStreamDialed, addr.Addr), nil
+}
+
+// DialTimeout establishes a stream to the given address
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.DialAddressTimeout(memberlist.Address{Addr: addr}, timeout)
+}
+
+// PacketCh returns the packets received by the wrapped transport
+func (t *Transport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// StreamCh returns the streams accepted by the wrapped transport
+func (t *Transport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown stops the workers and shuts down the wrapped transport
+func (t *Transport) Shutdown() error {
+	err := t.next.Shutdown()
+	t.cancel()
+	_ = t.wg.Wait()
+	return err
+}
+
+func (t *Transport) packetLoop() error {
+	in := t.next.PacketCh()
+	for {
+		select {
+		case p := <-in:
+			r := &Record{
+				Kind: KindPacketReceived,
+				Time: p.Timestamp,
+				Data: p.Buf,
+			}
+			if p.From != nil {
+				r.Peer = p.From.String()
+			}
+			t.record(r)
+
+			select {
+			case t.packetCh <- p:
+			case <-t.ctx.Done():
+				return nil
+			}
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *Transport) streamLoop() error {
+	in := t.next.StreamCh()
+	for {
+		select {
+		case conn := <-in:
+			var peer string
+			if addr := conn.RemoteAddr(); addr != nil {
+				peer = addr.String()
+			}
+
+			rc := t.newConn(conn, KindStreamAccepted, peer)
+			select {
+			case t.streamCh <- rc:
+			case <-t.ctx.Done():
+				_ = rc.Close()
+				return nil
+			}
+		case <-t.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *Transport) newConn(conn net.Conn, kind Kind, peer string) *recordConn {
+	rc := &recordConn{
+		Conn: conn,
+		t:    t,
+		id:   t.nextID.Add(1),
+	}
+
+	t.record(&Record{
+		Kind:   kind,
+		Stream: rc.id,
+		Peer:   peer,
+	})
+	return rc
+}
+
+// recordConn is a stream recording what is read and written
+type recordConn struct {
+	net.Conn
+	t    *Transport
+	id   uint64
+	once sync.Once
+}
+
+func (rc *recordConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	if n > 0 {
+		rc.t.record(&Record{
+			Kind:   KindStreamReceived,
+			Stream: rc.id,
+			Data:   b[:n],
+		})
+	}
+	return n, err
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	n, err := rc.Conn.Write(b)
+	if n > 0 {
+		rc.t.record(&Record{
+			Kind:   KindStreamSent,
+			Stream: rc.id,
+			Data:   b[:n],
+		})
+	}
+	return n, err
+}
+
+func (rc *recordConn) Close() error {
+	rc.once.Do(func() {
+		rc.t.record(&Record{
+			Kind:   KindStreamClosed,
+			Stream: rc.id,
+		})
+	})
+	return rc.Conn.Close()
+}
@@ -0,0 +1,263 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+var (
+	_ memberlist.Transport = (*Replayer)(nil)
+)
+
+// replayWriteTimeout is how long we wait for memberlist to read
+// recorded stream data
+const replayWriteTimeout = 5 * time.Second
+
+var (
+	// ErrReplay is returned when memberlist attempts to reach
+	// other nodes during a replay
+	ErrReplay = errors.New("replaying, no network available")
+)
+
+// Replayer is a memberlist.Transport that feeds the packets and
+// streams received in a recording into a memberlist instance.
+// What memberlist sends is discarded
+type Replayer struct {
+	r *Reader
+	// Speed scales the time between records. Zero or negative
+	// replays without waiting
+	Speed float64
+
+	self     string
+	ahead    []*Record
+	streams  map[uint64]net.Conn
+	streamCh chan net.Conn
+	packetCh chan *memberlist.Packet
+
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+// NewReplayer creates a Replayer for the given recording, reading
+// ahead to find the address the recording node advertised
+func NewReplayer(r *Reader) (*Replayer, error) {
+	rp := &Replayer{
+		r:        r,
+		Speed:    1,
+		streams:  make(map[uint64]net.Conn),
+		streamCh: make(chan net.Conn),
+		packetCh: make(chan *memberlist.Packet),
+		closed:   make(chan struct{}),
+	}
+
+	// find KindSelf, keeping what comes before
+	for {
+		rec, err := r.Next()
+		switch {
+		case err == io.EOF:
+			return rp, nil
+		case err != nil:
+			return nil, err
+		case rec.Kind == KindSelf:
+			rp.self = rec.Peer
+			return rp, nil
+		default:
+			rp.ahead = append(rp.ahead, rec)
+		}
+	}
+}
+
+// Run feeds the recording into memberlist until it ends or the
+// context is cancelled
+func (rp *Replayer) Run(ctx context.Context) error {
+	defer rp.closeStreams()
+
+	last := rp.r.Start
+	for {
+		rec, err := rp.next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if err := rp.wait(ctx, rec.Time.Sub(last)); err != nil {
+			return err
+		}
+		last = rec.Time
+
+		if err := rp.feed(ctx, rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (rp *Replayer) next() (*Record, error) {
+	if len(rp.ahead) > 0 {
+		rec := rp.ahead[0]
+		rp.ahead = rp.ahead[1:]
+		return rec, nil
+	}
+	return rp.r.Next()
+}
+
+func (rp *Replayer) wait(ctx context.Context, d time.Duration) error {
+	if rp.Speed > 0 && d > 0 {
+		timer := time.NewTimer(time.Duration(float64(d) / rp.Speed))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rp.closed:
+			return net.ErrClosed
+		}
+	}
+	return ctx.Err()
+}
+
+func (rp *Replayer) feed(ctx context.Context, rec *Record) error {
+	switch rec.Kind {
+	case KindPacketReceived:
+		return rp.feedPacket(ctx, rec)
+	case KindStreamAccepted:
+		return rp.feedStream(ctx, rec)
+	case KindStreamReceived:
+		if conn, ok := rp.streams[rec.Stream]; ok {
+			// a failing write means memberlist is done with it
+			_ = conn.SetWriteDeadline(time.Now().Add(replayWriteTimeout))
+			_, _ = conn.Write(rec.Data)
+		}
+	case KindStreamClosed:
+		if conn, ok := rp.streams[rec.Stream]; ok {
+			delete(rp.streams, rec.Stream)
+			_ = conn.Close()
+		}
+	}
+	return nil
+}
+
+func (rp *Replayer) feedPacket(ctx context.Context, rec *Record) error {
+	p := &memberlist.Packet{
+		Buf:       rec.Data,
+		From:      replayAddr(rec.Peer),
+		Timestamp: time.Now(),
+	}
+
+	select {
+	case rp.packetCh <- p:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rp.closed:
+		return net.ErrClosed
+	}
+}
+
+func (rp *Replayer) feedStream(ctx context.Context, rec *Record) error {
+	local, remote := net.Pipe()
+	conn := &replayConn{
+		Conn:   local,
+		remote: replayAddr(rec.Peer),
+	}
+
+	// discard what memberlist writes
+	go func() { _, _ = io.Copy(io.Discard, remote) }()
+
+	select {
+	case rp.streamCh <- conn:
+		rp.streams[rec.Stream] = remote
+		return nil
+	case <-ctx.Done():
+		_ = remote.Close()
+		return ctx.Err()
+	case <-rp.closed:
+		_ = remote.Close()
+		return net.ErrClosed
+	}
+}
+
+func (rp *Replayer) closeStreams() {
+	for id, conn := range rp.streams {
+		delete(rp.streams, id)
+		_ = conn.Close()
+	}
+}
+
+// FinalAdvertiseAddr returns the address advertised by the
+// recorded node, unless memberlist was told otherwise
+func (rp *Replayer) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip == "" && rp.self != "" {
+		if ap, err := netip.ParseAddrPort(rp.self); err == nil {
+			return ap.Addr().AsSlice(), int(ap.Port()), nil
+		}
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addr.AsSlice(), port, nil
+}
+
+// WriteTo discards packets sent by memberlist
+func (*Replayer) WriteTo([]byte, string) (time.Time, error) {
+	return time.Now(), nil
+}
+
+// DialTimeout fails, there is no one to talk to
+func (*Replayer) DialTimeout(string, time.Duration) (net.Conn, error) {
+	return nil, ErrReplay
+}
+
+// PacketCh returns the recorded inbound packets
+func (rp *Replayer) PacketCh() <-chan *memberlist.Packet {
+	return rp.packetCh
+}
+
+// StreamCh returns the recorded inbound streams
+func (rp *Replayer) StreamCh() <-chan net.Conn {
+	return rp.streamCh
+}
+
+// Shutdown stops the replay
+func (rp *Replayer) Shutdown() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	select {
+	case <-rp.closed:
+	default:
+		close(rp.closed)
+	}
+	return nil
+}
+
+// replayConn is an inbound stream presenting the recorded
+// remote address
+type replayConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *replayConn) RemoteAddr() net.Addr { return c.remote }
+
+func replayAddr(s string) net.Addr {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+
+	host, port, _ := net.SplitHostPort(s)
+	p, _ := strconv.Atoi(port)
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+}
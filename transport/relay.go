@@ -0,0 +1,398 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// relays keeps track of the tunnels of a Transport
+type relays struct {
+	mu sync.Mutex
+	// clients are tunnels accepted from nodes that can't receive
+	// packets or streams directly, by the address they are known by
+	clients map[string]*tunnel
+	// relays are tunnels we dialed, by the address we dialed
+	relays map[string]*tunnel
+
+	accept bool
+	dialTo []string
+	secret []byte
+}
+
+func (rs *relays) init(config *Config) {
+	rs.clients = make(map[string]*tunnel)
+	rs.relays = make(map[string]*tunnel)
+	rs.accept = config.AcceptTunnels
+	rs.dialTo = config.Relays
+	rs.secret = config.TunnelSecret
+}
+
+func (rs *relays) getClient(addr string) *tunnel {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.clients[addr]
+}
+
+func (rs *relays) getRelay(addr string) *tunnel {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.relays[addr]
+}
+
+func (rs *relays) closeAll() {
+	rs.mu.Lock()
+	all := make([]*tunnel, 0, len(rs.clients)+len(rs.relays))
+	for _, tun := range rs.clients {
+		all = append(all, tun)
+	}
+	for _, tun := range rs.relays {
+		all = append(all, tun)
+	}
+	rs.mu.Unlock()
+
+	for _, tun := range all {
+		tun.close()
+	}
+}
+
+// startRelays spawns the workers keeping tunnels to the configured
+// relays
+func (t *Transport) startRelays() {
+	for _, addr := range t.relays.dialTo {
+		t.goWorker(func() error {
+			t.relayLoop(addr)
+			return nil
+		})
+	}
+}
+
+// relayLoop keeps a tunnel to a relay open, reconnecting with
+// backoff when it fails
+func (t *Transport) relayLoop(addr string) {
+	const baseDelay = 100 * time.Millisecond
+	const maxDelay = 30 * time.Second
+
+	// we need to know our own address first
+	select {
+	case <-t.selfReady:
+	case <-t.ctx.Done():
+		return
+	}
+
+	var delay time.Duration
+	for {
+		err := t.serveRelay(addr)
+		if t.ctx.Err() != nil {
+			return
+		}
+
+		t.error(err).
+			WithField(RemoteAddrLabel, addr).
+			Print("Tunnel to relay terminated")
+
+		delay = min(max(2*delay, baseDelay), maxDelay)
+		select {
+		case <-time.After(delay):
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// serveRelay dials a relay asking to receive through the tunnel,
+// and serves it until it fails
+func (t *Transport) serveRelay(addr string) error {
+	tun, err := t.dialTunnel(addr, helloReceive)
+	if err != nil {
+		return err
+	}
+
+	return tun.serve(t.ctx)
+}
+
+// dialTunnel establishes a tunnel to a relay
+func (t *Transport) dialTunnel(addr string, flags byte) (*tunnel, error) {
+	self := t.self()
+	switch {
+	case self == "":
+		return nil, errors.New("advertise address unknown")
+	case len(t.relays.secret) == 0:
+		return nil, errors.New("TunnelSecret not set")
+	}
+
+	// tunnels aren't offered compression, the relay
+	// expects the tunnelMagic first
+	ctx, cancel := context.WithTimeout(t.ctx, tunnelDialTimeout)
+	defer cancel()
+
+	dest := memberlist.Address{Addr: addr}
+	conn, err := t.dialStream(ctx, dest, t.routes.get(dest))
+	if err != nil {
+		return nil, err
+	}
+
+	tun := newTunnel(conn, nil, true, t, t.relays.secret)
+	tun.peer = addr
+
+	_ = conn.SetDeadline(time.Now().Add(tunnelHelloTimeout))
+	if err := tun.hello(self, flags); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	t.relays.mu.Lock()
+	if old := t.relays.relays[addr]; old != nil {
+		go old.close()
+	}
+	t.relays.relays[addr] = tun
+	t.relays.mu.Unlock()
+
+	t.debug().
+		WithField(RemoteAddrLabel, addr).
+		Print("Tunnel established")
+	return tun, nil
+}
+
+const (
+	tunnelDialTimeout = 10 * time.Second
+	// tunnelHelloTimeout is how long either side of a new
+	// stream waits for the other to say what it is
+	tunnelHelloTimeout = 10 * time.Second
+)
+
+// relayTunnel returns a tunnel to the given relay, dialing it
+// if needed
+func (t *Transport) relayTunnel(addr string) (*tunnel, error) {
+	if tun := t.relays.getRelay(addr); tun != nil {
+		return tun, nil
+	}
+
+	tun, err := t.dialTunnel(addr, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.goWorker(func() error {
+		_ = tun.serve(t.ctx)
+		return nil
+	}) {
+		tun.close()
+		return nil, net.ErrClosed
+	}
+	return tun, nil
+}
+
+// acceptTunnel checks if an inbound stream is a tunnel, and serves it.
+// Otherwise it's given to memberlist
+func (t *Transport) acceptTunnel(ctx context.Context, conn net.Conn) {
+	// don't wait forever for silent clients
+	_ = conn.SetDeadline(time.Now().Add(tunnelHelloTimeout))
+	// nor past Shutdown
+	defer context.AfterFunc(ctx, func() { _ = conn.Close() })()
+
+	br := bufio.NewReader(conn)
+	ok, err := isTunnel(br)
+	switch {
+	case err != nil:
+		t.error(err).
+			WithField(RemoteAddrLabel, conn.RemoteAddr()).
+			Print("Failed to read stream")
+		_ = conn.Close()
+		return
+	case !ok:
+		// not a tunnel
+		_ = conn.SetDeadline(time.Time{})
+		_ = t.deliverStream(ctx, &bufferedConn{Conn: conn, r: br})
+		return
+	}
+
+	_, _ = br.Discard(len(tunnelMagic))
+	tun := newTunnel(conn, br, false, t, t.relays.secret)
+	if err := tun.readHello(); err != nil {
+		t.error(err).
+			WithField(RemoteAddrLabel, conn.RemoteAddr()).
+			Print("Invalid tunnel")
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if tun.flags&helloReceive != 0 {
+		t.relays.mu.Lock()
+		if old := t.relays.clients[tun.peer]; old != nil {
+			go old.close()
+		}
+		t.relays.clients[tun.peer] = tun
+		t.relays.mu.Unlock()
+	}
+
+	t.debug().
+		WithField(RemoteAddrLabel, tun.peer).
+		Print("Tunnel accepted")
+
+	_ = tun.serve(ctx)
+}
+
+// isTunnel tells if an inbound stream starts with the tunnelMagic.
+// The first byte decides, as memberlist streams and compression
+// offers can be shorter than the magic, and wait for an answer
+func isTunnel(br *bufio.Reader) (bool, error) {
+	b, err := br.Peek(1)
+	switch {
+	case err != nil:
+		return false, err
+	case b[0] != tunnelMagic[0]:
+		return false, nil
+	}
+
+	b, err = br.Peek(len(tunnelMagic))
+	switch {
+	case err != nil:
+		return false, err
+	case string(b) != tunnelMagic:
+		return false, errors.New("invalid tunnel magic")
+	default:
+		return true, nil
+	}
+}
+
+// tunnelPacket handles packets arriving through a tunnel
+func (t *Transport) tunnelPacket(tun *tunnel, ft byte, addr string, b []byte) {
+	switch ft {
+	case framePacket:
+		_ = t.deliverPacket(t.ctx, &memberlist.Packet{
+			Buf:       b,
+			From:      tunnelUDPAddr(addr),
+			Timestamp: time.Now(),
+		})
+	case frameForward:
+		if client := t.relays.getClient(addr); client != nil {
+			_ = client.sendPacket(framePacket, tun.peer, b)
+		}
+	}
+}
+
+// tunnelStream handles streams arriving through a tunnel
+func (t *Transport) tunnelStream(tun *tunnel, ft byte, addr string, conn net.Conn) {
+	switch ft {
+	case frameOpen:
+		t.goStream(conn, func() {
+			_ = t.deliverStream(t.ctx, conn)
+		})
+	case frameOpenForward:
+		client := t.relays.getClient(addr)
+		if client == nil {
+			_ = conn.Close()
+			return
+		}
+
+		out, err := client.open(frameOpen, tun.peer)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		if !t.goWorker(func() error {
+			splice(t.ctx, conn, out)
+			return nil
+		}) {
+			_ = conn.Close()
+			_ = out.Close()
+		}
+	}
+}
+
+// tunnelClosed forgets a terminated tunnel
+func (t *Transport) tunnelClosed(tun *tunnel) {
+	t.relays.mu.Lock()
+	defer t.relays.mu.Unlock()
+
+	if t.relays.clients[tun.peer] == tun {
+		delete(t.relays.clients, tun.peer)
+	}
+	if t.relays.relays[tun.peer] == tun {
+		delete(t.relays.relays, tun.peer)
+	}
+}
+
+// writeToTunnel sends a packet through a tunnel if the destination,
+// identified by the address memberlist knows it by, is a tunnel client
+// or has a relay Route
+func (t *Transport) writeToTunnel(b []byte, addr string, r Route) (bool, error) {
+	if client := t.relays.getClient(addr); client != nil {
+		return true, client.sendPacket(framePacket, t.self(), b)
+	}
+
+	if r.Relay == "" {
+		return false, nil
+	}
+
+	tun, err := t.relayTunnel(r.Relay)
+	if err != nil {
+		return true, err
+	}
+	return true, tun.sendPacket(frameForward, addr, b)
+}
+
+// dialTunnelStream opens a stream through a tunnel if the destination,
+// identified by the address memberlist knows it by, is a tunnel client
+// or has a relay Route
+func (t *Transport) dialTunnelStream(addr string, r Route) (net.Conn, bool, error) {
+	if client := t.relays.getClient(addr); client != nil {
+		conn, err := client.open(frameOpen, t.self())
+		return conn, true, err
+	}
+
+	if r.Relay == "" {
+		return nil, false, nil
+	}
+
+	tun, err := t.relayTunnel(r.Relay)
+	if err != nil {
+		return nil, true, err
+	}
+
+	conn, err := tun.open(frameOpenForward, addr)
+	return conn, true, err
+}
+
+func tunnelUDPAddr(addr string) net.Addr {
+	if a, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		return a
+	}
+	return tunnelAddr(addr)
+}
+
+// splice copies data between two streams until either is done
+// or the context is cancelled
+func splice(ctx context.Context, a, b net.Conn) {
+	closeBoth := func() {
+		_ = a.Close()
+		_ = b.Close()
+	}
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+	closeBoth()
+	<-done
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"darvaza.org/core"
+)
+
+// ListenTCPReusePort is a ListenTCP helper that sets SO_REUSEPORT on the
+// socket so several listeners can share the same address and port
+func ListenTCPReusePort(network string, laddr *net.TCPAddr) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: controlReusePort}
+
+	ln, err := lc.Listen(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpLn, ok := ln.(*net.TCPListener); ok {
+		return tcpLn, nil
+	}
+
+	_ = ln.Close()
+	return nil, core.Wrapf(core.ErrInvalid, "%s: not a TCP listener", network)
+}
+
+// ListenUDPReusePort is a ListenUDP helper that sets SO_REUSEPORT on the
+// socket so several readers can share the same address and port
+func ListenUDPReusePort(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: controlReusePort}
+
+	pc, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if udpLn, ok := pc.(*net.UDPConn); ok {
+		return udpLn, nil
+	}
+
+	_ = pc.Close()
+	return nil, core.Wrapf(core.ErrInvalid, "%s: not a UDP socket", network)
+}
+
+func controlReusePort(_, _ string, c syscall.RawConn) error {
+	var err error
+
+	err2 := c.Control(func(fd uintptr) {
+		err = setReusePort(fd)
+	})
+
+	return core.CoalesceError(err2, err)
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package transport
+
+import "errors"
+
+func setReusePort(uintptr) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,118 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestBindReusePort opens several readers sharing one port, and
+// checks packets reach them
+func TestBindReusePort(t *testing.T) {
+	const readers = 3
+
+	tr, err := New(&Config{
+		BindAddress:   []string{"127.0.0.1"},
+		BindReusePort: readers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Shutdown()
+
+	tcpListeners, udpListeners := tr.listeners()
+	if len(tcpListeners) != readers || len(udpListeners) != readers {
+		t.Fatalf("expected %v readers, got %v TCP and %v UDP",
+			readers, len(tcpListeners), len(udpListeners))
+	}
+
+	lsn := &Listeners{TCP: tcpListeners, UDP: udpListeners}
+	addrs, port, err := lsn.Validate()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case len(addrs) != 1:
+		t.Fatalf("expected one address, got %v", addrs)
+	}
+
+	probe, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := probe.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-tr.PacketCh():
+			if string(msg.Buf) != "hello" {
+				t.Fatalf("unexpected packet %q", msg.Buf)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet lost")
+		}
+	}
+}
+
+// TestCheckPortFree checks a port bound by another socket isn't
+// shared using SO_REUSEPORT
+func TestCheckPortFree(t *testing.T) {
+	ip := net.IPv4(127, 0, 0, 1)
+
+	// bound by someone else, also using SO_REUSEPORT
+	other, err := ListenTCPReusePort("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	port := other.Addr().(*net.TCPAddr).Port
+	if err := checkPortFree(ip, port); err == nil {
+		t.Fatal("taken port reported free")
+	}
+
+	_, err = New(&Config{
+		BindAddress:    []string{"127.0.0.1"},
+		BindPort:       port,
+		BindPortStrict: true,
+		BindReusePort:  2,
+	})
+	if err == nil {
+		t.Fatal("port shared with another socket")
+	}
+
+	_ = other.Close()
+	if err := checkPortFree(ip, port); err != nil {
+		t.Fatal("free port reported taken:", err)
+	}
+}
+
+func TestValidateGroup(t *testing.T) {
+	ap := netip.MustParseAddrPort
+
+	for _, tc := range []struct {
+		name   string
+		these  []netip.AddrPort
+		others []netip.AddrPort
+		ok     bool
+	}{
+		{"shared", []netip.AddrPort{ap("127.0.0.1:7946"), ap("127.0.0.1:7946")},
+			[]netip.AddrPort{ap("127.0.0.1:7946")}, true},
+		{"other port", []netip.AddrPort{ap("127.0.0.1:7946"), ap("127.0.0.2:7947")},
+			[]netip.AddrPort{ap("127.0.0.1:7946"), ap("127.0.0.2:7947")}, false},
+		{"unpaired", []netip.AddrPort{ap("127.0.0.1:7946"), ap("127.0.0.2:7946")},
+			[]netip.AddrPort{ap("127.0.0.1:7946")}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateGroup(tc.these, tc.others, 7946); (err == nil) != tc.ok {
+				t.Fatalf("unexpected result: %v", err)
+			}
+		})
+	}
+}
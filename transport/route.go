@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Route describes how to reach a particular node, overriding the
+// address memberlist knows it by
+type Route struct {
+	// Addr is the host:port to use for both streams and packets.
+	// If empty the memberlist address is used
+	Addr string
+	// Port replaces the port of the address when non-zero
+	Port int
+	// ServerName is the name to verify on the certificate presented
+	// by the node when StreamTLS is used
+	ServerName string
+	// Relay is the host:port of a node accepting tunnels from this one,
+	// used to reach nodes that can't receive packets or streams directly
+	Relay string
+}
+
+// Target returns the host:port to use to reach a node known by
+// memberlist as addr
+func (r Route) Target(addr string) string {
+	if r.Addr != "" {
+		addr = r.Addr
+	}
+
+	if r.Port > 0 {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort(host, strconv.Itoa(r.Port))
+		}
+	}
+
+	return addr
+}
+
+// RouteResolver is a callback used to find the Route to a node that
+// isn't on the routing table. If it returns false the memberlist
+// address is used as-is
+type RouteResolver func(addr memberlist.Address) (Route, bool)
+
+// routes is the name-to-route table of a Transport
+type routes struct {
+	mu      sync.RWMutex
+	table   map[string]Route
+	resolve RouteResolver
+}
+
+func (rt *routes) init(config *Config) {
+	rt.table = make(map[string]Route, len(config.Routes))
+	for name, r := range config.Routes {
+		rt.table[name] = r
+	}
+	rt.resolve = config.ResolveRoute
+}
+
+func (rt *routes) get(addr memberlist.Address) Route {
+	if addr.Name != "" {
+		rt.mu.RLock()
+		r, ok := rt.table[addr.Name]
+		rt.mu.RUnlock()
+
+		if ok {
+			return r
+		}
+	}
+
+	if fn := rt.resolve; fn != nil {
+		if r, ok := fn(addr); ok {
+			return r
+		}
+	}
+
+	return Route{}
+}
+
+// SetRoute sets how to reach the node with the given name
+func (t *Transport) SetRoute(name string, r Route) {
+	t.routes.mu.Lock()
+	defer t.routes.mu.Unlock()
+
+	t.routes.table[name] = r
+}
+
+// RemoveRoute removes the Route to the node with the given name
+// from the routing table
+func (t *Transport) RemoveRoute(name string) {
+	t.routes.mu.Lock()
+	defer t.routes.mu.Unlock()
+
+	delete(t.routes.table, name)
+}
+
+// Route returns how the Transport reaches a node
+func (t *Transport) Route(addr memberlist.Address) Route {
+	return t.routes.get(addr)
+}
@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// expectStream accepts a stream on a transport and reads
+// the given payload from it
+func expectStream(t *testing.T, tr *Transport, payload string, timeout time.Duration) bool {
+	t.Helper()
+
+	select {
+	case conn := <-tr.StreamCh():
+		defer conn.Close()
+
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		buf := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != payload {
+			t.Fatalf("expected %q, got %q", payload, buf)
+		}
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func sendStream(t *testing.T, tr *Transport, dest memberlist.Address, payload string) {
+	t.Helper()
+
+	conn, err := tr.DialAddressTimeout(dest, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRoutes checks a per-node Route overrides the address
+// memberlist knows for both packets and streams, and removing
+// it falls back to that address
+func TestRoutes(t *testing.T) {
+	sender, _ := newTestTransport(t, &Config{})
+	known, knownAddr := newTestTransport(t, &Config{})
+	routed, routedAddr := newTestTransport(t, &Config{})
+
+	dest := memberlist.Address{Addr: knownAddr, Name: "node"}
+	send := func(payload string) {
+		if _, err := sender.WriteToAddress([]byte(payload), dest); err != nil {
+			t.Fatal(err)
+		}
+		sendStream(t, sender, dest, payload)
+	}
+
+	// by address
+	sender.SetRoute("node", Route{Addr: routedAddr})
+	if s := sender.Route(dest).Target(dest.Addr); s != routedAddr {
+		t.Fatalf("expected %q, got %q", routedAddr, s)
+	}
+
+	send("routed")
+	if expectPacket(t, routed, "routed", 5*time.Second) == nil {
+		t.Fatal("routed packet lost")
+	}
+	if !expectStream(t, routed, "routed", 5*time.Second) {
+		t.Fatal("routed stream lost")
+	}
+
+	// by port
+	_, port, _ := net.SplitHostPort(routedAddr)
+	p, _ := strconv.Atoi(port)
+	sender.SetRoute("node", Route{Port: p})
+
+	send("port")
+	if expectPacket(t, routed, "port", 5*time.Second) == nil {
+		t.Fatal("packet to the routed port lost")
+	}
+	if !expectStream(t, routed, "port", 5*time.Second) {
+		t.Fatal("stream to the routed port lost")
+	}
+
+	// other nodes don't follow the route
+	other := memberlist.Address{Addr: knownAddr, Name: "other"}
+	if s := sender.Route(other).Target(other.Addr); s != knownAddr {
+		t.Fatalf("route of %q used for %q", dest.Name, other.Name)
+	}
+
+	// back to the memberlist address
+	sender.RemoveRoute("node")
+
+	send("default")
+	if expectPacket(t, known, "default", 5*time.Second) == nil {
+		t.Fatal("packet to the default address lost")
+	}
+	if !expectStream(t, known, "default", 5*time.Second) {
+		t.Fatal("stream to the default address lost")
+	}
+}
+
+// TestResolveRoute checks the resolver is only asked for nodes
+// not on the routing table
+func TestResolveRoute(t *testing.T) {
+	tr, _ := newTestTransport(t, &Config{
+		Routes: map[string]Route{"a": {Addr: "192.0.2.1:7946"}},
+		ResolveRoute: func(addr memberlist.Address) (Route, bool) {
+			return Route{Port: 7947}, addr.Name == "b"
+		},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"a", "192.0.2.1:7946"},
+		{"b", "127.0.0.1:7947"},
+		{"c", "127.0.0.1:7946"},
+	} {
+		addr := memberlist.Address{Addr: "127.0.0.1:7946", Name: tc.name}
+		if s := tr.Route(addr).Target(addr.Addr); s != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, s)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errorRateWindow is the period used to estimate
+// the error rate of the listeners
+const errorRateWindow = time.Minute
+
+// Status describes the health of a Transport
+type Status struct {
+	// Listeners describes each listening socket
+	Listeners []ListenerStatus `json:"listeners"`
+	// Advertise is the address we advertise, once known
+	Advertise string `json:"advertise,omitempty"`
+	// Failed is the error that made the Transport fail, if any
+	Failed string `json:"failed,omitempty"`
+	// Shutdown indicates the Transport is closing or closed
+	Shutdown bool `json:"shutdown"`
+
+	// PacketQueue is the number of packets waiting for
+	// memberlist to take them
+	PacketQueue int `json:"packet_queue"`
+	// StreamQueue is the number of streams waiting for
+	// memberlist to take them
+	StreamQueue int `json:"stream_queue"`
+	// LastPacket is when the last packet was passed
+	// to memberlist
+	LastPacket time.Time `json:"last_packet"`
+	// SinceLastPacket is the time elapsed since LastPacket,
+	// or zero if none has been received
+	SinceLastPacket time.Duration `json:"since_last_packet"`
+}
+
+// ListenerStatus describes the health of a listening socket
+type ListenerStatus struct {
+	// Network is "tcp" or "udp"
+	Network string `json:"network"`
+	// Addr is the address the socket listens on
+	Addr string `json:"addr"`
+	// Running indicates the worker is serving the socket
+	Running bool `json:"running"`
+	// Restarts is how many times the socket has been reopened
+	Restarts int `json:"restarts"`
+	// LastError is the last error accepting or reading
+	LastError string `json:"last_error,omitempty"`
+	// LastErrorTime is when LastError happened
+	LastErrorTime time.Time `json:"last_error_time"`
+	// ErrorRate is the estimated number of errors per minute
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// Alive tells if the Transport hasn't failed nor been shut down
+func (s *Status) Alive() bool {
+	return s.Failed == "" && !s.Shutdown
+}
+
+// Ready tells if the Transport is alive, knows what address to
+// advertise, and has at least one TCP and one UDP socket running
+func (s *Status) Ready() bool {
+	var tcp, udp bool
+
+	for _, ls := range s.Listeners {
+		switch {
+		case !ls.Running:
+		case ls.Network == "tcp":
+			tcp = true
+		case ls.Network == "udp":
+			udp = true
+		}
+	}
+
+	return tcp && udp && s.Advertise != "" && s.Alive()
+}
+
+// Status reports the health of the Transport
+func (t *Transport) Status() Status {
+	now := time.Now()
+	s := Status{
+		Advertise:   t.self(),
+		Shutdown:    t.cancelled.Load(),
+		PacketQueue: int(t.pendingPackets.Load()),
+		StreamQueue: int(t.pendingStreams.Load()),
+	}
+
+	if err := t.Err(); err != nil {
+		s.Failed = err.Error()
+	}
+
+	if ns := t.lastPacket.Load(); ns > 0 {
+		s.LastPacket = time.Unix(0, ns)
+		s.SinceLastPacket = now.Sub(s.LastPacket)
+	}
+
+	tcpListeners, udpListeners := t.listeners()
+	for _, ln := range tcpListeners {
+		s.Listeners = append(s.Listeners, t.listenerStatus(ln, ln.Addr(), now))
+	}
+	for _, ln := range udpListeners {
+		s.Listeners = append(s.Listeners, t.listenerStatus(ln, ln.LocalAddr(), now))
+	}
+	return s
+}
+
+func (t *Transport) listenerStatus(ln any, addr net.Addr, now time.Time) ListenerStatus {
+	if st := t.getListenerStats(ln); st != nil {
+		return st.status(now)
+	}
+
+	// not supervised yet or anymore
+	return ListenerStatus{
+		Network: addr.Network(),
+		Addr:    addr.String(),
+	}
+}
+
+// listenerStats tracks the health of a supervised socket,
+// surviving its restarts
+type listenerStats struct {
+	network  string
+	addr     string
+	running  atomic.Bool
+	restarts atomic.Int32
+
+	mu          sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+	window      time.Time
+	count       int
+	prev        int
+}
+
+func newListenerStats(addr net.Addr) *listenerStats {
+	return &listenerStats{
+		network: addr.Network(),
+		addr:    addr.String(),
+		window:  time.Now(),
+	}
+}
+
+func (st *listenerStats) noteError(err error) {
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.advance(now)
+	st.count++
+	st.lastErr = err
+	st.lastErrTime = now
+}
+
+// advance moves the counting window forward
+func (st *listenerStats) advance(now time.Time) {
+	switch elapsed := now.Sub(st.window); {
+	case elapsed >= 2*errorRateWindow:
+		st.prev, st.count = 0, 0
+		st.window = now
+	case elapsed >= errorRateWindow:
+		st.prev, st.count = st.count, 0
+		st.window = st.window.Add(errorRateWindow)
+	}
+}
+
+// rate estimates the errors per errorRateWindow, weighting
+// the previous window by how much of it is still in range
+func (st *listenerStats) rate(now time.Time) float64 {
+	st.advance(now)
+
+	weight := 1 - float64(now.Sub(st.window))/float64(errorRateWindow)
+	return float64(st.prev)*weight + float64(st.count)
+}
+
+func (st *listenerStats) status(now time.Time) ListenerStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ls := ListenerStatus{
+		Network:       st.network,
+		Addr:          st.addr,
+		Running:       st.running.Load(),
+		Restarts:      int(st.restarts.Load()),
+		LastErrorTime: st.lastErrTime,
+		ErrorRate:     st.rate(now),
+	}
+
+	if st.lastErr != nil {
+		ls.LastError = st.lastErr.Error()
+	}
+	return ls
+}
+
+func (t *Transport) getListenerStats(ln any) *listenerStats {
+	if v, ok := t.lstats.Load(ln); ok {
+		return v.(*listenerStats)
+	}
+	return nil
+}
+
+// noteListenerError records an error accepting or reading
+// on a socket
+func (t *Transport) noteListenerError(ln any, err error) {
+	if st := t.getListenerStats(ln); st != nil {
+		st.noteError(err)
+	}
+}
@@ -0,0 +1,310 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"darvaza.org/core"
+)
+
+const (
+	// DefaultRestartDelay is the wait before the first restart of
+	// a failed worker when RestartPolicy.Delay isn't set
+	DefaultRestartDelay = 100 * time.Millisecond
+	// DefaultRestartMaxDelay is the longest wait between restarts
+	// when RestartPolicy.MaxDelay isn't set
+	DefaultRestartMaxDelay = 30 * time.Second
+
+	// restartResetAfter is how long a worker needs to run after
+	// a restart to be considered healthy again
+	restartResetAfter = time.Minute
+)
+
+// RestartPolicy describes how listening workers that fail are
+// restarted, reopening their socket on the same address
+type RestartPolicy struct {
+	// MaxRestarts is how many consecutive restarts are attempted
+	// before considering the Transport failed. Zero disables restarts
+	MaxRestarts int
+	// Delay is the wait before the first restart, doubled on
+	// every consecutive one
+	Delay time.Duration
+	// MaxDelay is the longest wait between restarts
+	MaxDelay time.Duration
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.MaxRestarts <= 0 {
+		return RestartPolicy{}
+	}
+
+	if p.Delay <= 0 {
+		p.Delay = DefaultRestartDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRestartMaxDelay
+	}
+	if p.MaxDelay < p.Delay {
+		p.MaxDelay = p.Delay
+	}
+	return p
+}
+
+// delay returns how long to wait before the given attempt,
+// counting from one
+func (p RestartPolicy) delay(attempt int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDelay)
+}
+
+// Err returns the error that made the Transport fail, or nil
+// if it's running or was shut down normally
+func (t *Transport) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+
+	return t.failed
+}
+
+// Done returns a channel that is closed once all workers
+// have exited, either by Shutdown or by failure
+func (t *Transport) Done() <-chan struct{} {
+	return t.done
+}
+
+// NotifyFailure adds a function to be called when the Transport
+// fails, before it shuts down. If it has already failed the
+// function is called immediately
+func (t *Transport) NotifyFailure(fn func(error)) {
+	if fn == nil {
+		return
+	}
+
+	t.errMu.Lock()
+	err := t.failed
+	if err == nil {
+		t.onError = append(t.onError, fn)
+	}
+	t.errMu.Unlock()
+
+	if err != nil {
+		callOnError(fn, err)
+	}
+}
+
+// fail is called when a worker returns an error. The first one
+// marks the Transport as failed, notifies and initiates a shutdown
+func (t *Transport) fail(err error) error {
+	defer t.initiateShutdown()
+
+	t.errMu.Lock()
+	first := t.failed == nil
+	if first {
+		t.failed = err
+	}
+	hooks := t.onError
+	t.errMu.Unlock()
+
+	if first {
+		t.error(err).Print("Transport failed")
+
+		for _, fn := range hooks {
+			callOnError(fn, err)
+		}
+	}
+	return err
+}
+
+func callOnError(fn func(error), err error) {
+	var c core.Catcher
+
+	_ = c.Try(func() error {
+		fn(err)
+		return nil
+	})
+}
+
+// startListeners spawns one supervised worker per socket, closing
+// the ones it can't as the Transport is stopping
+func (t *Transport) startListeners(lsn *Listeners) {
+	for _, tcpLn := range lsn.TCP {
+		if !t.goWorker(func() error {
+			return supervise(t, tcpLn, tcpLn.Addr(), t.tcpLoop, t.relistenTCP)
+		}) {
+			_ = tcpLn.Close()
+		}
+	}
+
+	for _, udpLn := range lsn.UDP {
+		if !t.goWorker(func() error {
+			return supervise(t, udpLn, udpLn.LocalAddr(), t.udpLoop, t.relistenUDP)
+		}) {
+			_ = udpLn.Close()
+		}
+	}
+}
+
+// supervise runs a listening loop, reopening the socket and running
+// it again when it fails, as allowed by the RestartPolicy
+func supervise[T any](t *Transport, ln T, addr net.Addr,
+	loop func(context.Context, T) error,
+	relisten func(T) (T, bool, error)) error {
+	var restarts int
+
+	st := newListenerStats(addr)
+	t.lstats.Store(ln, st)
+	defer func() { t.lstats.Delete(ln) }()
+
+	for {
+		var c core.Catcher
+
+		started := time.Now()
+		st.running.Store(true)
+		err := c.Do(func() error {
+			return loop(t.ctx, ln)
+		})
+		st.running.Store(false)
+
+		switch {
+		case err == nil, t.cancelled.Load():
+			return nil
+		case time.Since(started) > restartResetAfter:
+			restarts = 0
+		}
+
+		st.noteError(err)
+		next, ok, err := restartListener(t, ln, addr, err, &restarts, relisten)
+		if !ok {
+			return err
+		}
+
+		st.restarts.Add(1)
+		t.lstats.Delete(ln)
+		t.lstats.Store(next, st)
+		ln = next
+	}
+}
+
+// restartListener waits and reopens a failed socket until it succeeds,
+// the Transport is shut down, the socket is removed or the restarts
+// are exhausted
+func restartListener[T any](t *Transport, ln T, addr net.Addr, err error,
+	restarts *int, relisten func(T) (T, bool, error)) (T, bool, error) {
+	var zero T
+
+	for {
+		*restarts++
+		if *restarts > t.restart.MaxRestarts {
+			return zero, false, err
+		}
+
+		delay := t.restart.delay(*restarts)
+		t.error(err).
+			WithField(ListenerAddrLabel, addr).
+			Printf("Listener failed, restarting in %s (%v/%v)",
+				delay, *restarts, t.restart.MaxRestarts)
+
+		if !t.sleep(delay) {
+			return zero, false, nil
+		}
+
+		next, ok, err2 := relisten(ln)
+		switch {
+		case err2 != nil:
+			err = err2
+		case ok:
+			t.debug().
+				WithField(ListenerAddrLabel, addr).
+				Print("Listener restarted")
+			return next, true, nil
+		default:
+			// removed or shutting down
+			return zero, false, nil
+		}
+	}
+}
+
+// sleep waits for the given duration, or until the Transport
+// is shut down
+func (t *Transport) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+// relistenTCP opens a new TCP listener on the address of a failed one
+// and puts it in its place. It returns false if the old listener
+// is no longer wanted
+func (t *Transport) relistenTCP(old *net.TCPListener) (*net.TCPListener, bool, error) {
+	if !t.hasTCPListener(old) {
+		return nil, false, nil
+	}
+
+	addr, _ := old.Addr().(*net.TCPAddr)
+	ln, err := t.config.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+
+	i := slices.Index(t.tcpListeners, old)
+	if i < 0 || t.cancelled.Load() {
+		_ = ln.Close()
+		return nil, false, nil
+	}
+
+	// copy on write
+	tcpListeners := slices.Clone(t.tcpListeners)
+	tcpListeners[i] = ln
+	t.tcpListeners = tcpListeners
+	return ln, true, nil
+}
+
+// relistenUDP opens a new UDP socket on the address of a failed one
+// and puts it in its place. It returns false if the old socket
+// is no longer wanted
+func (t *Transport) relistenUDP(old *net.UDPConn) (*net.UDPConn, bool, error) {
+	if !t.hasUDPListener(old) {
+		return nil, false, nil
+	}
+
+	addr, _ := old.LocalAddr().(*net.UDPAddr)
+	ln, err := t.config.ListenUDP("udp", addr)
+	if err == nil {
+		_, err = setUDPRecvBuffer(ln)
+	}
+	if err != nil {
+		if ln != nil {
+			_ = ln.Close()
+		}
+		return nil, false, err
+	}
+
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+
+	i := slices.Index(t.udpListeners, old)
+	if i < 0 || t.cancelled.Load() {
+		_ = ln.Close()
+		return nil, false, nil
+	}
+
+	// copy on write
+	udpListeners := slices.Clone(t.udpListeners)
+	udpListeners[i] = ln
+	t.udpListeners = udpListeners
+	return ln, true, nil
+}
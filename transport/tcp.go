@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"time"
 
@@ -9,12 +11,69 @@ import (
 )
 
 // DialAddressTimeout is used by memberlist to establish a TCP connection to a particular node
-func (*Transport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (
+func (t *Transport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (
 	net.Conn, error) {
-	dialer := net.Dialer{
-		Timeout: timeout,
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	r := t.routes.get(addr)
+
+	conn, err := t.dialStream(ctx, addr, r)
+	if err != nil || !t.compress.shouldOffer(addr.Addr) {
+		return conn, err
+	}
+
+	cc, err := t.compress.offer(ctx, conn, addr.Addr)
+	switch {
+	case err == nil:
+		return cc, nil
+	case errors.Is(err, errCompressRefused):
+		// try again without compression
+		_ = conn.Close()
+		return t.dialStream(ctx, addr, r)
+	default:
+		_ = conn.Close()
+		return nil, err
+	}
+}
+
+// dialStream establishes a stream to a node, directly or through
+// a tunnel
+func (t *Transport) dialStream(ctx context.Context, addr memberlist.Address, r Route) (
+	net.Conn, error) {
+	if conn, ok, err := t.dialTunnelStream(addr.Addr, r); ok {
+		return conn, err
+	}
+
+	target := r.Target(addr.Addr)
+	conn, err := t.dial(ctx, "tcp", target)
+	switch {
+	case err != nil:
+		return nil, err
+	case t.tls != nil:
+		return t.tlsClient(ctx, conn, r, target)
+	default:
+		return conn, nil
+	}
+}
+
+// tlsClient wraps an outbound stream with TLS, verifying the server
+// name given by the Route, or the target host
+func (t *Transport) tlsClient(ctx context.Context, conn net.Conn, r Route, target string) (
+	net.Conn, error) {
+	cfg := t.tls.Clone()
+	if r.ServerName != "" {
+		cfg.ServerName = r.ServerName
+	} else if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(target)
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
-	return dialer.Dial("tcp", addr.Addr)
+	return tc, nil
 }
 
 // DialTimeout is used by memberlist to connect to a particular TCP Address
@@ -57,23 +116,16 @@ func (t *Transport) tcpLoop(ctx context.Context, ln *net.TCPListener) error {
 				WithField(RemoteAddrLabel, conn.RemoteAddr()).
 				Print("Connected")
 
-			select {
-			case t.streamCh <- conn:
-				// continue
-			case <-ctx.Done():
-				err := ctx.Err()
-				// sorry pal, we are cancelled
-				t.error(err).
-					WithField(ListenerAddrLabel, ln.Addr()).
-					WithField(RemoteAddrLabel, conn.RemoteAddr()).
-					Print("Connection Terminated")
-
-				_ = conn.Close()
+			if err := t.handleStream(ctx, conn); err != nil {
 				return err
 			}
-		} else if t.cancelled.Load() {
-			// shutdown in process, ignore error and exit
+		} else if t.cancelled.Load() || !t.hasTCPListener(ln) {
+			// shutdown in process or listener removed,
+			// ignore error and exit
 			return nil
+		} else if errors.Is(err, net.ErrClosed) {
+			// closed behind our back
+			return err
 		} else {
 			if errorDelay == 0 {
 				// first
@@ -88,6 +140,7 @@ func (t *Transport) tcpLoop(ctx context.Context, ln *net.TCPListener) error {
 				errorDelay = maxDelay
 			}
 
+			t.noteListenerError(ln, err)
 			t.error(err).
 				WithField(ListenerAddrLabel, ln.Addr()).
 				Print("Error accepting TCP connection")
@@ -102,3 +155,53 @@ func (t *Transport) tcpLoop(ctx context.Context, ln *net.TCPListener) error {
 		}
 	}
 }
+
+// handleStream processes an accepted connection
+func (t *Transport) handleStream(ctx context.Context, conn net.Conn) error {
+	if t.tls != nil {
+		// handshake happens on first read
+		conn = tls.Server(conn, t.tls)
+	}
+
+	if t.relays.accept {
+		// could be a tunnel, we need to read to know
+		t.goStream(conn, func() {
+			t.acceptTunnel(ctx, conn)
+		})
+		return nil
+	}
+
+	return t.deliverStream(ctx, conn)
+}
+
+// goStream handles a stream on a worker, so Shutdown waits for it,
+// or closes it if the Transport is stopping
+func (t *Transport) goStream(conn net.Conn, fn func()) {
+	if !t.goWorker(func() error {
+		fn()
+		return nil
+	}) {
+		_ = conn.Close()
+	}
+}
+
+// deliverStream passes an inbound stream to memberlist
+func (t *Transport) deliverStream(ctx context.Context, conn net.Conn) error {
+	t.pendingStreams.Add(1)
+	defer t.pendingStreams.Add(-1)
+
+	select {
+	case t.streamCh <- t.compress.accept(conn):
+		return nil
+	case <-ctx.Done():
+		err := ctx.Err()
+		// sorry pal, we are cancelled
+		t.error(err).
+			WithField(ListenerAddrLabel, conn.LocalAddr()).
+			WithField(RemoteAddrLabel, conn.RemoteAddr()).
+			Print("Connection Terminated")
+
+		_ = conn.Close()
+		return err
+	}
+}
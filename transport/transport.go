@@ -3,9 +3,11 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/netip"
+	"sync"
 	"sync/atomic"
 
 	"darvaza.org/core"
@@ -22,16 +24,41 @@ var (
 // an slog.Logger, Cancellable Context, ListenTCP/ListenUDP
 // callbacks
 type Transport struct {
-	wg        core.WaitGroup
-	cancel    context.CancelFunc
-	cancelled atomic.Bool
-	onError   func(err error)
-	log       slog.Logger
-
+	wg          core.WaitGroup
+	wgMu        sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cancelled   atomic.Bool
+	errMu       sync.Mutex
+	failed      error
+	onError     []func(err error)
+	restart     RestartPolicy
+	done        chan struct{}
+	log         slog.Logger
+	advertise   *AdvertisePolicy
+	dial        DialContextFunc
+	routes      routes
+	relays      relays
+	compress    compressor
+	tls         *tls.Config
+	selfAddr    atomic.Value
+	selfOnce    sync.Once
+	selfReady   chan struct{}
+	selfFixed   atomic.Bool
+	onAdvertise atomic.Pointer[func(netip.AddrPort)]
+
+	config       *Config
+	port         int
+	lmu          sync.RWMutex
 	tcpListeners []*net.TCPListener
 	udpListeners []*net.UDPConn
 	streamCh     chan net.Conn
 	packetCh     chan *memberlist.Packet
+
+	lstats         sync.Map
+	lastPacket     atomic.Int64
+	pendingPackets atomic.Int32
+	pendingStreams atomic.Int32
 }
 
 // NewWithListeners creates a new transport using preallocated listeners.
@@ -81,52 +108,57 @@ func newTransport(config *Config, lsn *Listeners) (*Transport, error) {
 	ctx, cancel := context.WithCancel(config.Context)
 
 	t := &Transport{
-		cancel:  cancel,
-		log:     config.Logger,
-		onError: config.OnError,
+		ctx:       ctx,
+		cancel:    cancel,
+		log:       config.Logger,
+		restart:   config.Restart.withDefaults(),
+		done:      make(chan struct{}),
+		advertise: config.AdvertisePolicy,
+		tls:       config.StreamTLS,
+		selfReady: make(chan struct{}),
+		config:    config,
 
 		streamCh: make(chan net.Conn),
 		packetCh: make(chan *memberlist.Packet),
 	}
 
-	if lsn == nil {
-		var err error
+	t.routes.init(config)
+	t.relays.init(config)
+	t.compress.init(config)
+
+	dial, err := t.newDialer(config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t.dial = dial
 
+	if lsn == nil {
 		lsn, err = newListeners(config)
 		if err != nil {
+			cancel()
 			return nil, err
 		}
 	}
 
 	t.tcpListeners = lsn.TCP
 	t.udpListeners = lsn.UDP
+	t.port = lsn.port()
 
-	t.wg.OnError(func(err error) error {
-		var c core.Catcher
-
-		defer t.initiateShutdown()
-
-		_ = c.Try(func() error {
-			t.onError(err)
-			return nil
-		})
-
-		return err
-	})
+	if fn := config.OnAdvertiseChange; fn != nil {
+		t.onAdvertise.Store(&fn)
+	}
 
-	// and start
-	for i := range t.tcpListeners {
-		tcpLn := t.tcpListeners[i]
-		udpLn := t.udpListeners[i]
+	if fn := config.OnError; fn != nil {
+		t.onError = append(t.onError, fn)
+	}
 
-		t.wg.Go(func() error {
-			return t.tcpLoop(ctx, tcpLn)
-		})
+	t.wg.OnError(t.fail)
 
-		t.wg.Go(func() error {
-			return t.udpLoop(ctx, udpLn)
-		})
-	}
+	// and start, one worker per socket
+	t.startListeners(lsn)
+	t.startRelays()
+	t.startWatcher(config)
 
 	return t, nil
 }
@@ -137,23 +169,63 @@ func newTransport(config *Config, lsn *Listeners) (*Transport, error) {
 func (t *Transport) Shutdown() error {
 	t.initiateShutdown()
 
-	_ = t.wg.Wait()
+	<-t.done
 	return nil
 }
 
+// goWorker spawns a worker unless the Transport is stopping,
+// reporting false if it didn't
+func (t *Transport) goWorker(fn func() error) bool {
+	t.wgMu.Lock()
+	defer t.wgMu.Unlock()
+
+	if t.cancelled.Load() {
+		return false
+	}
+
+	t.wg.Go(fn)
+	return true
+}
+
+// stop marks the Transport as stopping, reporting false if it
+// already was. No more workers are spawned after this, and done
+// is closed once the running ones exit
+func (t *Transport) stop() bool {
+	t.wgMu.Lock()
+	defer t.wgMu.Unlock()
+
+	if !t.cancelled.CompareAndSwap(false, true) {
+		return false
+	}
+
+	go func() {
+		defer close(t.done)
+		_ = t.wg.Wait()
+	}()
+	return true
+}
+
 func (t *Transport) initiateShutdown() {
-	if t.cancelled.CompareAndSwap(false, true) {
+	if t.stop() {
 		// stop workers
 		t.cancel()
 
 		// close ports
-		for i := range t.tcpListeners {
-			_ = t.tcpListeners[i].Close()
-		}
+		t.closeListeners()
 
-		for i := range t.udpListeners {
-			_ = t.udpListeners[i].Close()
-		}
+		// and tunnels
+		t.relays.closeAll()
+	}
+}
+
+func (t *Transport) closeListeners() {
+	tcpListeners, udpListeners := t.listeners()
+	for i := range tcpListeners {
+		_ = tcpListeners[i].Close()
+	}
+
+	for i := range udpListeners {
+		_ = udpListeners[i].Close()
 	}
 }
 
@@ -166,20 +238,18 @@ func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error)
 	if ip != "" {
 		// use given
 		addr, err = core.ParseAddr(ip)
+		t.selfFixed.Store(true)
 	} else {
 		// listener address
-		lsnAddr := t.tcpListeners[0]
-		if addrPort, ok := core.AddrPort(lsnAddr); !ok {
-			err = core.NewUnreachableErrorf(0, nil, "impossible listener address: %v", lsnAddr)
-		} else {
-			addr = addrPort.Addr()
-			port = int(addrPort.Port())
-		}
+		addr, port, err = t.listenerAddr()
+		t.selfFixed.Store(false)
 	}
 
 	if err == nil {
 		addr, err = t.doFinalAdvertiseAddr(addr)
 		if err == nil && addr.IsValid() {
+			addr = addr.Unmap()
+			t.setSelf(netip.AddrPortFrom(addr, uint16(port)))
 			return addr.AsSlice(), port, nil
 		}
 	}
@@ -187,6 +257,43 @@ func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error)
 	return t.failFinalAdvertiseAddr(err)
 }
 
+// listenerAddr returns the address and port of the first TCP listener
+func (t *Transport) listenerAddr() (netip.Addr, int, error) {
+	tcpListeners, _ := t.listeners()
+	if len(tcpListeners) == 0 {
+		return netip.Addr{}, 0, net.ErrClosed
+	}
+
+	lsnAddr := tcpListeners[0].Addr()
+	addrPort, ok := core.AddrPort(lsnAddr)
+	if !ok {
+		err := core.NewUnreachableErrorf(0, nil, "impossible listener address: %v", lsnAddr)
+		return netip.Addr{}, 0, err
+	}
+
+	return addrPort.Addr(), int(addrPort.Port()), nil
+}
+
+// setSelf remembers the address we advertise
+func (t *Transport) setSelf(addr netip.AddrPort) {
+	t.selfAddr.Store(addr.String())
+	t.selfOnce.Do(func() {
+		close(t.selfReady)
+	})
+}
+
+// self returns the host:port we advertise, if known
+func (t *Transport) self() string {
+	s, _ := t.selfAddr.Load().(string)
+	return s
+}
+
+// AdvertiseAddr returns the address and port we advertise, if known
+func (t *Transport) AdvertiseAddr() (netip.AddrPort, bool) {
+	ap, err := netip.ParseAddrPort(t.self())
+	return ap, err == nil
+}
+
 func (t *Transport) failFinalAdvertiseAddr(err error) (net.IP, int, error) {
 	s := "Failed to get IP Address to advertise"
 	t.error(err).Print(s)
@@ -196,27 +303,6 @@ func (t *Transport) failFinalAdvertiseAddr(err error) (net.IP, int, error) {
 	return nil, 0, err
 }
 
-func (*Transport) doFinalAdvertiseAddr(addr netip.Addr) (netip.Addr, error) {
-	var addrs []netip.Addr
-	var err error
-
-	if addr.IsValid() && !addr.IsUnspecified() {
-		return addr, nil
-	}
-
-	// listening all addresses, pick one
-	ifaces, _ := core.GetInterfacesNames("lo")
-	if len(ifaces) > 0 {
-		addrs, _ = core.GetIPAddresses(ifaces...)
-	}
-	if len(addrs) == 0 {
-		addrs, err = core.GetIPAddresses()
-	}
-
-	if len(addrs) > 0 {
-		// pick the first
-		return addrs[0], nil
-	}
-
-	return netip.Addr{}, err
+func (t *Transport) doFinalAdvertiseAddr(addr netip.Addr) (netip.Addr, error) {
+	return ResolveAdvertiseAddr(addr, t.advertise)
 }
@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShutdownWhileAddingListeners checks workers spawned while
+// shutting down don't race with waiting for them
+func TestShutdownWhileAddingListeners(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		tr, _ := newTestTransport(t, &Config{})
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = tr.AddListener("127.0.0.2")
+		}()
+
+		_ = tr.Shutdown()
+		wg.Wait()
+
+		select {
+		case <-tr.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("workers still running after Shutdown")
+		}
+	}
+}
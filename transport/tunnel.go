@@ -0,0 +1,469 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// tunnelMagic is sent by the dialing side of a tunnel. Its first
+	// byte can't be mistaken for a memberlist message type
+	tunnelMagic = "GCTN\x02"
+
+	tunnelHeaderSize   = 9
+	tunnelMaxFrameSize = udpPacketBufSize + 256
+	tunnelStreamQueue  = 64
+
+	tunnelNonceSize = 16
+	tunnelMACSize   = sha256.Size
+)
+
+// tunnel frame types
+const (
+	// frameHello carries the flags and address of the dialing side
+	frameHello byte = iota + 1
+	// framePacket delivers a packet, and carries its origin
+	framePacket
+	// frameForward asks a relay to deliver a packet, and carries
+	// its destination
+	frameForward
+	// frameOpen delivers a new stream, and carries its origin
+	frameOpen
+	// frameOpenForward asks a relay to deliver a new stream, and
+	// carries its destination
+	frameOpenForward
+	// frameData carries stream data
+	frameData
+	// frameClose terminates a stream
+	frameClose
+	// frameChallenge carries the nonce the accepting side wants
+	// the hello to be authenticated with
+	frameChallenge
+)
+
+const (
+	// helloReceive indicates the dialing side wants to receive
+	// packets and streams through the tunnel
+	helloReceive byte = 1 << iota
+)
+
+var (
+	errTunnelClosed   = errors.New("tunnel closed")
+	errTunnelProtocol = errors.New("tunnel protocol error")
+	errTunnelAuth     = errors.New("tunnel not authenticated")
+)
+
+// tunnelHandler receives what arrives through a tunnel
+type tunnelHandler interface {
+	tunnelPacket(tun *tunnel, ft byte, addr string, b []byte)
+	tunnelStream(tun *tunnel, ft byte, addr string, conn net.Conn)
+	tunnelClosed(tun *tunnel)
+}
+
+// tunnel multiplexes packets and streams over a single TCP connection
+type tunnel struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler tunnelHandler
+	// secret authenticates the hello
+	secret []byte
+
+	// peer is the address the other side is known by
+	peer  string
+	flags byte
+
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	streams map[uint32]*tunnelStream
+	nextID  atomic.Uint32
+	closed  atomic.Bool
+}
+
+func newTunnel(conn net.Conn, br *bufio.Reader, dialer bool, h tunnelHandler,
+	secret []byte) *tunnel {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+
+	tun := &tunnel{
+		conn:    conn,
+		br:      br,
+		handler: h,
+		secret:  secret,
+		streams: make(map[uint32]*tunnelStream),
+	}
+
+	// the dialer uses odd stream IDs, the acceptor even
+	if dialer {
+		tun.nextID.Store(1)
+	} else {
+		tun.nextID.Store(2)
+	}
+
+	return tun
+}
+
+// hello sends the preamble from the dialing side, authenticated
+// with the nonce the accepting side challenges us with
+func (tun *tunnel) hello(self string, flags byte) error {
+	if _, err := io.WriteString(tun.conn, tunnelMagic); err != nil {
+		return err
+	}
+
+	ft, _, nonce, err := tun.readFrame()
+	switch {
+	case err != nil:
+		return err
+	case ft != frameChallenge || len(nonce) != tunnelNonceSize:
+		return errTunnelProtocol
+	}
+
+	mac := tunnelMAC(tun.secret, nonce, flags, self)
+	return tun.writeFrame(frameHello, 0, []byte{flags}, mac, []byte(self))
+}
+
+// readHello challenges the dialing side and reads its preamble,
+// after the magic has been consumed
+func (tun *tunnel) readHello() error {
+	nonce := make([]byte, tunnelNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if err := tun.writeFrame(frameChallenge, 0, nonce); err != nil {
+		return err
+	}
+
+	ft, _, payload, err := tun.readFrame()
+	switch {
+	case err != nil:
+		return err
+	case ft != frameHello || len(payload) < 2+tunnelMACSize:
+		return errTunnelProtocol
+	}
+
+	flags, mac, self := payload[0], payload[1:1+tunnelMACSize], payload[1+tunnelMACSize:]
+	if !hmac.Equal(mac, tunnelMAC(tun.secret, nonce, flags, string(self))) {
+		return errTunnelAuth
+	}
+
+	tun.flags = flags
+	tun.peer = string(self)
+	return nil
+}
+
+// tunnelMAC authenticates the hello of a tunnel
+func tunnelMAC(secret, nonce []byte, flags byte, self string) []byte {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write(nonce)
+	_, _ = h.Write([]byte{flags})
+	_, _ = h.Write([]byte(self))
+	return h.Sum(nil)
+}
+
+// serve reads frames until the tunnel fails or the context
+// is cancelled
+func (tun *tunnel) serve(ctx context.Context) error {
+	defer tun.close()
+	defer context.AfterFunc(ctx, tun.close)()
+
+	for {
+		ft, id, payload, err := tun.readFrame()
+		if err != nil {
+			return err
+		}
+
+		if err := tun.dispatch(ft, id, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (tun *tunnel) dispatch(ft byte, id uint32, payload []byte) error {
+	switch ft {
+	case framePacket, frameForward:
+		addr, b, err := splitAddrPayload(payload)
+		if err != nil {
+			return err
+		}
+		tun.handler.tunnelPacket(tun, ft, addr, b)
+	case frameOpen, frameOpenForward:
+		s := tun.newStream(id)
+		tun.handler.tunnelStream(tun, ft, string(payload), s.conn(tun, string(payload)))
+	case frameData:
+		if s := tun.getStream(id); s != nil {
+			s.deliver(payload)
+		}
+	case frameClose:
+		if s := tun.getStream(id); s != nil {
+			s.closeRemote()
+		}
+	default:
+		return errTunnelProtocol
+	}
+	return nil
+}
+
+func splitAddrPayload(payload []byte) (string, []byte, error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return "", nil, errTunnelProtocol
+	}
+
+	n := 1 + int(payload[0])
+	return string(payload[1:n]), payload[n:], nil
+}
+
+func (tun *tunnel) readFrame() (byte, uint32, []byte, error) {
+	var hdr [tunnelHeaderSize]byte
+
+	if _, err := io.ReadFull(tun.br, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	ft := hdr[0]
+	id := binary.BigEndian.Uint32(hdr[1:])
+	size := binary.BigEndian.Uint32(hdr[5:])
+	if size > tunnelMaxFrameSize {
+		return 0, 0, nil, errTunnelProtocol
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(tun.br, payload); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return ft, id, payload, nil
+}
+
+func (tun *tunnel) writeFrame(ft byte, id uint32, parts ...[]byte) error {
+	tun.wmu.Lock()
+	defer tun.wmu.Unlock()
+
+	if tun.closed.Load() {
+		return errTunnelClosed
+	}
+
+	return tun.unsafeWriteFrame(ft, id, parts...)
+}
+
+func (tun *tunnel) unsafeWriteFrame(ft byte, id uint32, parts ...[]byte) error {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+
+	buf := make([]byte, tunnelHeaderSize, tunnelHeaderSize+size)
+	buf[0] = ft
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint32(buf[5:], uint32(size))
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+
+	_, err := tun.conn.Write(buf)
+	if err != nil {
+		go tun.close()
+	}
+	return err
+}
+
+// sendPacket sends a packet frame with the origin or destination address
+func (tun *tunnel) sendPacket(ft byte, addr string, b []byte) error {
+	if len(addr) > 255 {
+		return errTunnelProtocol
+	}
+	return tun.writeFrame(ft, 0, []byte{byte(len(addr))}, []byte(addr), b)
+}
+
+// open opens a new stream with the origin or destination address
+func (tun *tunnel) open(ft byte, addr string) (net.Conn, error) {
+	id := tun.nextID.Add(2) - 2
+	s := tun.newStream(id)
+
+	if err := tun.writeFrame(ft, id, []byte(addr)); err != nil {
+		tun.removeStream(id)
+		return nil, err
+	}
+
+	return s.conn(tun, addr), nil
+}
+
+func (tun *tunnel) newStream(id uint32) *tunnelStream {
+	s := newTunnelStream(tun, id)
+
+	tun.mu.Lock()
+	tun.streams[id] = s
+	tun.mu.Unlock()
+
+	return s
+}
+
+func (tun *tunnel) getStream(id uint32) *tunnelStream {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+
+	return tun.streams[id]
+}
+
+func (tun *tunnel) removeStream(id uint32) {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+
+	delete(tun.streams, id)
+}
+
+// close terminates the tunnel and all its streams
+func (tun *tunnel) close() {
+	if !tun.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	_ = tun.conn.Close()
+
+	tun.mu.Lock()
+	streams := tun.streams
+	tun.streams = make(map[uint32]*tunnelStream)
+	tun.mu.Unlock()
+
+	for _, s := range streams {
+		s.closeRemote()
+	}
+
+	tun.handler.tunnelClosed(tun)
+}
+
+// tunnelStream is one stream within a tunnel. The local end of a pipe
+// is given to memberlist while the other is pumped through the tunnel
+type tunnelStream struct {
+	tun    *tunnel
+	id     uint32
+	local  net.Conn
+	remote net.Conn
+
+	mu     sync.Mutex
+	in     chan []byte
+	closed bool
+}
+
+func newTunnelStream(tun *tunnel, id uint32) *tunnelStream {
+	local, remote := net.Pipe()
+	s := &tunnelStream{
+		tun:    tun,
+		id:     id,
+		local:  local,
+		remote: remote,
+		in:     make(chan []byte, tunnelStreamQueue),
+	}
+
+	go s.inbound()
+	go s.outbound()
+	return s
+}
+
+// conn returns the local end, presenting the peer's address as remote
+func (s *tunnelStream) conn(tun *tunnel, addr string) net.Conn {
+	if addr == "" {
+		addr = tun.peer
+	}
+
+	return &tunnelConn{
+		Conn:   s.local,
+		local:  tun.conn.LocalAddr(),
+		remote: tunnelAddr(addr),
+	}
+}
+
+// deliver queues data received through the tunnel. If the stream
+// can't keep up it's reset instead of holding the whole tunnel
+func (s *tunnelStream) deliver(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.in <- b:
+	default:
+		// too slow, outbound will tell the other side
+		s.unsafeClose()
+		_ = s.remote.Close()
+	}
+}
+
+// closeRemote handles the other side closing the stream
+func (s *tunnelStream) closeRemote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unsafeClose()
+}
+
+func (s *tunnelStream) unsafeClose() {
+	if !s.closed {
+		s.closed = true
+		s.tun.removeStream(s.id)
+		close(s.in)
+	}
+}
+
+// inbound writes received data into the pipe
+func (s *tunnelStream) inbound() {
+	defer s.remote.Close()
+
+	for b := range s.in {
+		if _, err := s.remote.Write(b); err != nil {
+			break
+		}
+	}
+
+	// drain
+	for range s.in {
+	}
+}
+
+// outbound sends what memberlist writes through the tunnel
+func (s *tunnelStream) outbound() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.remote.Read(buf)
+		if n > 0 {
+			if s.tun.writeFrame(frameData, s.id, buf[:n]) != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	_ = s.tun.writeFrame(frameClose, s.id)
+	s.closeRemote()
+}
+
+// tunnelConn is the net.Conn handed to memberlist for tunnelled streams
+type tunnelConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+// tunnelAddr is the net.Addr of a peer reached through a tunnel
+type tunnelAddr string
+
+func (tunnelAddr) Network() string  { return "tcp" }
+func (a tunnelAddr) String() string { return string(a) }
@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+var testTunnelSecret = []byte("tunnel secret")
+
+// newTestTransport starts a Transport on loopback, advertising
+// its listening address
+func newTestTransport(t *testing.T, config *Config) (*Transport, string) {
+	t.Helper()
+
+	config.BindAddress = []string{"127.0.0.1"}
+	tr, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tr.Shutdown() })
+
+	ip, port, err := tr.FinalAdvertiseAddr("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: ip, Port: port}
+	return tr, addr.String()
+}
+
+// listenBlockedUDP binds UDP sockets on a random port instead of
+// the requested, so packets sent to the node are lost as if
+// inbound UDP was blocked
+func listenBlockedUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP(network, &net.UDPAddr{IP: laddr.IP})
+}
+
+func expectPacket(t *testing.T, tr *Transport, payload string, timeout time.Duration) *memberlist.Packet {
+	t.Helper()
+
+	select {
+	case msg := <-tr.PacketCh():
+		if s := string(msg.Buf); s != payload {
+			t.Fatalf("expected %q, got %q", payload, s)
+		}
+		return msg
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func waitTunnelClient(t *testing.T, relay *Transport, addr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for relay.relays.getClient(addr) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTunnelBlockedUDP simulates a node that can't receive UDP
+// keeping a tunnel to a relay, and another node reaching it through
+// the relay
+func TestTunnelBlockedUDP(t *testing.T) {
+	relay, relayAddr := newTestTransport(t, &Config{
+		AcceptTunnels: true,
+		TunnelSecret:  testTunnelSecret,
+	})
+
+	blocked, blockedAddr := newTestTransport(t, &Config{
+		ListenUDP:    listenBlockedUDP,
+		Relays:       []string{relayAddr},
+		TunnelSecret: testTunnelSecret,
+	})
+
+	other, otherAddr := newTestTransport(t, &Config{
+		Routes: map[string]Route{
+			"blocked": {Relay: relayAddr},
+		},
+		TunnelSecret: testTunnelSecret,
+	})
+
+	waitTunnelClient(t, relay, blockedAddr)
+
+	// direct UDP is lost
+	if _, err := other.WriteTo([]byte("direct"), blockedAddr); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectPacket(t, blocked, "direct", 200*time.Millisecond); msg != nil {
+		t.Fatal("UDP not blocked")
+	}
+
+	// the relay sends through the tunnel
+	if _, err := relay.WriteTo([]byte("from relay"), blockedAddr); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectPacket(t, blocked, "from relay", 5*time.Second); msg == nil {
+		t.Fatal("packet from the relay lost")
+	}
+
+	// others have the relay forward
+	dest := memberlist.Address{Addr: blockedAddr, Name: "blocked"}
+	if _, err := other.WriteToAddress([]byte("forwarded"), dest); err != nil {
+		t.Fatal(err)
+	}
+	switch msg := expectPacket(t, blocked, "forwarded", 5*time.Second); {
+	case msg == nil:
+		t.Fatal("forwarded packet lost")
+	case msg.From.String() != otherAddr:
+		t.Fatalf("forwarded packet from %q, expected %q", msg.From, otherAddr)
+	}
+
+	// and streams too
+	go func() {
+		conn := <-blocked.StreamCh()
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := other.DialAddressTimeout(dest, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn, "ping")
+}
+
+// assertClosed checks a stream was closed by the other end
+func assertClosed(t *testing.T, conn net.Conn, what string) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal(what, "outlived Shutdown")
+	}
+}
+
+// TestTunnelShutdownStreams checks the streams a relay is still
+// inspecting or splicing don't outlive it
+func TestTunnelShutdownStreams(t *testing.T) {
+	relay, relayAddr := newTestTransport(t, &Config{
+		AcceptTunnels: true,
+		TunnelSecret:  testTunnelSecret,
+	})
+
+	blocked, blockedAddr := newTestTransport(t, &Config{
+		ListenUDP:    listenBlockedUDP,
+		Relays:       []string{relayAddr},
+		TunnelSecret: testTunnelSecret,
+	})
+
+	other, _ := newTestTransport(t, &Config{
+		Routes: map[string]Route{
+			"blocked": {Relay: relayAddr},
+		},
+		TunnelSecret: testTunnelSecret,
+	})
+
+	waitTunnelClient(t, relay, blockedAddr)
+
+	// a stream spliced through the relay
+	go func() {
+		conn := <-blocked.StreamCh()
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	dest := memberlist.Address{Addr: blockedAddr, Name: "blocked"}
+	spliced, err := other.DialAddressTimeout(dest, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spliced.Close()
+	assertEcho(t, spliced, "ping")
+
+	// and a client yet to say what it is
+	silent, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := relay.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertClosed(t, silent, "silent client")
+	assertClosed(t, spliced, "spliced stream")
+}
+
+func TestTunnelBadSecret(t *testing.T) {
+	relay, relayAddr := newTestTransport(t, &Config{
+		AcceptTunnels: true,
+		TunnelSecret:  testTunnelSecret,
+	})
+
+	_, intruderAddr := newTestTransport(t, &Config{
+		Relays:       []string{relayAddr},
+		TunnelSecret: []byte("wrong secret"),
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	if relay.relays.getClient(intruderAddr) != nil {
+		t.Fatal("tunnel with the wrong secret accepted")
+	}
+}
+
+func TestTunnelAcceptRequiresSecret(t *testing.T) {
+	cfg := &Config{AcceptTunnels: true}
+	if err := cfg.SetDefaults(); err == nil {
+		t.Fatal("AcceptTunnels without TunnelSecret accepted")
+	}
+}
+
+// TestTunnelSlowStream checks a stream nobody reads is reset
+// instead of holding the tunnel
+func TestTunnelSlowStream(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() { _, _ = io.Copy(io.Discard, b) }()
+
+	tun := newTunnel(a, nil, true, nopTunnelHandler{}, testTunnelSecret)
+	s := tun.newStream(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*tunnelStreamQueue; i++ {
+			s.deliver([]byte("data"))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow stream holds the tunnel")
+	}
+
+	if tun.getStream(1) != nil {
+		t.Fatal("slow stream not reset")
+	}
+}
+
+type nopTunnelHandler struct{}
+
+func (nopTunnelHandler) tunnelPacket(*tunnel, byte, string, []byte)   {}
+func (nopTunnelHandler) tunnelStream(*tunnel, byte, string, net.Conn) {}
+func (nopTunnelHandler) tunnelClosed(*tunnel)                         {}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"net"
 	"time"
 
@@ -34,12 +35,25 @@ func setUDPRecvBuffer(udpLn *net.UDPConn) (int, error) {
 
 // WriteToAddress is used by memberlist to send a UDP message to a particular Node
 func (t *Transport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr.Addr)
+	r := t.routes.get(addr)
+	target := r.Target(addr.Addr)
+	b = t.compress.compressPacket(b, addr.Addr)
+
+	if ok, err := t.writeToTunnel(b, addr.Addr, r); ok {
+		return time.Now(), err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", target)
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	_, err = t.udpListeners[0].WriteTo(b, udpAddr)
+	_, udpListeners := t.listeners()
+	if len(udpListeners) == 0 {
+		return time.Time{}, net.ErrClosed
+	}
+
+	_, err = udpListeners[0].WriteTo(b, udpAddr)
 	return time.Now(), err
 }
 
@@ -73,11 +87,18 @@ func (t *Transport) udpLoop(ctx context.Context, ln *net.UDPConn) error {
 
 		if err != nil {
 			// error
-			if t.cancelled.Load() {
-				// shutdown in process, ignore error and exit
+			if t.cancelled.Load() || !t.hasUDPListener(ln) {
+				// shutdown in process or listener removed,
+				// ignore error and exit
 				return nil
 			}
 
+			if errors.Is(err, net.ErrClosed) {
+				// closed behind our back
+				return err
+			}
+
+			t.noteListenerError(ln, err)
 			t.error(err).
 				WithField(ListenerAddrLabel, ln.LocalAddr()).
 				Print("Error reading UDP packet")
@@ -99,19 +120,40 @@ func (t *Transport) udpLoop(ctx context.Context, ln *net.UDPConn) error {
 				Timestamp: ts,
 			}
 
-			select {
-			case t.packetCh <- msg:
-				// continue
-			case <-ctx.Done():
-				err := ctx.Err()
-				// cancelled
-				t.error(err).
-					WithField(ListenerAddrLabel, ln.LocalAddr()).
-					WithField(RemoteAddrLabel, addr).
-					WithField(PacketSizeLabel, n).
-					Print("UDP packet discarded")
+			if err := t.deliverPacket(ctx, msg); err != nil {
 				return err
 			}
 		}
 	}
 }
+
+// deliverPacket passes an inbound packet to memberlist
+func (t *Transport) deliverPacket(ctx context.Context, msg *memberlist.Packet) error {
+	buf, err := t.compress.decompressPacket(msg.Buf, msg.From)
+	if err != nil {
+		// drop
+		t.error(err).
+			WithField(RemoteAddrLabel, msg.From).
+			WithField(PacketSizeLabel, len(msg.Buf)).
+			Print("Invalid compressed packet")
+		return nil
+	}
+	msg.Buf = buf
+
+	t.pendingPackets.Add(1)
+	defer t.pendingPackets.Add(-1)
+
+	select {
+	case t.packetCh <- msg:
+		t.lastPacket.Store(time.Now().UnixNano())
+		return nil
+	case <-ctx.Done():
+		err := ctx.Err()
+		// cancelled
+		t.error(err).
+			WithField(RemoteAddrLabel, msg.From).
+			WithField(PacketSizeLabel, len(msg.Buf)).
+			Print("UDP packet discarded")
+		return err
+	}
+}
@@ -0,0 +1,388 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"github.com/hashicorp/memberlist"
+)
+
+var (
+	_ memberlist.Transport          = (*UnixTransport)(nil)
+	_ memberlist.NodeAwareTransport = (*UnixTransport)(nil)
+)
+
+// UnixTransport implements a memberlist.Transport for nodes running
+// on the same host, using Unix stream and datagram sockets in a shared
+// directory instead of TCP and UDP. Nodes are still identified by
+// IP address and port, which are mapped to the socket paths
+type UnixTransport struct {
+	wg        core.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled atomic.Bool
+	onError   func(err error)
+	log       slog.Logger
+
+	dir  string
+	addr netip.AddrPort
+
+	streamLn *net.UnixListener
+	packetLn *net.UnixConn
+	streamCh chan net.Conn
+	packetCh chan *memberlist.Packet
+}
+
+// NewUnix creates a new UnixTransport based on the given configuration.
+// If succeeds, the created transport needs to be explicitly Shutdown()
+// once it's no longer used
+func NewUnix(config *UnixConfig) (*UnixTransport, error) {
+	if config == nil {
+		config = &UnixConfig{}
+	}
+
+	if err := config.SetDefaults(); err != nil {
+		// bad config
+		return nil, err
+	}
+
+	ip, err := core.ParseAddr(config.Addr)
+	if err != nil {
+		return nil, core.Wrap(err, "Addr")
+	}
+
+	ctx, cancel := context.WithCancel(config.Context)
+
+	t := &UnixTransport{
+		ctx:     ctx,
+		cancel:  cancel,
+		log:     config.Logger,
+		onError: config.OnError,
+		dir:     config.Dir,
+
+		streamCh: make(chan net.Conn),
+		packetCh: make(chan *memberlist.Packet),
+	}
+
+	if err := t.listen(ip.Unmap(), config); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	t.wg.OnError(func(err error) error {
+		var c core.Catcher
+
+		defer t.initiateShutdown()
+
+		_ = c.Try(func() error {
+			if t.onError != nil {
+				t.onError(err)
+			}
+			return nil
+		})
+
+		return err
+	})
+
+	t.wg.Go(t.streamLoop)
+	t.wg.Go(t.packetLoop)
+
+	return t, nil
+}
+
+// listen opens the sockets for the first available port
+func (t *UnixTransport) listen(ip netip.Addr, config *UnixConfig) error {
+	var err error
+
+	port := config.Port
+	for i := 0; i < config.PortRetry; i++ {
+		addr := netip.AddrPortFrom(ip, uint16(port))
+
+		err = t.listenAddr(addr)
+		if err == nil || config.PortStrict {
+			return err
+		}
+
+		port++
+	}
+
+	return err
+}
+
+// listenAddr opens the sockets for the given memberlist address,
+// removing them first if left behind by a dead process
+func (t *UnixTransport) listenAddr(addr netip.AddrPort) error {
+	stream, packet := UnixSocketPaths(t.dir, addr.String())
+
+	if unixSocketInUse(stream) {
+		return &os.PathError{Op: "listen", Path: stream, Err: os.ErrExist}
+	}
+
+	// stale
+	_ = os.Remove(stream)
+	_ = os.Remove(packet)
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: stream, Net: "unix"})
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: packet, Net: "unixgram"})
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+
+	t.addr = addr
+	t.streamLn = ln
+	t.packetLn = pc
+	return nil
+}
+
+// unixSocketInUse tells if a process is listening on a stream socket
+func unixSocketInUse(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// Shutdown closes the sockets and cancels the workers, and then
+// waits until all workers have exited
+func (t *UnixTransport) Shutdown() error {
+	t.initiateShutdown()
+
+	_ = t.wg.Wait()
+	return nil
+}
+
+func (t *UnixTransport) initiateShutdown() {
+	if t.cancelled.CompareAndSwap(false, true) {
+		// stop workers
+		t.cancel()
+
+		// close sockets. datagram sockets aren't unlinked on Close
+		_ = t.streamLn.Close()
+		_ = t.packetLn.Close()
+		_ = os.Remove(t.packetLn.LocalAddr().String())
+	}
+}
+
+// FinalAdvertiseAddr is used by memberlist to find what address and port to
+// advertise to other nodes. They can only be those the sockets are
+// named after
+func (t *UnixTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	addr := t.addr.Addr()
+	if ip != "" {
+		ip2, err := core.ParseAddr(ip)
+		if err != nil || ip2.Unmap() != addr || (port != 0 && port != int(t.addr.Port())) {
+			err = fmt.Errorf("can't advertise %s, sockets are named after %s",
+				net.JoinHostPort(ip, strconv.Itoa(port)), t.addr)
+
+			errorLogger(t.log, err).Print("Failed to get IP Address to advertise")
+			return nil, 0, err
+		}
+	}
+
+	return addr.AsSlice(), int(t.addr.Port()), nil
+}
+
+// WriteToAddress is used by memberlist to send a message to a particular Node
+func (t *UnixTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	_, packet := UnixSocketPaths(t.dir, addr.Addr)
+
+	_, err := t.packetLn.WriteToUnix(b, &net.UnixAddr{Name: packet, Net: "unixgram"})
+	return time.Now(), err
+}
+
+// WriteTo is used by memberlist to send a message to a particular address
+func (t *UnixTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	peer := memberlist.Address{
+		Addr: addr,
+	}
+	return t.WriteToAddress(b, peer)
+}
+
+// PacketCh is used by memberlist to receive messages
+func (t *UnixTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialAddressTimeout is used by memberlist to establish a stream to a particular node
+func (t *UnixTransport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (
+	net.Conn, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	stream, _ := UnixSocketPaths(t.dir, addr.Addr)
+
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", stream)
+}
+
+// DialTimeout is used by memberlist to establish a stream to a particular address
+func (t *UnixTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	peer := memberlist.Address{
+		Addr: addr,
+	}
+	return t.DialAddressTimeout(peer, timeout)
+}
+
+// StreamCh is used by memberlist to receive incoming streams
+func (t *UnixTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// streamLoop is the main routine of the stream listening worker
+func (t *UnixTransport) streamLoop() error {
+	ln := t.streamLn
+
+	// we explicitly close the listener because we could be interrupted
+	// by the cancellation of the parent Context instead of Shutdown()
+	defer ln.Close()
+	stop := context.AfterFunc(t.ctx, t.initiateShutdown)
+	defer stop()
+
+	for {
+		conn, err := ln.AcceptUnix()
+		switch {
+		case err == nil:
+			debugLogger(t.log).
+				WithField(ListenerAddrLabel, ln.Addr()).
+				Print("Connected")
+
+			if err := t.deliverStream(conn); err != nil {
+				return err
+			}
+		case t.cancelled.Load():
+			// shutdown in process, ignore error and exit
+			return nil
+		case errors.Is(err, net.ErrClosed):
+			return err
+		default:
+			errorLogger(t.log, err).
+				WithField(ListenerAddrLabel, ln.Addr()).
+				Print("Error accepting Unix connection")
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func (t *UnixTransport) deliverStream(conn net.Conn) error {
+	select {
+	case t.streamCh <- conn:
+		return nil
+	case <-t.ctx.Done():
+		err := t.ctx.Err()
+		// sorry pal, we are cancelled
+		errorLogger(t.log, err).
+			WithField(ListenerAddrLabel, conn.LocalAddr()).
+			Print("Connection Terminated")
+
+		_ = conn.Close()
+		return err
+	}
+}
+
+// revive:disable:cognitive-complexity
+
+// packetLoop is the main routine of the datagram listening worker
+func (t *UnixTransport) packetLoop() error {
+	// revive:enable:cognitive-complexity
+	ln := t.packetLn
+
+	const baseDelay = 5 * time.Millisecond
+	const maxDelay = 1 * time.Second
+
+	var errorDelay time.Duration
+
+	for {
+		buf := make([]byte, udpPacketBufSize)
+		n, from, err := ln.ReadFromUnix(buf)
+		ts := time.Now()
+
+		switch {
+		case err != nil && t.cancelled.Load():
+			// shutdown in process, ignore error and exit
+			return nil
+		case errors.Is(err, net.ErrClosed):
+			return err
+		case err != nil:
+			if errorDelay == 0 {
+				// first
+				errorDelay = baseDelay
+			} else {
+				// again? double the delay
+				errorDelay *= 2
+			}
+
+			if errorDelay > maxDelay {
+				// that's too far
+				errorDelay = maxDelay
+			}
+
+			errorLogger(t.log, err).
+				WithField(ListenerAddrLabel, ln.LocalAddr()).
+				Print("Error reading Unix packet")
+
+			select {
+			case <-time.After(errorDelay):
+				// let's wait a bit
+			case <-t.ctx.Done():
+				// cancelled
+				return nil
+			}
+		case n > 0:
+			errorDelay = 0
+
+			msg := &memberlist.Packet{
+				Buf:       buf[:n],
+				From:      unixPacketFrom(from),
+				Timestamp: ts,
+			}
+
+			if err := t.deliverPacket(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *UnixTransport) deliverPacket(msg *memberlist.Packet) error {
+	select {
+	case t.packetCh <- msg:
+		return nil
+	case <-t.ctx.Done():
+		err := t.ctx.Err()
+		// cancelled
+		errorLogger(t.log, err).
+			WithField(RemoteAddrLabel, msg.From).
+			WithField(PacketSizeLabel, len(msg.Buf)).
+			Print("Unix packet discarded")
+		return err
+	}
+}
+
+// unixPacketFrom converts the socket a packet came from into
+// the memberlist address of the sender
+func unixPacketFrom(from *net.UnixAddr) net.Addr {
+	if from != nil {
+		if ap, ok := unixSocketAddr(from.Name); ok {
+			return net.UDPAddrFromAddrPort(ap)
+		}
+		return from
+	}
+	return &net.UnixAddr{Net: "unixgram"}
+}
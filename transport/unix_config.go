@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"strings"
+
+	"darvaza.org/core"
+	"darvaza.org/slog"
+	"darvaza.org/slog/handlers/discard"
+)
+
+const (
+	// unixStreamSuffix is appended to the address of a node to name
+	// the socket receiving its streams
+	unixStreamSuffix = ".stream"
+	// unixPacketSuffix is appended to the address of a node to name
+	// the socket receiving its packets
+	unixPacketSuffix = ".packet"
+)
+
+// UnixConfig is the configuration data for UnixTransport
+type UnixConfig struct {
+	// Dir is the directory holding the sockets of all the nodes
+	// of the cluster
+	Dir string
+	// Addr is the IP address identifying this node in the cluster.
+	// It's never used on the network. If empty 127.0.0.1 will be used
+	Addr string
+	// Port is the port identifying this node in the cluster. If zero
+	// DefaultPort will be used
+	Port int
+	// PortStrict tells us not to try other ports if the sockets
+	// of the given one are in use
+	PortStrict bool
+	// PortRetry indicates how many times we will try finding a port
+	PortRetry int
+
+	// OnError is called when a worker returns an error, before initiating
+	// a shutdown
+	OnError func(error)
+
+	// Context
+	Context context.Context
+	// Logger is the optional logger to record events
+	Logger slog.Logger
+}
+
+// SetDefaults attempts to fill any configuration gap
+func (cfg *UnixConfig) SetDefaults() error {
+	if cfg.Dir == "" {
+		return core.Wrap(core.ErrInvalid, "Dir")
+	}
+
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1"
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+
+	if cfg.PortRetry < 1 {
+		cfg.PortRetry = DefaultBindRetry
+	}
+
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = discard.New()
+	}
+
+	return nil
+}
+
+// UnixSocketPaths returns the paths of the sockets a node known by
+// memberlist as addr listens on for streams and packets
+func UnixSocketPaths(dir, addr string) (stream, packet string) {
+	base := filepath.Join(dir, addr)
+	return base + unixStreamSuffix, base + unixPacketSuffix
+}
+
+// unixSocketAddr returns the memberlist address of a node
+// from the path of one of its sockets
+func unixSocketAddr(path string) (netip.AddrPort, bool) {
+	s := filepath.Base(path)
+	s = strings.TrimSuffix(s, unixPacketSuffix)
+	s = strings.TrimSuffix(s, unixStreamSuffix)
+
+	ap, err := netip.ParseAddrPort(s)
+	return ap, err == nil
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func newTestUnixTransport(t *testing.T, dir string) (*UnixTransport, string) {
+	t.Helper()
+
+	tr, err := NewUnix(&UnixConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tr.Shutdown() })
+
+	return tr, tr.addr.String()
+}
+
+// TestUnixRoundTrip checks two nodes sharing a directory exchange
+// packets and streams
+func TestUnixRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	a, aAddr := newTestUnixTransport(t, dir)
+	b, bAddr := newTestUnixTransport(t, dir)
+
+	if aAddr == bAddr {
+		t.Fatalf("both nodes on %s", aAddr)
+	}
+
+	// packets
+	if _, err := a.WriteToAddress([]byte("hello"), memberlist.Address{Addr: bAddr}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-b.PacketCh():
+		switch {
+		case string(msg.Buf) != "hello":
+			t.Fatalf("unexpected packet %q", msg.Buf)
+		case msg.From.String() != aAddr:
+			t.Fatalf("packet from %q, expected %q", msg.From, aAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet lost")
+	}
+
+	// and streams
+	go func() {
+		conn := <-b.StreamCh()
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := a.DialTimeout(bAddr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn, "ping")
+}
@@ -0,0 +1,308 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"darvaza.org/core"
+)
+
+var (
+	errLastListener = errors.New("can't remove the last listener")
+)
+
+// listeners returns the current listening sockets. The slices
+// are replaced, never modified, so they can be used without
+// holding the lock
+func (t *Transport) listeners() ([]*net.TCPListener, []*net.UDPConn) {
+	t.lmu.RLock()
+	defer t.lmu.RUnlock()
+
+	return t.tcpListeners, t.udpListeners
+}
+
+func (t *Transport) hasTCPListener(ln *net.TCPListener) bool {
+	tcpListeners, _ := t.listeners()
+	return core.SliceContains(tcpListeners, ln)
+}
+
+func (t *Transport) hasUDPListener(ln *net.UDPConn) bool {
+	_, udpListeners := t.listeners()
+	return core.SliceContains(udpListeners, ln)
+}
+
+// Addresses returns the addresses the Transport is listening on
+func (t *Transport) Addresses() []netip.Addr {
+	tcpListeners, _ := t.listeners()
+
+	out := make([]netip.Addr, 0, len(tcpListeners))
+	for _, ln := range tcpListeners {
+		if ap, ok := core.AddrPort(ln.Addr()); ok {
+			out = append(out, ap.Addr().Unmap())
+		}
+	}
+	return core.SliceUnique(out)
+}
+
+// AddListener starts listening on an additional address, using the
+// same port as the rest. Nothing is done if already listening on it
+func (t *Transport) AddListener(addr string) error {
+	ip, err := core.ParseNetIP(addr)
+	if err != nil {
+		return err
+	}
+
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+
+	switch {
+	case t.cancelled.Load():
+		return net.ErrClosed
+	case t.unsafeListensOn(ip):
+		return nil
+	}
+
+	var lsn Listeners
+	for i := 0; i < max(t.config.BindReusePort, 1); i++ {
+		if _, err := lsn.listenOne(ip, t.port, t.config); err != nil {
+			_ = lsn.Close()
+			return err
+		}
+	}
+
+	// copy on write
+	t.tcpListeners = append(t.tcpListeners[:len(t.tcpListeners):len(t.tcpListeners)], lsn.TCP...)
+	t.udpListeners = append(t.udpListeners[:len(t.udpListeners):len(t.udpListeners)], lsn.UDP...)
+	t.startListeners(&lsn)
+
+	t.debug().
+		WithField(ListenerAddrLabel, lsn.TCP[0].Addr()).
+		Print("Listener added")
+	return nil
+}
+
+// RemoveListener stops listening on the given address, and chooses
+// a new address to advertise if it was the advertised one
+func (t *Transport) RemoveListener(addr string) error {
+	ip, err := core.ParseNetIP(addr)
+	if err != nil {
+		return err
+	}
+
+	if err := t.removeListener(ip); err != nil {
+		return err
+	}
+
+	t.debug().
+		WithField(ListenerAddrLabel, ip).
+		Print("Listener removed")
+
+	t.refreshAdvertise()
+	return nil
+}
+
+func (t *Transport) removeListener(ip net.IP) error {
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+
+	var tcpKeep, tcpGone []*net.TCPListener
+	for _, ln := range t.tcpListeners {
+		if sameIP(ln.Addr(), ip) {
+			tcpGone = append(tcpGone, ln)
+		} else {
+			tcpKeep = append(tcpKeep, ln)
+		}
+	}
+
+	var udpKeep, udpGone []*net.UDPConn
+	for _, ln := range t.udpListeners {
+		if sameIP(ln.LocalAddr(), ip) {
+			udpGone = append(udpGone, ln)
+		} else {
+			udpKeep = append(udpKeep, ln)
+		}
+	}
+
+	switch {
+	case len(tcpGone) == 0:
+		return core.Wrap(core.ErrNotExists, ip.String())
+	case len(tcpKeep) == 0 || len(udpKeep) == 0:
+		return errLastListener
+	}
+
+	// replace before closing, so the workers know they
+	// have to exit
+	t.tcpListeners = tcpKeep
+	t.udpListeners = udpKeep
+
+	for _, ln := range tcpGone {
+		_ = ln.Close()
+	}
+	for _, ln := range udpGone {
+		_ = ln.Close()
+	}
+	return nil
+}
+
+func (t *Transport) unsafeListensOn(ip net.IP) bool {
+	for _, ln := range t.tcpListeners {
+		if sameIP(ln.Addr(), ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameIP(addr net.Addr, ip net.IP) bool {
+	ap, ok := core.AddrPort(addr)
+	if !ok {
+		return false
+	}
+
+	other, ok := netip.AddrFromSlice(ip)
+	return ok && ap.Addr().Unmap() == other.Unmap()
+}
+
+// OnAdvertiseChange sets the function to call when the address
+// to advertise changes, replacing Config.OnAdvertiseChange
+func (t *Transport) OnAdvertiseChange(fn func(netip.AddrPort)) {
+	if fn == nil {
+		t.onAdvertise.Store(nil)
+	} else {
+		t.onAdvertise.Store(&fn)
+	}
+}
+
+// refreshAdvertise chooses a new address to advertise if the current
+// one is no longer on the host or we stopped listening on it, unless
+// memberlist gave us one
+func (t *Transport) refreshAdvertise() {
+	old, ok := t.AdvertiseAddr()
+	switch {
+	case !ok, t.selfFixed.Load():
+		return
+	case t.isLocalAddr(old.Addr()) && t.listensOn(old.Addr()):
+		return
+	}
+
+	addr, port, err := t.listenerAddr()
+	if err == nil {
+		addr, err = t.doFinalAdvertiseAddr(addr)
+	}
+
+	if err != nil {
+		t.error(err).
+			WithField(ListenerAddrLabel, old).
+			Print("Advertised address gone, no replacement")
+		return
+	}
+
+	ap := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+	if ap == old {
+		return
+	}
+
+	t.setSelf(ap)
+	t.debug().
+		WithField(ListenerAddrLabel, ap).
+		Print("Advertised address changed")
+
+	if fn := t.onAdvertise.Load(); fn != nil {
+		(*fn)(ap)
+	}
+}
+
+// listensOn tells if a TCP listener, bound to the address or
+// to the unspecified one, accepts streams to the address
+func (t *Transport) listensOn(addr netip.Addr) bool {
+	tcpListeners, _ := t.listeners()
+	for _, ln := range tcpListeners {
+		ap, ok := core.AddrPort(ln.Addr())
+		if !ok {
+			continue
+		}
+
+		if a := ap.Addr().Unmap(); a == addr.Unmap() || a.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalAddr tells if an address is still present on the host
+func (t *Transport) isLocalAddr(addr netip.Addr) bool {
+	addrs, err := core.GetIPAddresses()
+	if err != nil {
+		// can't tell, assume it is
+		return true
+	}
+
+	return core.SliceContainsFn(addrs, addr, func(a, b netip.Addr) bool {
+		return a.Unmap() == b.Unmap()
+	})
+}
+
+// startWatcher spawns the worker following address changes
+// on the host, if enabled
+func (t *Transport) startWatcher(config *Config) {
+	if interval := config.WatchInterfaces; interval > 0 {
+		t.goWorker(func() error {
+			t.watchLoop(interval)
+			return nil
+		})
+	}
+}
+
+func (t *Transport) watchLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.syncInterfaces()
+			t.refreshAdvertise()
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncInterfaces adds and removes listeners to follow the addresses
+// of BindInterface
+func (t *Transport) syncInterfaces() {
+	if len(t.config.BindInterface) == 0 {
+		return
+	}
+
+	want, err := core.GetIPAddresses(t.config.BindInterface...)
+	if err != nil {
+		t.error(err).Print("Failed to read interface addresses")
+		return
+	}
+
+	have := t.Addresses()
+	for _, addr := range want {
+		if !core.SliceContains(have, addr.Unmap()) {
+			if err := t.AddListener(addr.String()); err != nil {
+				t.error(err).
+					WithField(ListenerAddrLabel, addr).
+					Print("Failed to add listener")
+			}
+		}
+	}
+
+	for _, addr := range have {
+		if !core.SliceContainsFn(want, addr, func(a, b netip.Addr) bool {
+			return a.Unmap() == b
+		}) {
+			if err := t.RemoveListener(addr.String()); err != nil {
+				t.error(err).
+					WithField(ListenerAddrLabel, addr).
+					Print("Failed to remove listener")
+			}
+		}
+	}
+}
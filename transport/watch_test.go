@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// TestRemoveAdvertisedListener checks removing the listener of the
+// advertised address, still present on the host, picks another
+func TestRemoveAdvertisedListener(t *testing.T) {
+	tr, addr := newTestTransport(t, &Config{})
+
+	changed := make(chan netip.AddrPort, 1)
+	tr.OnAdvertiseChange(func(ap netip.AddrPort) {
+		changed <- ap
+	})
+
+	if err := tr.AddListener("127.0.0.2"); err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	if err := tr.RemoveListener("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := netip.MustParseAddrPort(addr)
+	want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), old.Port())
+
+	if ap, _ := tr.AdvertiseAddr(); ap != want {
+		t.Fatalf("advertising %v, expected %v", ap, want)
+	}
+
+	select {
+	case ap := <-changed:
+		if ap != want {
+			t.Fatalf("announced %v, expected %v", ap, want)
+		}
+	default:
+		t.Fatal("change not announced")
+	}
+}
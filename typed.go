@@ -0,0 +1,132 @@
+package gossipcache
+
+import (
+	"context"
+	"time"
+
+	"darvaza.org/core"
+)
+
+// TypedEntry is what a TypedLoader produces for a key
+type TypedEntry[V any] struct {
+	// Value is the content to cache
+	Value V
+	// TTL is how long the Value remains fresh. Zero uses the
+	// Group's default, negative never expires
+	TTL time.Duration
+	// Stale is how long after the TTL the Value can still be
+	// served while a new one is loaded. Zero uses the Group's
+	// default
+	Stale time.Duration
+}
+
+// TypedLoader produces the TypedEntry of a key when it's not cached
+type TypedLoader[K, V any] func(ctx context.Context, key K) (TypedEntry[V], error)
+
+// TypedGroup is a Group whose keys and values are converted
+// using a KeyEncoder and a Codec
+type TypedGroup[K, V any] struct {
+	g     *Group
+	keys  KeyEncoder[K]
+	codec Codec[V]
+}
+
+// NewTypedGroup creates a TypedGroup on the given GossipCache. Values
+// cached with a different Codec tag, like by nodes running older code,
+// are never decoded, they are loaded again once on this node and kept
+// within cacheBytes until they need a refresh
+func NewTypedGroup[K, V any](gc *GossipCache, name string, cacheBytes int64,
+	keys KeyEncoder[K], codec Codec[V], loader TypedLoader[K, V],
+	options ...GroupOption) (*TypedGroup[K, V], error) {
+	switch {
+	case keys == nil:
+		return nil, core.Wrap(core.ErrInvalid, "keys")
+	case codec == nil:
+		return nil, core.Wrap(core.ErrInvalid, "codec")
+	case loader == nil:
+		return nil, core.Wrap(core.ErrInvalid, "loader")
+	}
+
+	tg := &TypedGroup[K, V]{
+		keys:  keys,
+		codec: codec,
+	}
+
+	g, err := gc.NewLoaderGroup(name, cacheBytes, tg.newLoader(loader),
+		tg.withOptions(options)...)
+	if err != nil {
+		return nil, err
+	}
+
+	tg.g = g
+	return tg, nil
+}
+
+// withOptions prepends labelling the values with the Codec tag
+// to the given GroupOptions
+func (tg *TypedGroup[K, V]) withOptions(options []GroupOption) []GroupOption {
+	return append([]GroupOption{withCodecTag(tg.codec.Tag())}, options...)
+}
+
+func (tg *TypedGroup[K, V]) newLoader(loader TypedLoader[K, V]) Loader {
+	return func(ctx context.Context, s string) (Entry, error) {
+		key, err := tg.keys.DecodeKey(s)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		te, err := loader(ctx, key)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		b, err := tg.codec.Encode(te.Value)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		return Entry{
+			Value: b,
+			TTL:   te.TTL,
+			Stale: te.Stale,
+		}, nil
+	}
+}
+
+// Group returns the underlying Group
+func (tg *TypedGroup[K, V]) Group() *Group {
+	return tg.g
+}
+
+// Name returns the name of the Group
+func (tg *TypedGroup[K, V]) Name() string {
+	return tg.g.Name()
+}
+
+// Get returns the value of a key, loading it if needed
+func (tg *TypedGroup[K, V]) Get(ctx context.Context, key K) (V, error) {
+	v, _, err := tg.GetWithInfo(ctx, key)
+	return v, err
+}
+
+// GetWithInfo returns the value of a key and details about it,
+// loading it if needed
+func (tg *TypedGroup[K, V]) GetWithInfo(ctx context.Context, key K) (V, Info, error) {
+	var zero V
+
+	b, info, err := tg.g.GetWithInfo(ctx, tg.keys.EncodeKey(key))
+	if err != nil {
+		return zero, info, err
+	}
+
+	v, err := tg.codec.Decode(b)
+	if err != nil {
+		return zero, info, err
+	}
+	return v, info, nil
+}
+
+// Remove removes a key from the cache of every node
+func (tg *TypedGroup[K, V]) Remove(ctx context.Context, key K) error {
+	return tg.g.Remove(ctx, tg.keys.EncodeKey(key))
+}
@@ -0,0 +1,97 @@
+package gossipcache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"darvaza.org/core"
+)
+
+// newTestTypedGroup creates a TypedGroup as NewTypedGroup does,
+// backed by newTestGroup
+func newTestTypedGroup[K, V any](t *testing.T, name string, keys KeyEncoder[K],
+	codec Codec[V], loader TypedLoader[K, V], options ...GroupOption) *TypedGroup[K, V] {
+	t.Helper()
+
+	tg := &TypedGroup[K, V]{
+		keys:  keys,
+		codec: codec,
+	}
+
+	tg.g = newTestGroup(t, &GossipCache{}, name, tg.newLoader(loader),
+		tg.withOptions(options)...)
+	return tg
+}
+
+func TestTypedGroup(t *testing.T) {
+	var calls atomic.Int32
+
+	tg := newTestTypedGroup(t, "typed", IntKeys[int](), JSONCodec[testValue](1),
+		func(_ context.Context, key int) (TypedEntry[testValue], error) {
+			calls.Add(1)
+			if key < 0 {
+				return TypedEntry[testValue]{}, ErrNotFound
+			}
+			return TypedEntry[testValue]{
+				Value: testValue{Name: "value", Count: key},
+			}, nil
+		})
+
+	ctx := context.Background()
+	expected := testValue{Name: "value", Count: 42}
+	for i := 0; i < 3; i++ {
+		v, err := tg.Get(ctx, 42)
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(v, expected):
+			t.Fatalf("expected %+v, got %+v", expected, v)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected one Loader call, got %v", n)
+	}
+
+	// stored under the encoded key, with the Codec tag
+	b, err := tg.Group().Get(ctx, "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tg.codec.Decode(b); err != nil || !reflect.DeepEqual(v, expected) {
+		t.Fatalf("unexpected raw value %q: %v", b, err)
+	}
+	if tg.g.tag != "json/1" {
+		t.Fatalf("values tagged %q", tg.g.tag)
+	}
+
+	if _, err := tg.Get(ctx, -1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestNewTypedGroupInvalid(t *testing.T) {
+	gc := &GossipCache{}
+	loader := func(context.Context, string) (TypedEntry[string], error) {
+		return TypedEntry[string]{}, nil
+	}
+
+	for _, tc := range []struct {
+		name   string
+		keys   KeyEncoder[string]
+		codec  Codec[string]
+		loader TypedLoader[string, string]
+	}{
+		{"keys", nil, RawCodec[string](1), loader},
+		{"codec", StringKeys[string](), nil, loader},
+		{"loader", StringKeys[string](), RawCodec[string](1), nil},
+	} {
+		_, err := NewTypedGroup(gc, "typed", 1<<20, tc.keys, tc.codec, tc.loader)
+		if !errors.Is(err, core.ErrInvalid) {
+			t.Errorf("%s: expected %v, got %v", tc.name, core.ErrInvalid, err)
+		}
+	}
+}